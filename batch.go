@@ -0,0 +1,452 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Batches build a matrix of targets and goversions for a package. They are
+// created with a POST to /batch. Progress of all builds is streamed at
+// /batch/<id>/events, and the summary is at /batch/<id>. Batches in progress
+// are kept in memory, the summary is stored in data/batch/<id>.json when all
+// builds are done.
+
+// Maximum number of builds in a batch.
+const batchMaxMembers = 64
+
+// batchRequest is the JSON body for POST /batch.
+type batchRequest struct {
+	Module     string
+	Version    string   // Canonical version or query like "latest".
+	Dir        string   // Package directory, like "/cmd/x". Empty means "/".
+	Targets    []string // Like "linux/amd64" or "linux/arm/6".
+	Goversions []string // Like "go1.21.5", "latest" or "module". Empty means "latest".
+}
+
+// Status of a build in a batch.
+const (
+	batchPending = "pending" // Preparing, queued or building.
+	batchSuccess = "success"
+	batchFailed  = "failed"
+)
+
+type batchMember struct {
+	buildSpec
+	Status        string
+	QueuePosition int    `json:",omitempty"` // While pending and queued.
+	Error         string `json:",omitempty"` // If failed.
+	Sum           string `json:",omitempty"` // Remaining fields only on success.
+	Filesize      int64  `json:",omitempty"`
+	Link          string `json:",omitempty"` // Path of result page.
+	DownloadLink  string `json:",omitempty"` // Path of binary.
+
+	seq int64 // Of last change, for sending changes to listeners.
+}
+
+// batchSummary is returned for /batch/<id> and stored when the batch is done.
+type batchSummary struct {
+	ID      string
+	Created time.Time
+	Done    bool
+	Members []batchMember
+}
+
+type batch struct {
+	sync.Mutex
+	summary   batchSummary
+	seq       int64 // Incremented for each change.
+	listeners map[chan struct{}]struct{}
+}
+
+// Batches in progress.
+var batches = struct {
+	sync.Mutex
+	m map[string]*batch
+}{m: map[string]*batch{}}
+
+func batchPath(id string) string {
+	return filepath.Join(config.DataDir, "batch", id+".json")
+}
+
+// Serve POST /batch, creating a batch and starting its builds.
+func serveBatchCreate(w http.ResponseWriter, r *http.Request) {
+	defer observePage("batch", time.Now())
+
+	if r.Method != "POST" {
+		http.Error(w, "405 - Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var breq batchRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&breq); err != nil {
+		failf(w, "parsing batch request: %v", err)
+		return
+	}
+	if !checkAllowedRespond(w, breq.Module) {
+		return
+	}
+	specs, err := batchSpecs(r, breq)
+	if err != nil {
+		failf(w, "%w", err)
+		return
+	}
+
+	buf := make([]byte, 9)
+	if _, err := rand.Read(buf); err != nil {
+		failf(w, "%w: random id: %v", errServer, err)
+		return
+	}
+	b := &batch{
+		summary:   batchSummary{ID: base64.RawURLEncoding.EncodeToString(buf), Created: time.Now().Round(time.Second)},
+		listeners: map[chan struct{}]struct{}{},
+	}
+	for _, bs := range specs {
+		b.summary.Members = append(b.summary.Members, batchMember{buildSpec: bs, Status: batchPending})
+	}
+	batches.Lock()
+	batches.m[b.summary.ID] = b
+	batches.Unlock()
+	metricBatches.Inc()
+
+	client := requestClient(r)
+	for i, bs := range specs {
+		go b.build(i, bs, client)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/batch/"+b.summary.ID)
+	w.WriteHeader(http.StatusCreated)
+	b.Lock()
+	defer b.Unlock()
+	json.NewEncoder(w).Encode(b.summary) // nothing to do for errors
+}
+
+// Resolve the versions in the request, and make the buildSpecs for the matrix.
+func batchSpecs(r *http.Request, breq batchRequest) ([]buildSpec, error) {
+	if len(breq.Targets) == 0 {
+		return nil, fmt.Errorf("no targets")
+	}
+	if len(breq.Goversions) == 0 {
+		breq.Goversions = []string{"latest"}
+	}
+	if n := len(breq.Targets) * len(breq.Goversions); n > batchMaxMembers {
+		return nil, fmt.Errorf("too many builds in batch, %d, max %d", n, batchMaxMembers)
+	}
+
+	dir := "/" + strings.Trim(breq.Dir, "/")
+	if path.Clean(dir) != dir || breq.Module == "" || path.Clean(breq.Module) != breq.Module {
+		return nil, fmt.Errorf("bad module or dir")
+	}
+
+	version := breq.Version
+	if !isCanonicalVersion(version) {
+		info, err := resolveModuleQuery(r.Context(), goproxyURL(), breq.Module, version)
+		if err != nil {
+			return nil, fmt.Errorf("resolving version %q for module: %w", version, err)
+		}
+		version = info.Version
+	}
+
+	// Resolve goversions, and read options and go.mod versions of the module with a
+	// recent toolchain, they are the same for all builds.
+	goversion, err := ensureMostRecentSDK()
+	if err != nil {
+		return nil, fmt.Errorf("ensuring most recent goversion: %w", err)
+	}
+	opts, err := moduleOptions(buildSpec{Mod: breq.Module, Version: version, Goversion: goversion})
+	if err != nil {
+		return nil, fmt.Errorf("reading build options: %w", err)
+	}
+	var goversions []string
+	for _, gv := range breq.Goversions {
+		switch gv {
+		case "latest":
+			gv = goversion
+		case "module":
+			gobin, err := ensureGobin(goversion)
+			if err != nil {
+				return nil, err
+			}
+			modDir, getOutput, err := ensureModule(goversion, gobin, breq.Module, version)
+			if err != nil {
+				return nil, fmt.Errorf("error fetching module from goproxy: %w\n\n# output from go get:\n%s", err, string(getOutput))
+			}
+			v, err := readGoModVersions(modDir)
+			if err != nil {
+				return nil, err
+			}
+			gv = v.resolve()
+		}
+		if _, err := parseGoVersion(gv); err != nil {
+			return nil, fmt.Errorf("%w: %q: %v", errBadGoversion, gv, err)
+		}
+		goversions = append(goversions, gv)
+	}
+
+	var specs []buildSpec
+	seen := map[buildSpec]bool{}
+	for _, gv := range goversions {
+		for _, target := range breq.Targets {
+			t := strings.Split(target, "/")
+			if len(t) != 2 && len(t) != 3 || !isTargetName(t[0]) || !isTargetName(t[1]) {
+				return nil, fmt.Errorf("bad target %q", target)
+			}
+			bs := buildSpec{breq.Module, version, dir, t[0], t[1], "", gv, opts.fingerprint()}
+			if len(t) == 3 {
+				bs.Variant = t[2]
+				if err := checkVariant(bs.Goarch, bs.Variant); err != nil {
+					return nil, err
+				}
+			}
+			if !seen[bs] {
+				seen[bs] = true
+				specs = append(specs, bs)
+			}
+		}
+	}
+	return specs, nil
+}
+
+// Prepare and build member i through the coordinator, updating the batch as the
+// build progresses.
+func (b *batch) build(i int, bs buildSpec, client buildClient) {
+	if err := prepareBuild(bs); err != nil {
+		b.update(i, func(m *batchMember) {
+			m.Status = batchFailed
+			m.Error = "preparing build: " + err.Error()
+		})
+		return
+	}
+
+	eventc := make(chan buildUpdate, 100)
+	registerBuild(bs, client, eventc)
+	defer unregisterBuild(bs, eventc)
+	for {
+		update := <-eventc
+		b.update(i, func(m *batchMember) {
+			if !update.done {
+				m.QueuePosition = update.queuePosition
+			} else if update.err != nil {
+				m.Status = batchFailed
+				m.QueuePosition = 0
+				m.Error = update.err.Error()
+			} else {
+				br := update.result
+				m.Status = batchSuccess
+				m.QueuePosition = 0
+				m.Sum = br.Sum
+				m.Filesize = br.Filesize
+				m.Link = request{br.buildSpec, br.Sum, pageIndex}.link()
+				m.DownloadLink = request{br.buildSpec, br.Sum, pageDownload}.link()
+			}
+		})
+		if update.done {
+			return
+		}
+	}
+}
+
+// Change member i with fn, and wake up listeners. When all builds are done, the
+// summary is stored and the batch removed from memory.
+func (b *batch) update(i int, fn func(m *batchMember)) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.seq++
+	fn(&b.summary.Members[i])
+	b.summary.Members[i].seq = b.seq
+
+	done := true
+	for _, m := range b.summary.Members {
+		if m.Status == batchPending {
+			done = false
+		}
+	}
+	if done {
+		b.summary.Done = true
+		if err := writeBatchSummary(b.summary); err != nil {
+			log.Printf("batch %s: storing summary: %v", b.summary.ID, err)
+		} else {
+			batches.Lock()
+			delete(batches.m, b.summary.ID)
+			batches.Unlock()
+		}
+	}
+
+	for c := range b.listeners {
+		select {
+		case c <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func writeBatchSummary(summary batchSummary) error {
+	buf, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	p := batchPath(summary.ID)
+	os.MkdirAll(filepath.Dir(p), 0777) // error will show later
+	if err := os.WriteFile(p+".tmp", buf, 0666); err != nil {
+		return err
+	}
+	return os.Rename(p+".tmp", p)
+}
+
+// Find a batch in progress, or a stored batch that is done.
+func findBatch(id string) (*batch, error) {
+	batches.Lock()
+	b, ok := batches.m[id]
+	batches.Unlock()
+	if ok {
+		return b, nil
+	}
+
+	if id == "" || strings.ContainsAny(id, "/.") {
+		return nil, os.ErrNotExist
+	}
+	buf, err := os.ReadFile(batchPath(id))
+	if err != nil {
+		return nil, err
+	}
+	b = &batch{listeners: map[chan struct{}]struct{}{}}
+	if err := json.Unmarshal(buf, &b.summary); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Serve /batch/<id> with the summary as JSON, and /batch/<id>/events with an
+// SSE stream of changes to members.
+func serveBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "405 - Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, page, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/batch/"), "/")
+	if page != "" && page != "events" {
+		http.NotFound(w, r)
+		return
+	}
+	b, err := findBatch(id)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			http.NotFound(w, r)
+		} else {
+			failf(w, "%w: reading batch: %v", errServer, err)
+		}
+		return
+	}
+
+	if page == "" {
+		defer observePage("batch", time.Now())
+		b.Lock()
+		buf, err := json.Marshal(b.summary)
+		b.Unlock()
+		if err != nil {
+			failf(w, "%w: marshal summary: %v", errServer, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(buf) // nothing to do for errors
+		return
+	}
+	serveBatchEvents(w, r, b)
+}
+
+// Event sent for a changed member of a batch.
+type batchMemberEvent struct {
+	Index int
+	batchMember
+}
+
+// Send "member" events for all members, then for changes. When all builds are
+// done, a "done" event with the summary is sent and the stream is closed.
+func serveBatchEvents(w http.ResponseWriter, r *http.Request, b *batch) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Println("ResponseWriter not a http.Flusher")
+		failf(w, "%w: implementation limitation: cannot stream updates", errServer)
+		return
+	}
+
+	c := make(chan struct{}, 1)
+	b.Lock()
+	b.listeners[c] = struct{}{}
+	b.Unlock()
+	defer func() {
+		b.Lock()
+		delete(b.listeners, c)
+		b.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	// Changes after this seq have to be sent. Members from a stored summary have seq
+	// 0, so start below.
+	last := int64(-1)
+	keepalive := time.NewTicker(time.Minute)
+	defer keepalive.Stop()
+	for {
+		var events [][]byte
+		b.Lock()
+		for i, m := range b.summary.Members {
+			if m.seq > last {
+				data, err := json.Marshal(batchMemberEvent{i, m})
+				if err != nil {
+					b.Unlock()
+					log.Printf("batch events: marshal member: %v", err)
+					return
+				}
+				events = append(events, []byte(fmt.Sprintf("event: member\ndata: %s\n\n", data)))
+			}
+		}
+		last = b.seq
+		if b.summary.Done {
+			data, err := json.Marshal(b.summary)
+			if err != nil {
+				b.Unlock()
+				log.Printf("batch events: marshal summary: %v", err)
+				return
+			}
+			events = append(events, []byte(fmt.Sprintf("event: done\ndata: %s\n\n", data)))
+		}
+		done := b.summary.Done
+		b.Unlock()
+
+		for _, ev := range events {
+			if _, err := w.Write(ev); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+		if done {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-c:
+		case <-keepalive.C:
+			if _, err := w.Write([]byte(": keepalive\n\n")); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"debug/buildinfo"
+	"debug/elf"
+	"debug/macho"
+	"debug/pe"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// binaryAnalysis describes a binary, for comparing binaries from mismatching
+// builds.
+type binaryAnalysis struct {
+	Error     string // If binary could not be read. Other fields are empty.
+	Size      int64
+	Format    string // "elf", "macho", "pe", or empty if unknown.
+	Sections  []sectionSum
+	BuildInfo string   // From debug/buildinfo.
+	Paths     []string // Embedded absolute paths, sorted.
+}
+
+type sectionSum struct {
+	Name string
+	Size int64
+	Sum  string // Hex, first 8 bytes of sha256.
+}
+
+// Runs of at least 6 printable characters, in which we look for paths.
+var printableRegexp = regexp.MustCompile(`[\x20-\x7e]{6,}`)
+
+// Absolute unix paths with at least two elements, and windows paths.
+var pathRegexp = regexp.MustCompile(`(^|[^A-Za-z0-9._:/\\-])(/[A-Za-z0-9._@+~-]+(/[A-Za-z0-9._@+~-]+)+|[A-Za-z]:\\[A-Za-z0-9._@+~\\-]+)`)
+
+func analyzeBinary(data []byte) binaryAnalysis {
+	a := binaryAnalysis{Size: int64(len(data))}
+
+	r := bytes.NewReader(data)
+	type section struct {
+		name string
+		size int64
+		open func() io.Reader
+	}
+	var sections []section
+	if f, err := elf.NewFile(r); err == nil {
+		a.Format = "elf"
+		for _, s := range f.Sections {
+			if s.Type == elf.SHT_NOBITS || s.Type == elf.SHT_NULL {
+				continue
+			}
+			s := s
+			sections = append(sections, section{s.Name, int64(s.Size), func() io.Reader { return s.Open() }})
+		}
+	} else if f, err := macho.NewFile(r); err == nil {
+		a.Format = "macho"
+		for _, s := range f.Sections {
+			s := s
+			sections = append(sections, section{s.Seg + "," + s.Name, int64(s.Size), func() io.Reader { return s.Open() }})
+		}
+	} else if f, err := pe.NewFile(r); err == nil {
+		a.Format = "pe"
+		for _, s := range f.Sections {
+			s := s
+			sections = append(sections, section{s.Name, int64(s.Size), func() io.Reader { return s.Open() }})
+		}
+	}
+	for _, s := range sections {
+		h := sha256.New()
+		sum := ""
+		if _, err := io.Copy(h, s.open()); err != nil {
+			sum = "error: " + err.Error()
+		} else {
+			sum = fmt.Sprintf("%x", h.Sum(nil)[:8])
+		}
+		a.Sections = append(a.Sections, sectionSum{s.name, s.size, sum})
+	}
+
+	if bi, err := buildinfo.Read(r); err != nil {
+		a.BuildInfo = "error: " + err.Error()
+	} else {
+		a.BuildInfo = bi.String()
+	}
+
+	paths := map[string]struct{}{}
+	for _, run := range printableRegexp.FindAll(data, -1) {
+		for _, m := range pathRegexp.FindAllSubmatch(run, -1) {
+			// Skip short matches, typically random data.
+			if len(m[2]) < 8 {
+				continue
+			}
+			paths[string(m[2])] = struct{}{}
+			if len(paths) >= 1000 {
+				break
+			}
+		}
+	}
+	for p := range paths {
+		a.Paths = append(a.Paths, p)
+	}
+	sort.Strings(a.Paths)
+	return a
+}
+
+// binaryReport compares analyses of binaries. Each row has a column per binary.
+type binaryReport struct {
+	Binaries  []binaryAnalysis
+	Sections  []reportRow
+	BuildInfo []reportRow // Per line of buildinfo.
+	Paths     []reportRow // Only paths not present in all binaries.
+}
+
+type reportRow struct {
+	Name   string
+	Values []string // Per binary, empty if absent.
+	Differ bool
+}
+
+func compareBinaries(l []binaryAnalysis) binaryReport {
+	report := binaryReport{Binaries: l}
+
+	// Gather names in order of first appearance, and values per binary.
+	rows := func(get func(a binaryAnalysis) [][2]string) []reportRow {
+		var names []string
+		values := map[string][]string{}
+		for i, a := range l {
+			for _, nv := range get(a) {
+				if _, ok := values[nv[0]]; !ok {
+					names = append(names, nv[0])
+					values[nv[0]] = make([]string, len(l))
+				}
+				values[nv[0]][i] = nv[1]
+			}
+		}
+		var r []reportRow
+		for _, name := range names {
+			row := reportRow{Name: name, Values: values[name]}
+			for _, v := range row.Values[1:] {
+				if v != row.Values[0] {
+					row.Differ = true
+				}
+			}
+			r = append(r, row)
+		}
+		return r
+	}
+
+	report.Sections = rows(func(a binaryAnalysis) (r [][2]string) {
+		for _, s := range a.Sections {
+			r = append(r, [2]string{s.Name, fmt.Sprintf("%d %s", s.Size, s.Sum)})
+		}
+		return
+	})
+
+	// For buildinfo, lines are keyed by their first two words, e.g. "dep
+	// golang.org/x/mod" or "build -ldflags".
+	report.BuildInfo = rows(func(a binaryAnalysis) (r [][2]string) {
+		for _, line := range strings.Split(strings.TrimSpace(a.BuildInfo), "\n") {
+			t := strings.SplitN(strings.ReplaceAll(line, "=", "\t"), "\t", 3)
+			key := t[0]
+			if len(t) > 1 {
+				key += " " + t[1]
+			}
+			r = append(r, [2]string{key, line})
+		}
+		return
+	})
+
+	for _, row := range rows(func(a binaryAnalysis) (r [][2]string) {
+		for _, p := range a.Paths {
+			r = append(r, [2]string{p, "present"})
+		}
+		return
+	}) {
+		if row.Differ {
+			report.Paths = append(report.Paths, row)
+		}
+	}
+
+	return report
+}
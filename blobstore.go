@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// blobStore is the storage for the gzipped binary and build log of successful
+// builds. Keys are of the form "<storeKey>/<name>", see buildSpec.storeKey. The
+// other files of a build, like the "recordnumber" file and the log of a failed
+// build, are always in the result directory.
+type blobStore interface {
+	// Store the file at path under key, removing the file. An existing blob is never
+	// replaced, an error wrapping fs.ErrExist is returned instead.
+	put(key, path string) error
+
+	// Open the blob. Returns an error wrapping fs.ErrNotExist if it doesn't exist.
+	open(key string) (io.ReadCloser, error)
+
+	// Like open, but only returns size and modification time.
+	stat(key string) (blobInfo, error)
+
+	remove(key string) error
+
+	// Call fn for all blobs with a key ending in "/"+name.
+	list(name string, fn func(key string, info blobInfo)) error
+
+	// URL for downloading the blob directly, with filename as suggested name.
+	// Returns an empty string if not supported.
+	downloadURL(key, filename string) (string, error)
+}
+
+type blobInfo struct {
+	Size     int64
+	Modified time.Time
+}
+
+// The global blob store, set at startup.
+var blobs blobStore
+
+func initBlobStore() {
+	if config.S3 != nil {
+		blobs = newS3Store()
+	} else {
+		blobs = localStore{resultDir}
+	}
+}
+
+// Names of the blobs of a successful build.
+var buildBlobNames = []string{"binary.gz", "log.gz"}
+
+// Store the blobs in the directory of a new successful build, before the build is
+// added to the transparency log. With the local store, the blobs stay in dir and
+// are moved into the result directory with it.
+func putBuildBlobs(dir string, br buildResult) error {
+	if _, ok := blobs.(localStore); ok {
+		return nil
+	}
+	for _, name := range buildBlobNames {
+		if err := putBuildBlob(br.storeKey()+"/"+name, filepath.Join(dir, name), br); err != nil {
+			return fmt.Errorf("storing %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Store the file at p under key for build result br. The blob may already have
+// been stored by another instance sharing the blob store. It is not replaced, its
+// binary must have the same sum as ours.
+func putBuildBlob(key, p string, br buildResult) error {
+	err := blobs.put(key, p)
+	if !errors.Is(err, fs.ErrExist) {
+		return err
+	}
+	if path.Base(key) == "binary.gz" {
+		sum, size, err := sumGzipBlob(key)
+		if err != nil {
+			return fmt.Errorf("checking existing blob: %w", err)
+		}
+		if sum != br.Sum || size != br.Filesize {
+			return fmt.Errorf("%w: existing blob %s has sum %s and size %d, build has %s and %d", errServer, key, sum, size, br.Sum, br.Filesize)
+		}
+	}
+	return os.Remove(p)
+}
+
+// Open the build log of a build. For failed builds, it is in the result
+// directory.
+func openBuildLog(bs buildSpec) (io.ReadCloser, error) {
+	rc, err := blobs.open(bs.storeKey() + "/log.gz")
+	if errors.Is(err, fs.ErrNotExist) {
+		return os.Open(filepath.Join(bs.storeDir(), "log.gz"))
+	}
+	return rc, err
+}
+
+// localStore keeps blobs in the directories of builds in the result directory.
+type localStore struct {
+	dir string
+}
+
+var _ blobStore = localStore{}
+
+func (s localStore) path(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(key))
+}
+
+func (s localStore) put(key, p string) error {
+	// A hard link fails if the blob exists, unlike a rename.
+	if err := os.Link(p, s.path(key)); err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+func (s localStore) open(key string) (io.ReadCloser, error) {
+	return os.Open(s.path(key))
+}
+
+func (s localStore) stat(key string) (blobInfo, error) {
+	fi, err := os.Stat(s.path(key))
+	if err != nil {
+		return blobInfo{}, err
+	}
+	return blobInfo{fi.Size(), fi.ModTime()}, nil
+}
+
+func (s localStore) remove(key string) error {
+	return os.Remove(s.path(key))
+}
+
+func (s localStore) list(name string, fn func(key string, info blobInfo)) error {
+	dirs, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		// Skip temporary directories of builds in progress.
+		if !dir.IsDir() || len(dir.Name()) != 1 {
+			continue
+		}
+		builds, err := os.ReadDir(filepath.Join(s.dir, dir.Name()))
+		if err != nil {
+			return err
+		}
+		for _, b := range builds {
+			key := path.Join(dir.Name(), b.Name(), name)
+			if info, err := s.stat(key); err == nil {
+				fn(key, info)
+			} else if !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s localStore) downloadURL(key, filename string) (string, error) {
+	return "", nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"log"
 	"net/http"
 	"os"
@@ -20,10 +21,12 @@ func serveBuild(w http.ResponseWriter, r *http.Request, req request) {
 		return
 	}
 
-	// Resolve "latest" module version with a redirect.
-	if req.Version == "latest" {
-		if info, err := resolveModuleLatest(r.Context(), config.GoProxy, req.Mod); err != nil {
-			failf(w, "resolving latest for module: %w", err)
+	// Resolve "latest" and other version queries like branches, commits and
+	// semver prefixes to a canonical version with a redirect. Records only have
+	// immutable versions.
+	if !isCanonicalVersion(req.Version) {
+		if info, err := resolveModuleQuery(r.Context(), goproxyURL(), req.Mod, req.Version); err != nil {
+			failf(w, "resolving version %q for module: %w", req.Version, err)
 		} else {
 			mreq := req
 			mreq.Version = info.Version
@@ -32,6 +35,24 @@ func serveBuild(w http.ResponseWriter, r *http.Request, req request) {
 		return
 	}
 
+	// Resolve "module" goversion from the go.mod of the module with a redirect.
+	if req.Goversion == "module" {
+		if goversion, err := ensureMostRecentSDK(); err != nil {
+			failf(w, "ensuring most recent goversion: %w", err)
+		} else if gobin, err := ensureGobin(goversion); err != nil {
+			failf(w, "%w", err)
+		} else if modDir, getOutput, err := ensureModule(goversion, gobin, req.Mod, req.Version); err != nil {
+			failf(w, "error fetching module from goproxy: %w\n\n# output from go get:\n%s", err, string(getOutput))
+		} else if v, err := readGoModVersions(modDir); err != nil {
+			failf(w, "reading go.mod: %w", err)
+		} else {
+			greq := req
+			greq.Goversion = v.resolve()
+			http.Redirect(w, r, greq.link(), http.StatusTemporaryRedirect)
+		}
+		return
+	}
+
 	// See if we have a completed build, and handle it.
 	if _, br, failed, err := (serverOps{}).lookupResult(r.Context(), req.buildSpec); err != nil {
 		failf(w, "%w: lookup record: %v", errServer, err)
@@ -72,7 +93,7 @@ func serveBuild(w http.ResponseWriter, r *http.Request, req request) {
 			req.Page = pageIndex
 			http.Redirect(w, r, req.link(), http.StatusSeeOther)
 		case pageLog:
-			serveLog(w, r, filepath.Join(req.storeDir(), "log.gz"))
+			serveLog(w, r, req.buildSpec)
 		case pageIndex:
 			serveIndex(w, r, req.buildSpec, nil)
 		default:
@@ -89,7 +110,19 @@ func serveBuild(w http.ResponseWriter, r *http.Request, req request) {
 	// We always immediately attempt to get the files for a build build. This checks
 	// with the goproxy that the module and package exist, and seems like it has a
 	// chance to compile.
-	if err := prepareBuild(req.buildSpec); err != nil {
+	if err := prepareBuild(req.buildSpec); err != nil && errors.Is(err, errBadOptions) {
+		// Redirect to the URL with the options the module declares, if they are valid.
+		if opts, xerr := moduleOptions(req.buildSpec); xerr != nil {
+			failf(w, "preparing build: %w", xerr)
+		} else if fp := opts.fingerprint(); fp == req.Options {
+			failf(w, "preparing build: %w", err)
+		} else {
+			oreq := req
+			oreq.Options = fp
+			http.Redirect(w, r, oreq.link(), http.StatusTemporaryRedirect)
+		}
+		return
+	} else if err != nil {
 		failf(w, "preparing build: %w", err)
 		return
 	}
@@ -103,7 +136,7 @@ func serveBuild(w http.ResponseWriter, r *http.Request, req request) {
 	}
 
 	eventc := make(chan buildUpdate, 100)
-	registerBuild(req.buildSpec, eventc)
+	registerBuild(req.buildSpec, requestClient(r), eventc)
 
 	ctx := r.Context()
 
@@ -153,7 +186,7 @@ func serveBuild(w http.ResponseWriter, r *http.Request, req request) {
 				unregisterBuild(req.buildSpec, eventc)
 
 				if req.Page == pageLog {
-					serveLog(w, r, filepath.Join(req.storeDir(), "log.gz"))
+					serveLog(w, r, req.buildSpec)
 					return
 				}
 
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// sumResult is returned by the JSON lookup of builds by sum.
+type sumResult struct {
+	RecordNumber int64
+	buildResult
+	Link string // Path to result page.
+}
+
+// Lookup builds in the transparency log by sum of their binary.
+func lookupSum(ctx context.Context, sum string) ([]sumResult, error) {
+	nums, err := sums.lookupSum(sum)
+	if err != nil {
+		return nil, err
+	}
+	l := []sumResult{}
+	for _, num := range nums {
+		records, err := serverOps{}.ReadRecords(ctx, num, 1)
+		if err != nil {
+			return nil, fmt.Errorf("%w: reading record: %v", errServer, err)
+		}
+		br, err := parseRecord(records[0])
+		if err != nil {
+			return nil, fmt.Errorf("%w: parsing record: %v", errServer, err)
+		} else if br.Sum != sum {
+			return nil, fmt.Errorf("%w: sum index points to record %d with other sum %s", errServer, num, br.Sum)
+		}
+		link := request{br.buildSpec, br.Sum, pageIndex}.link()
+		l = append(l, sumResult{num, *br, link})
+	}
+	return l, nil
+}
+
+// Serve /s/<sum>, redirecting to the result page, and /s/<sum>.json, returning
+// all builds with the sum.
+func serveSum(w http.ResponseWriter, r *http.Request) {
+	defer observePage("sum", time.Now())
+
+	if r.Method != "GET" {
+		http.Error(w, "405 - Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sum := strings.TrimPrefix(r.URL.Path, "/s/")
+	asJSON := strings.HasSuffix(sum, ".json")
+	sum = strings.TrimSuffix(sum, ".json")
+	if !isSum(sum) {
+		http.NotFound(w, r)
+		return
+	}
+
+	l, err := lookupSum(r.Context(), sum)
+	if err != nil && os.IsNotExist(err) || err == nil && len(l) == 0 {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		failf(w, "%w: looking up sum: %v", errServer, err)
+		return
+	}
+
+	if !asJSON {
+		http.Redirect(w, r, l[0].Link, http.StatusTemporaryRedirect)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	enc.Encode(l) // nothing to do for errors
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var errTooManyBuilds = errors.New("too many builds for client")
+
+// Client requesting a build, for fair scheduling in the coordinator.
+type buildClient struct {
+	ID       string // IP address, or name for a configured token.
+	Priority bool   // Authenticated with token.
+}
+
+// Client for builds started by gobuild itself, e.g. for following logs or
+// resumed after a restart.
+var internalClient = buildClient{"gobuild", false}
+
+// Identify the client of an HTTP request, by token in the Authorization header
+// if it matches a configured ClientTokens, otherwise by IP address.
+func requestClient(r *http.Request) buildClient {
+	if token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); token != "" {
+		for _, ct := range config.ClientTokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(ct.Token)) == 1 {
+				return buildClient{"token:" + ct.Name, true}
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return buildClient{host, false}
+}
+
+type clientKey struct{}
+
+// Wrap h to add the client of the request to its context, for handlers that
+// don't have access to the request when registering builds, like lookups in the
+// transparency log.
+func withClient(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), clientKey{}, requestClient(r))
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func contextClient(ctx context.Context) buildClient {
+	if c, ok := ctx.Value(clientKey{}).(buildClient); ok {
+		return c
+	}
+	return internalClient
+}
+
+// Whether builds for module get priority by config PriorityModulePrefixes.
+func priorityModule(module string) bool {
+	for _, prefix := range config.PriorityModulePrefixes {
+		if strings.HasPrefix(module, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,10 +1,24 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"sync"
+	"time"
+)
+
+// Reasons a build command was stopped before completion. These are not compile
+// errors, the build is not stored as failed.
+var (
+	errBuildTimeout  = errors.New("build took too long")
+	errBuildIdle     = errors.New("build stopped writing output")
+	errBuildCanceled = errors.New("build canceled, no more listeners")
 )
 
 // Prepare command, typically for running go get. We sometimes need CGO_ENABLED to
@@ -18,38 +32,154 @@ func makeCommand(withGoproxy bool, dir string, cgoEnabled bool, extraEnv []strin
 
 	goproxy := "GOPROXY=off"
 	if withGoproxy {
-		goproxy = "GOPROXY=" + config.GoProxy
+		goproxy = "GOPROXY=" + goproxyURL()
 	}
 
 	var l []string
 	l = append(l, config.Run...)
 	l = append(l, argv...)
-	cmd := exec.Command(l[0], l[1:]...)
-	cmd.Dir = dir
-	cmd.Env = []string{
+	env := []string{
 		goproxy,
 		cgo,
 		"GO111MODULE=on",
 		"GO19CONCURRENTCOMPILATION=0",
+		// Never switch to another toolchain because of a go.mod, builds must be done
+		// with the requested goversion.
+		"GOTOOLCHAIN=local",
 	}
 	switch runtime.GOOS {
 	case "windows":
-		cmd.Env = append(cmd.Env,
+		env = append(env,
 			"USERPROFILE="+homedir,
 			"AppData="+filepath.Join(homedir, "AppData"),
 			"LocalAppData="+filepath.Join(homedir, "LocalAppData"),
 		)
 	case "plan9":
-		cmd.Env = append(cmd.Env, "home="+homedir)
+		env = append(env, "home="+homedir)
 	default:
-		cmd.Env = append(cmd.Env, "HOME="+homedir)
+		env = append(env, "HOME="+homedir)
+	}
+	if config.GoPrivate != "" {
+		// Private modules are fetched through our module proxies too, not directly.
+		env = append(env, "GOPRIVATE="+config.GoPrivate, "GONOPROXY=none")
+	}
+	if config.GoNoSumDB != "" {
+		env = append(env, "GONOSUMDB="+config.GoNoSumDB)
 	}
 	if len(config.Environment) > 0 {
-		cmd.Env = append(cmd.Env, config.Environment...)
+		env = append(env, config.Environment...)
 	}
 	if len(extraEnv) > 0 {
-		cmd.Env = append(cmd.Env, extraEnv...)
+		env = append(env, extraEnv...)
+	}
+	log.Printf("command: workdir=%q argv=%#v environment=%s sandbox=%v", dir, l, redactGoproxy(fmt.Sprintf("%#v", env)), config.Sandbox != nil)
+	var cmd *exec.Cmd
+	if config.Sandbox != nil {
+		// Only commands that use the goproxy need network access.
+		cmd = sandboxCommand(withGoproxy, dir, l, env, nil)
+	} else {
+		cmd = exec.Command(l[0], l[1:]...)
+		cmd.Dir = dir
+		cmd.Env = env
+	}
+	if privsepFrontend {
+		// Run as BuildUser by the privileged process.
+		return privsepCommand(cmd)
 	}
-	log.Printf("command: workdir=%q argv=%#v environment=%#v", dir, l, cmd.Env)
 	return cmd
 }
+
+// Writer for combined output of a command, keeping track of the last write.
+type outputWriter struct {
+	sync.Mutex
+	buf  bytes.Buffer
+	last time.Time
+}
+
+func (w *outputWriter) Write(buf []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	w.last = time.Now()
+	return w.buf.Write(buf)
+}
+
+// Run cmd and return its combined output, like CombinedOutput, without the
+// secret of the local module proxy. The command is killed when ctx is done, or
+// when it hasn't written output for idle, if non-zero. The error then wraps
+// errBuildTimeout, errBuildCanceled or errBuildIdle.
+func runCommand(ctx context.Context, cmd *exec.Cmd, idle time.Duration) ([]byte, error) {
+	w := &outputWriter{last: time.Now()}
+	cmd.Stdout = w
+	cmd.Stderr = w
+	// Children of the go command keep our output pipe open, they must be killed too.
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	var ticks <-chan time.Time
+	if idle > 0 {
+		ticker := time.NewTicker(idle / 10)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+	done := make(chan struct{})
+	killed := make(chan error, 1)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				killed <- contextAbort(ctx)
+				killCommand(cmd)
+				return
+			case <-ticks:
+				w.Lock()
+				last := w.last
+				w.Unlock()
+				if time.Since(last) >= idle {
+					killed <- errBuildIdle
+					killCommand(cmd)
+					return
+				}
+			}
+		}
+	}()
+
+	err := cmd.Wait()
+	close(done)
+	if err != nil {
+		select {
+		case kerr := <-killed:
+			err = fmt.Errorf("%w: %v", kerr, err)
+		default:
+		}
+	}
+	w.Lock()
+	defer w.Unlock()
+	return []byte(redactGoproxy(w.buf.String())), err
+}
+
+// Error for a build stopped because ctx is done.
+func contextAbort(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return errBuildTimeout
+	}
+	return errBuildCanceled
+}
+
+// Reason for metrics if err is for a stopped build.
+func buildAbortReason(err error) (string, bool) {
+	switch {
+	case err == nil:
+		return "", false
+	case errors.Is(err, errBuildTimeout):
+		return "timeout", true
+	case errors.Is(err, errBuildIdle):
+		return "idle", true
+	case errors.Is(err, errBuildCanceled):
+		return "canceled", true
+	}
+	return "", false
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// Start cmd in a new process group, so killCommand also kills the processes it
+// starts, like compile and link started by the go command.
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// Kill the process group of a command started with setProcessGroup.
+func killCommand(cmd *exec.Cmd) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
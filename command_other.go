@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import (
+	"os/exec"
+)
+
+// Process groups are only used on Linux. Elsewhere, only the command itself is
+// killed, not the processes it started.
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+func killCommand(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
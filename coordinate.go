@@ -5,7 +5,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"runtime"
+	"log"
+	"sort"
+	"time"
 )
 
 type kind string
@@ -45,24 +47,102 @@ type buildUpdate struct {
 }
 
 type buildRequest struct {
-	bs     buildSpec
-	eventc chan buildUpdate
+	bs      buildSpec
+	client  buildClient
+	eventc  chan buildUpdate
+	restore bool // Build again even with a result, its binary was removed by retention.
 }
 
 var coordinate = struct {
 	register   chan buildRequest
 	unregister chan buildRequest
+	kick       chan struct{}
 }{
 	make(chan buildRequest, 1),
 	make(chan buildRequest, 1),
+	make(chan struct{}, 1),
 }
 
-func registerBuild(bs buildSpec, eventc chan buildUpdate) {
-	coordinate.register <- buildRequest{bs, eventc}
+// Register interest in a build for client, starting it if needed. Updates are
+// sent on eventc. If the client has too many builds queued, the build fails with
+// errTooManyBuilds.
+func registerBuild(bs buildSpec, client buildClient, eventc chan buildUpdate) {
+	coordinate.register <- buildRequest{bs, client, eventc, false}
+}
+
+// Like registerBuild, but for a build with a result of which the binary was
+// removed by retention. The build is done again, restoring the binary. Callers
+// check the binary is removed, the coordinator doesn't access the storage.
+func registerRestore(bs buildSpec, client buildClient, eventc chan buildUpdate) {
+	coordinate.register <- buildRequest{bs, client, eventc, true}
 }
 
 func unregisterBuild(bs buildSpec, eventc chan buildUpdate) {
-	coordinate.unregister <- buildRequest{bs, eventc}
+	coordinate.unregister <- buildRequest{bs, buildClient{}, eventc, false}
+}
+
+// Let the coordinator start queued builds, e.g. after capacity increased.
+func kickBuilds() {
+	select {
+	case coordinate.kick <- struct{}{}:
+	default:
+	}
+}
+
+// Builds a buildSpec for the coordinator. Variable for tests.
+var buildFunc = build
+
+// Build in the queue, for determining the order in which builds are started.
+type queueItem struct {
+	bs       buildSpec
+	client   string
+	priority bool
+}
+
+// Order in which queued builds are started: builds with priority first, then
+// round-robin between clients, starting with the client that was served longest
+// ago. Served has the sequence number of the last started build per client,
+// clients with the same sequence number are in order of arrival in queue. The
+// builds of a client are in order of arrival in queue.
+//
+// A served client goes to the end of the round-robin, so the clients are served
+// in the same order in each round, and we can sort by round and client.
+func queueOrder(queue []queueItem, served map[string]int64) []buildSpec {
+	type clientKey struct {
+		client   string
+		priority bool
+	}
+	type entry struct {
+		queueItem
+		round int // Index of build among those of its client.
+	}
+	first := map[clientKey]int{} // Index in queue of first build of client.
+	count := map[clientKey]int{}
+	l := make([]entry, len(queue))
+	for i, qi := range queue {
+		k := clientKey{qi.client, qi.priority}
+		if _, ok := first[k]; !ok {
+			first[k] = i
+		}
+		l[i] = entry{qi, count[k]}
+		count[k]++
+	}
+	sort.Slice(l, func(i, j int) bool {
+		a, b := l[i], l[j]
+		if a.priority != b.priority {
+			return a.priority
+		} else if a.round != b.round {
+			return a.round < b.round
+		} else if served[a.client] != served[b.client] {
+			return served[a.client] < served[b.client]
+		}
+		return first[clientKey{a.client, a.priority}] < first[clientKey{b.client, b.priority}]
+	})
+	r := make([]buildSpec, len(l))
+	for i, e := range l {
+		r[i] = e.bs
+	}
+	return r
 }
 
 func coordinateBuilds() {
@@ -76,19 +156,46 @@ func coordinateBuilds() {
 		// Last update, with done set to true. We store it to know the command has
 		// finished, and give all listeners the concluding update.
 		final *buildUpdate
+
+		queued   time.Time
+		building bool
+
+		// Client that first requested the build, builds are accounted to it. Builds with
+		// priority are started before others.
+		client   string
+		priority bool
+
+		// For stopping the build when all listeners have gone.
+		cancel   context.CancelFunc
+		canceled bool
+
+		// Queued before a restart. Built even without listeners.
+		resumed bool
 	}
 	builds := map[buildSpec]*wipBuild{}
 
+	// Builds in progress, locally or on remote workers.
 	active := 0
-	maxBuilds := config.MaxBuilds
-	if maxBuilds == 0 {
-		maxBuilds = runtime.NumCPU() + 1
-	}
 
 	// Build requests always go through the queue. We'll pick up the next for which the
 	// output path is available, but only if we are below maxBuilds builds in progress.
+	// Builds are not started in order of the queue, see order.
 	queue := []buildSpec{}
 
+	// Per client, number of builds queued or in progress, and number of builds in
+	// progress.
+	clientBuilds := map[string]int{}
+	clientActive := map[string]int{}
+
+	// Per client, sequence number of when a build of the client was last started,
+	// for round-robin between clients.
+	clientServed := map[string]int64{}
+	var servedSeq int64
+
+	// Registrations rejected because of per-client limits. They don't have a
+	// wipBuild, but will still unregister.
+	rejected := map[chan buildUpdate]struct{}{}
+
 	// Keep track of output paths that are "busy", i.e. paths that currently running
 	// builds will write the resulting binary to.
 	// Keys are the result of request.outputPath.
@@ -113,11 +220,105 @@ func coordinateBuilds() {
 		}
 	}
 
+	// Queued builds in the order they will be started. Computed again after changes
+	// to the queue, priorities or served clients, which set ordered to nil.
+	var ordered []buildSpec
+	order := func() []buildSpec {
+		if ordered == nil && len(queue) > 0 {
+			l := make([]queueItem, len(queue))
+			for i, bs := range queue {
+				b := builds[bs]
+				l[i] = queueItem{bs, b.client, b.priority}
+			}
+			ordered = queueOrder(l, clientServed)
+		}
+		return ordered
+	}
+
+	// Position of a build in the queue, 0 if not queued.
+	position := func(bs buildSpec) int {
+		for i, obs := range order() {
+			if obs == bs {
+				return i + 1
+			}
+		}
+		return 0
+	}
+
+	sendPositions := func() {
+		for i, bs := range order() {
+			sendPending(builds[bs], i+1)
+		}
+	}
+
+	// Store the queue and builds in progress, for resuming after a restart.
+	persist := func() {
+		var l []queuedBuild
+		for bs, b := range builds {
+			if b.building {
+				l = append(l, queuedBuild{bs, b.queued, true, b.client, b.priority})
+			}
+		}
+		sort.Slice(l, func(i, j int) bool {
+			return l[i].Queued.Before(l[j].Queued)
+		})
+		for _, bs := range order() {
+			b := builds[bs]
+			l = append(l, queuedBuild{bs, b.queued, false, b.client, b.priority})
+		}
+		writeQueue(l)
+	}
+
+	// Add a build to the queue.
+	enqueue := func(bs buildSpec) {
+		queue = append(queue, bs)
+		ordered = nil
+	}
+
+	// Remove a build from the queue.
+	dequeue := func(bs buildSpec) {
+		for i, qbs := range queue {
+			if qbs == bs {
+				queue = append(queue[:i], queue[i+1:]...)
+				break
+			}
+		}
+		ordered = nil
+	}
+
+	// Account a build to its client. A client without builds joins the end of the
+	// round-robin.
+	account := func(b *wipBuild) {
+		if clientBuilds[b.client] == 0 {
+			clientServed[b.client] = servedSeq
+			ordered = nil
+		}
+		clientBuilds[b.client]++
+	}
+
+	// Stop accounting a build to its client.
+	release := func(b *wipBuild) {
+		clientBuilds[b.client]--
+		if clientBuilds[b.client] <= 0 {
+			delete(clientBuilds, b.client)
+			delete(clientServed, b.client)
+			ordered = nil
+		}
+	}
+
 	startBuild := func(bs buildSpec, b *wipBuild) {
 		active++
+		clientActive[b.client]++
+		servedSeq++
+		clientServed[b.client] = servedSeq
+		ordered = nil
+		b.building = true
 		pathBusy[bs.outputPath()] = struct{}{}
+		ctx, cancel := context.WithCancel(context.Background())
+		b.cancel = cancel
 		go func() {
-			recordNumber, result, errOutput, err := build(bs)
+			defer cancel()
+			recordNumber, result, errOutput, err := buildFunc(ctx, bs)
 			var errmsg string
 			if err != nil {
 				errmsg = err.Error() + "\n\n" + errOutput
@@ -135,52 +336,90 @@ func coordinateBuilds() {
 		}()
 	}
 
-	kick := func() {
-		if active >= maxBuilds {
-			return
-		}
-
-		for i := 0; i < len(queue); {
-			bs := queue[i]
+	// Start the next build, if any. Returns whether a build was started.
+	kickOne := func() bool {
+		for _, bs := range order() {
+			nb := builds[bs]
 			if _, busy := pathBusy[bs.outputPath()]; busy {
-				i++
 				continue
 			}
-			queue = append(queue[:i], queue[i+1:]...)
-			nb := builds[bs]
-			if len(nb.events) == 0 {
+			if len(nb.events) == 0 && !nb.resumed {
 				// All parties interested have gone, don't build.
+				dequeue(bs)
+				release(nb)
+				delete(builds, bs)
 				continue
 			}
+			if config.ClientMaxBuilds > 0 && clientActive[nb.client] >= config.ClientMaxBuilds {
+				continue
+			}
+			dequeue(bs)
 			sendPending(nb, 0)
 			startBuild(bs, nb)
-			for j, wbs := range queue[i:] {
-				sendPending(builds[wbs], i+j+1)
-			}
-			break
+			sendPositions()
+			return true
 		}
+		return false
 	}
 
+	// Start builds while we have capacity.
+	kick := func() {
+		for active < maxLocalBuilds()+remoteCapacity() && kickOne() {
+		}
+	}
+
+	// Resume builds from before a restart, unless they finished just before.
+	for _, qb := range readQueue() {
+		if _, br, failed, err := (serverOps{}.lookupResult(context.Background(), qb.buildSpec)); err != nil {
+			log.Printf("looking up result for queued build %s: %v", qb.buildSpec, err)
+			continue
+		} else if failed || br != nil {
+			continue
+		}
+		if _, ok := builds[qb.buildSpec]; ok {
+			continue
+		}
+		b := &wipBuild{queued: qb.Queued, client: qb.Client, priority: qb.Priority, resumed: true}
+		builds[qb.buildSpec] = b
+		account(b)
+		enqueue(qb.buildSpec)
+	}
+	if len(queue) > 0 {
+		log.Printf("resuming %d queued builds", len(queue))
+	}
+	kick()
+	persist()
+
 	for {
 		select {
 		case reg := <-coordinate.register:
+			priority := reg.client.Priority || priorityModule(reg.bs.Mod)
 			b, ok := builds[reg.bs]
 			if !ok {
-				b = &wipBuild{nil, nil}
-				builds[reg.bs] = b
+				b = &wipBuild{queued: time.Now(), client: reg.client.ID, priority: priority}
 
-				// We may have just finished a build. Before starting any new work, try reading a result.
+				// We may have just finished a build. Before starting any new work, try reading a
+				// result. For a restore, a result is built again.
 				if recordNumber, br, failed, err := (serverOps{}.lookupResult(context.Background(), reg.bs)); err != nil || failed {
 					if err == nil {
 						err = fmt.Errorf("build failed")
 					}
 					msg := buildUpdateMsg{Kind: kindTempFail, Error: err.Error()}.json()
 					b.final = &buildUpdate{reg.bs, true, err, nil, 0, 0, msg}
-				} else if br != nil {
+				} else if br != nil && !reg.restore {
 					msg := buildUpdateMsg{Kind: kindSuccess, Result: br}.json()
 					b.final = &buildUpdate{reg.bs, true, nil, br, recordNumber, 0, msg}
 				}
 				// Else no result, we'll continue as normal, starting a build.
+
+				if b.final == nil && config.ClientMaxQueued > 0 && clientBuilds[b.client] >= config.ClientMaxQueued {
+					err := fmt.Errorf("%w: %d builds queued or in progress, try again later", errTooManyBuilds, clientBuilds[b.client])
+					msg := buildUpdateMsg{Kind: kindTempFail, Error: err.Error()}.json()
+					rejected[reg.eventc] = struct{}{}
+					reg.eventc <- buildUpdate{reg.bs, true, err, nil, 0, 0, msg}
+					continue
+				}
+				builds[reg.bs] = b
 			}
 			b.events = append(b.events, reg.eventc)
 			if b.final != nil {
@@ -189,16 +428,28 @@ func coordinateBuilds() {
 			}
 
 			if !ok {
-				queue = append(queue, reg.bs)
+				account(b)
+				enqueue(reg.bs)
 				kick()
+				persist()
+			} else if priority && !b.priority && !b.building {
+				b.priority = true
+				ordered = nil
+				sendPositions()
+				persist()
 			}
+			pos := position(reg.bs)
 			update := buildUpdate{
-				queuePosition: len(queue),
-				msg:           buildUpdateMsg{Kind: kindQueuePosition, QueuePosition: intptr(len(queue))}.json(),
+				queuePosition: pos,
+				msg:           buildUpdateMsg{Kind: kindQueuePosition, QueuePosition: intptr(pos)}.json(),
 			}
 			reg.eventc <- update
 
 		case reg := <-coordinate.unregister:
+			if _, ok := rejected[reg.eventc]; ok {
+				delete(rejected, reg.eventc)
+				continue
+			}
 			b := builds[reg.bs]
 			l := []chan buildUpdate{}
 			for _, c := range b.events {
@@ -212,10 +463,31 @@ func coordinateBuilds() {
 			b.events = l
 			if len(b.events) == 0 && b.final != nil {
 				delete(builds, reg.bs)
+			} else if len(b.events) == 0 && b.building && !b.resumed && !b.canceled {
+				// Nobody is waiting for the result anymore. If the go command is still
+				// running, it is stopped. A build that is being published completes.
+				b.canceled = true
+				b.cancel()
 			}
 
+		case <-coordinate.kick:
+			kick()
+			persist()
+
 		case update := <-updatec:
 			b := builds[update.bs]
+			if update.done && b.canceled && len(b.events) > 0 && update.err != nil {
+				// New listeners came after we canceled, build again.
+				delete(pathBusy, update.bs.outputPath())
+				active--
+				clientActive[b.client]--
+				b.building = false
+				b.canceled = false
+				enqueue(update.bs)
+				kick()
+				persist()
+				continue
+			}
 			for _, c := range b.events {
 				// We don't want to block. Slow clients/readers may not get all updates, better than blocking.
 				select {
@@ -228,11 +500,18 @@ func coordinateBuilds() {
 			}
 			delete(pathBusy, update.bs.outputPath())
 			b.final = &update
+			b.building = false
 			active--
+			clientActive[b.client]--
+			if clientActive[b.client] == 0 {
+				delete(clientActive, b.client)
+			}
+			release(b)
 			if len(b.events) == 0 {
 				delete(builds, update.bs)
 			}
 			kick()
+			persist()
 		}
 	}
 }
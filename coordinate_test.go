@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Build spec with name as module, so builds don't share an output path.
+func testSpec(name string) buildSpec {
+	return buildSpec{Mod: "example.com/" + name, Version: "v1.0.0", Dir: "/", Goos: "linux", Goarch: "amd64", Goversion: "go1.21.0"}
+}
+
+func TestQueueOrder(t *testing.T) {
+	item := func(name, client string, priority bool) queueItem {
+		return queueItem{testSpec(name), client, priority}
+	}
+	tests := []struct {
+		queue  []queueItem
+		served map[string]int64
+		exp    string
+	}{
+		{nil, nil, ""},
+		// Clients that haven't been served are in order of arrival.
+		{[]queueItem{item("a1", "a", false), item("a2", "a", false), item("b1", "b", false), item("a3", "a", false), item("c1", "c", false)}, nil, "a1 b1 c1 a2 a3"},
+		// Client served longest ago goes first.
+		{[]queueItem{item("a1", "a", false), item("a2", "a", false), item("b1", "b", false), item("b2", "b", false)}, map[string]int64{"a": 5, "b": 3}, "b1 a1 b2 a2"},
+		// Priority before all others, also round-robin.
+		{[]queueItem{item("a1", "a", false), item("b1", "b", true), item("c1", "c", true), item("b2", "b", true), item("a2", "a", true)}, map[string]int64{"b": 2, "c": 1}, "a2 c1 b1 b2 a1"},
+		// Clients served at the same time are in order of arrival, per priority.
+		{[]queueItem{item("b1", "b", true), item("a1", "a", false), item("b2", "b", false), item("a2", "a", false), item("b3", "b", false)}, map[string]int64{"a": 1, "b": 1}, "b1 a1 b2 a2 b3"},
+	}
+	for i, tc := range tests {
+		var l []string
+		for _, bs := range queueOrder(tc.queue, tc.served) {
+			l = append(l, strings.TrimPrefix(bs.Mod, "example.com/"))
+		}
+		if got := strings.Join(l, " "); got != tc.exp {
+			t.Fatalf("test %d: order %q, expected %q", i, got, tc.exp)
+		}
+	}
+}
+
+// Build started by the coordinator, finished when the test sends on done.
+type testBuild struct {
+	bs   buildSpec
+	done chan error
+}
+
+func testStarted(t *testing.T, started chan testBuild, name string) testBuild {
+	t.Helper()
+	select {
+	case b := <-started:
+		if b.bs != testSpec(name) {
+			t.Fatalf("started %s, expected %s", b.bs.Mod, name)
+		}
+		return b
+	case <-time.After(5 * time.Second):
+		t.Fatalf("build %s not started", name)
+	}
+	panic("not reached")
+}
+
+func testNotStarted(t *testing.T, started chan testBuild) {
+	t.Helper()
+	select {
+	case b := <-started:
+		t.Fatalf("unexpected start of %s", b.bs.Mod)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// Wait until the persisted queue has the builds in progress, in any order, and
+// the queued builds in order.
+func testQueue(t *testing.T, building, queued string) {
+	t.Helper()
+	var got string
+	for i := 0; i < 100; i++ {
+		queueState.Lock()
+		l := queueState.l
+		queueState.Unlock()
+		var b, q []string
+		for _, qb := range l {
+			name := strings.TrimPrefix(qb.Mod, "example.com/")
+			if qb.Building {
+				b = append(b, name)
+			} else {
+				q = append(q, name)
+			}
+		}
+		sort.Strings(b)
+		got = fmt.Sprintf("%s | %s", strings.Join(b, " "), strings.Join(q, " "))
+		if got == building+" | "+queued {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("queue %q, expected %q", got, building+" | "+queued)
+}
+
+// The coordinator keeps running, for all tests.
+var testCoordinatorOnce sync.Once
+
+func TestCoordinate(t *testing.T) {
+	resultDir = t.TempDir()
+	config.DataDir = t.TempDir()
+	config.MaxBuilds = 2
+	config.ClientMaxBuilds = 1
+	config.ClientMaxQueued = 3
+	defer func() {
+		config.MaxBuilds = 0
+		config.ClientMaxBuilds = 0
+		config.ClientMaxQueued = 0
+	}()
+
+	started := make(chan testBuild)
+	buildFunc = func(ctx context.Context, bs buildSpec) (int64, *buildResult, string, error) {
+		b := testBuild{bs, make(chan error)}
+		started <- b
+		if err := <-b.done; err != nil {
+			return -1, nil, "", err
+		}
+		return 0, &buildResult{bs, 1, "0" + strings.Repeat("a", 27)}, "", nil
+	}
+	defer func() {
+		buildFunc = build
+	}()
+	testCoordinatorOnce.Do(func() {
+		go coordinateBuilds()
+	})
+
+	listeners := map[string]chan buildUpdate{}
+	register := func(name string, client buildClient) chan buildUpdate {
+		eventc := make(chan buildUpdate, 100)
+		registerBuild(testSpec(name), client, eventc)
+		listeners[name] = eventc
+		return eventc
+	}
+	a := buildClient{"a", false}
+	b := buildClient{"b", false}
+	c := buildClient{"c", true}
+
+	register("a1", a)
+	a1 := testStarted(t, started, "a1")
+	// Client a is at ClientMaxBuilds, its builds wait.
+	register("a2", a)
+	register("a3", a)
+	testQueue(t, "a1", "a2 a3")
+	testNotStarted(t, started)
+
+	// Beyond ClientMaxQueued, builds are rejected.
+	a4c := register("a4", a)
+	select {
+	case u := <-a4c:
+		if !u.done || !errors.Is(u.err, errTooManyBuilds) {
+			t.Fatalf("got update %#v, expected too many builds", u)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no update for rejected build")
+	}
+	unregisterBuild(testSpec("a4"), a4c)
+	delete(listeners, "a4")
+
+	// Client b can start a build, and is round-robin with a for the queue. Client c
+	// has priority.
+	register("b1", b)
+	b1 := testStarted(t, started, "b1")
+	register("b2", b)
+	register("c1", c)
+	testQueue(t, "a1 b1", "c1 a2 b2 a3")
+	testNotStarted(t, started)
+
+	a1.done <- nil
+	c1 := testStarted(t, started, "c1")
+	testQueue(t, "b1 c1", "a2 b2 a3")
+
+	b1.done <- fmt.Errorf("failed")
+	a2 := testStarted(t, started, "a2")
+	testQueue(t, "a2 c1", "b2 a3")
+
+	// Client a is at ClientMaxBuilds again, b goes first.
+	c1.done <- nil
+	b2 := testStarted(t, started, "b2")
+	testQueue(t, "a2 b2", "a3")
+
+	a2.done <- nil
+	a3 := testStarted(t, started, "a3")
+	b2.done <- nil
+	a3.done <- nil
+	testQueue(t, "", "")
+
+	for name, eventc := range listeners {
+		unregisterBuild(testSpec(name), eventc)
+	}
+}
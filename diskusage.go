@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Disk usage of the caches in HomeDir, the SDKs and the results is exported as
+// metrics. With config Cleanup, idle extracted modules are removed from the module
+// cache, and the build cache is cleaned when it gets too big.
+
+// Held for reading while builds, and preparations for builds, use the module and
+// build caches. Cleaning the caches holds it for writing, so no builds run
+// meanwhile.
+var cacheLock sync.RWMutex
+
+// Go build cache, as go determines it from the home directory we set for go
+// commands.
+func buildCacheDir() string {
+	switch runtime.GOOS {
+	case "windows":
+		return filepath.Join(homedir, "LocalAppData", "go-build")
+	case "darwin", "ios":
+		return filepath.Join(homedir, "Library", "Caches", "go-build")
+	case "plan9":
+		return filepath.Join(homedir, "lib", "cache", "go-build")
+	}
+	return filepath.Join(homedir, ".cache", "go-build")
+}
+
+// Clean the caches with config Cleanup, and update the disk usage metrics, every
+// hour.
+func diskUsageLoop() {
+	for {
+		if config.Cleanup != nil {
+			cleanCaches()
+		}
+		updateDiskUsage()
+		time.Sleep(time.Hour)
+	}
+}
+
+func updateDiskUsage() {
+	dirs := map[string]string{
+		"modcache":   modcacheDir(),
+		"buildcache": buildCacheDir(),
+		"sdk":        config.SDKDir,
+		"result":     resultDir,
+	}
+	for name, dir := range dirs {
+		// Workers don't have a result directory.
+		if dir == "" {
+			continue
+		}
+		size, err := diskUsage(dir)
+		if err != nil {
+			log.Printf("disk usage of %s: %v", dir, err)
+			continue
+		}
+		metricDiskUsage.WithLabelValues(name).Set(float64(size))
+	}
+}
+
+// Total size of the files in dir. Files removed while walking the directory, e.g.
+// by builds, are skipped.
+func diskUsage(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.Type().IsRegular() {
+			if fi, err := d.Info(); err == nil {
+				size += fi.Size()
+			}
+		}
+		return nil
+	})
+	return size, err
+}
+
+func cleanCaches() {
+	// Wait for a moment without builds, for up to an hour. While we wait for the
+	// lock, new builds and pages preparing builds would wait for running builds.
+	locked := cacheLock.TryLock()
+	for i := 0; i < 60 && !locked; i++ {
+		time.Sleep(time.Minute)
+		locked = cacheLock.TryLock()
+	}
+	if !locked {
+		cacheLock.Lock()
+	}
+	defer cacheLock.Unlock()
+
+	if config.Cleanup.ModuleIdleHours > 0 {
+		var pruned int
+		var err error
+		if privsepFrontend {
+			// Extracted modules are read-only and owned by BuildUser.
+			pruned, err = privsepPruneModules()
+		} else {
+			pruned, err = pruneModules(time.Now())
+		}
+		metricModulesPruned.Add(float64(pruned))
+		if err != nil {
+			log.Printf("pruning module cache: %v", err)
+		}
+	}
+	if config.Cleanup.BuildCacheMaxMB > 0 {
+		if err := limitBuildCache(); err != nil {
+			log.Printf("cleaning build cache: %v", err)
+		}
+	}
+}
+
+// Remove extracted module directories from the module cache that haven't been
+// accessed for ModuleIdleHours. The zip files in the download cache are kept, go
+// extracts them again when the module is needed.
+func pruneModules(now time.Time) (int, error) {
+	idle := time.Duration(config.Cleanup.ModuleIdleHours) * time.Hour
+	root := modcacheDir()
+	var pruned int
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		} else if p == filepath.Join(root, "cache") {
+			return fs.SkipDir
+		} else if !strings.Contains(d.Name(), "@") {
+			return nil
+		}
+
+		// Directory of an extracted module, module@version.
+		if last, err := lastAccess(p); err != nil {
+			return err
+		} else if now.Sub(last) < idle {
+			return fs.SkipDir
+		}
+		if err := removeReadonlyTree(p); err != nil {
+			return err
+		}
+		pruned++
+		return fs.SkipDir
+	})
+	if pruned > 0 {
+		log.Printf("cleanup: removed %d idle extracted modules", pruned)
+	}
+	return pruned, err
+}
+
+// Most recent access time of the files in dir. Directories are not considered,
+// reading them to find the files changes their access time.
+func lastAccess(dir string) (time.Time, error) {
+	var last time.Time
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if t := fileAccessTime(fi); t.After(last) {
+			last = t
+		}
+		return nil
+	})
+	return last, err
+}
+
+// Remove dir, with read-only directories as go makes them in the module cache.
+func removeReadonlyTree(dir string) error {
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			err = os.Chmod(p, 0755)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// Run "go clean -cache" if the build cache is larger than BuildCacheMaxMB.
+func limitBuildCache() error {
+	size, err := diskUsage(buildCacheDir())
+	if err != nil {
+		return err
+	}
+	if size <= int64(config.Cleanup.BuildCacheMaxMB)*1024*1024 {
+		return nil
+	}
+
+	// Any toolchain will do, the newest knows about the build cache.
+	var goversion string
+	var newest goVersion
+	sdk.Lock()
+	for v := range sdk.installed {
+		if gv, err := parseGoVersion(v); err == nil && gv.num() > newest.num() {
+			goversion, newest = v, gv
+		}
+	}
+	sdk.Unlock()
+	if goversion == "" {
+		return errors.New("no go toolchain installed")
+	}
+	gobin, err := ensureGobin(goversion)
+	if err != nil {
+		return err
+	}
+
+	cmd := makeCommand(false, emptyDir, false, nil, gobin, "clean", "-cache")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("go clean -cache: %v\n%s", err, output)
+	}
+	metricBuildCacheCleans.Inc()
+	log.Printf("cleanup: cleaned go build cache of %.1f MB", float64(size)/(1024*1024))
+	return nil
+}
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"io/fs"
+	"syscall"
+	"time"
+)
+
+func fileAccessTime(fi fs.FileInfo) time.Time {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(st.Atim.Unix())
+	}
+	return fi.ModTime()
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"io/fs"
+	"time"
+)
+
+// Access times are only used on Linux. Elsewhere, modules are pruned by the time
+// they were extracted.
+func fileAccessTime(fi fs.FileInfo) time.Time {
+	return fi.ModTime()
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var errBadTarget = errors.New("unsupported target")
+
+// Target as listed by "go tool dist list -json".
+type distTarget struct {
+	GOOS         string
+	GOARCH       string
+	CgoSupported bool
+	FirstClass   bool
+}
+
+// We don't build for these goos, linking requires cgo.
+var excludedGoos = map[string]bool{
+	"android": true,
+	"ios":     true,
+}
+
+// Targets per goversion, from "go tool dist list". Also stored in
+// data/sdktargets/<goversion>.json, so we only run the command once per
+// toolchain.
+var distTargets = struct {
+	sync.Mutex
+	m map[string][]distTarget
+}{m: map[string][]distTarget{}}
+
+func distTargetsPath(goversion string) string {
+	return filepath.Join(config.DataDir, "sdktargets", goversion+".json")
+}
+
+// Targets supported by the toolchain for goversion, which must be installed.
+// The targets are added to the global target list.
+func sdkTargets(goversion string) ([]distTarget, error) {
+	distTargets.Lock()
+	defer distTargets.Unlock()
+
+	if l, ok := distTargets.m[goversion]; ok {
+		return l, nil
+	}
+
+	p := distTargetsPath(goversion)
+	buf, err := os.ReadFile(p)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	} else if err != nil {
+		gobin, err := ensureGobin(goversion)
+		if err != nil {
+			return nil, err
+		}
+		goproxy := false
+		cgo := false
+		cmd := makeCommand(goproxy, emptyDir, cgo, nil, gobin, "tool", "dist", "list", "-json")
+		stderr := &strings.Builder{}
+		cmd.Stderr = stderr
+		buf, err = cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("listing targets: %v\n\nstderr:\n%s", err, stderr.String())
+		}
+		os.MkdirAll(filepath.Dir(p), 0777) // error will show later
+		if err := os.WriteFile(p+".tmp", buf, 0666); err != nil {
+			return nil, err
+		} else if err := os.Rename(p+".tmp", p); err != nil {
+			return nil, err
+		}
+	}
+
+	var all []distTarget
+	if err := json.Unmarshal(buf, &all); err != nil {
+		return nil, fmt.Errorf("parsing target list: %v", err)
+	}
+	var l []distTarget
+	for _, t := range all {
+		if !excludedGoos[t.GOOS] {
+			l = append(l, t)
+		}
+	}
+	distTargets.m[goversion] = l
+	targets.merge(l)
+	return l, nil
+}
+
+// Load the targets of all installed toolchains, called at startup.
+func initSDKTargets() {
+	sdk.Lock()
+	var l []string
+	for goversion := range sdk.installed {
+		l = append(l, goversion)
+	}
+	sdk.Unlock()
+	for _, goversion := range l {
+		if _, err := sdkTargets(goversion); err != nil {
+			log.Printf("listing targets for %s: %v", goversion, err)
+		}
+	}
+}
+
+// Check the target of bs is supported by its toolchain, which must be installed.
+// Returns an error wrapping errBadTarget if not.
+func checkTarget(bs buildSpec) error {
+	l, err := sdkTargets(bs.Goversion)
+	if err != nil {
+		return fmt.Errorf("%w: listing targets for %s: %v", errServer, bs.Goversion, err)
+	}
+	for _, t := range l {
+		if t.GOOS == bs.Goos && t.GOARCH == bs.Goarch {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s/%s not supported by %s", errBadTarget, bs.Goos, bs.Goarch, bs.Goversion)
+}
@@ -21,7 +21,8 @@ form. Links are to the latest module and Go versions, and with goos/goarch
 guessed based on user-agent.
 
 The second URL first resolves "latest" for the module and Go version with a
-redirect. For URLs with explicit versions, it starts a build for the requested
+redirect. Goversion "module" resolves to the toolchain directive in the go.mod
+of the module, or the oldest Go release satisfying its go directive. For URLs with explicit versions, it starts a build for the requested
 parameters if no build is available yet. After a successful build, it redirects
 to a URL of the third kind.
 
@@ -32,6 +33,29 @@ command with different module versions, goversions, goos/goarch.
 
 You need not and cannot refresh a successful build: they would give the same result.
 
+To find the build for a binary you already have, use its sum:
+
+	/s/<sum>
+	/s/<sum>.json
+
+The first redirects to the result page of the build. The second returns all
+builds with that sum from the transparency log as JSON. "gobuild get -by-sum
+<sum>" uses it to find and verify a build.
+
+To build a command for many targets and goversions in one request, POST a JSON
+batch to /batch:
+
+	{"Module": "github.com/mjl-/gobuild", "Version": "latest", "Dir": "/",
+	 "Targets": ["linux/amd64", "linux/arm/6", "windows/amd64"], "Goversions": ["latest"]}
+
+The response has the batch ID, and a Location header with the URL of the
+summary of the batch, /batch/<id>, listing the status of each build with sums
+and download links when done. Progress of all builds is streamed at
+/batch/<id>/events, as Server-Sent Events: a "member" event for each changed
+build, and a "done" event with the summary when all builds have finished.
+"gobuild get -targets linux/amd64,windows/amd64 <module>@<version>" uses a batch,
+verifying each build with the transparency log.
+
 # Transparency log
 
 Gobuild maintains a transparency log containing the hashes of all successful
@@ -46,21 +70,100 @@ Examples:
 	gobuild get github.com/mjl-/gobuild@latest
 	gobuild get -sum 0N7e6zxGtHCObqNBDA_mXKv7-A9M -target linux/amd64 -goversion go1.14.1 github.com/mjl-/gobuild@v0.0.8
 
+A record is a line with space-separated fields:
+
+	<module> <version> <dir> <goos> <goarch> <goversion> <filesize> <sum> [variant=<variant>] [options=<fingerprint>]
+
+The variant and options fields were added later, and are only present for
+builds with a variant or options, in that order. Records of other builds have
+the original format. Older clients require exactly 8 fields and fail on lookups
+of records with the new fields, so upgrade "gobuild get" and monitors before
+building with variants or options. Clients reject unknown fields, later fields
+will have the same name=value form.
+
+Monitors and mirrors can follow new records without polling at /tlog/stream,
+a Server-Sent Events stream with an event for each added record, including the
+signed tree head for the tree ending with that record. The event ID is the
+record number, so a reconnecting client that sends Last-Event-ID doesn't miss
+records.
+
 # Details
 
 Only "go build" is run, for pure Go code. None of "go test", "go generate",
-build tags, cgo, custom compile/link flags, makefiles, etc. This means gobuild
-cannot build all Go applications.
+cgo, makefiles, etc. This means gobuild cannot build all Go applications.
+
+Builds can be for a microarchitecture variant of a goarch, set through GOAMD64,
+GOARM, GO386, GOMIPS, GOMIPS64 or GOPPC64, by adding the variant after the
+goarch, as in "linux-amd64-v3-go1.20" or "linux-arm-6-go1.20". Without variant,
+the default of the Go toolchain is set explicitly. With "gobuild get", specify
+a variant as "-target linux/arm/6".
+
+Modules can declare build tags and linker flags with directives in their go.mod:
+
+	//gobuild:tags netgo,osusergo
+	//gobuild:X main.version=$version
+	//gobuild:strip
+
+"$version" is replaced with the module version, "strip" adds "-s -w" to the
+linker flags. Builds of modules with options have a fingerprint of the options
+appended to the last path element, as in "linux-amd64-go1.20+<fingerprint>",
+and in the transparency log record. Build URLs without the fingerprint redirect
+to the URL with the options declared by the module.
 
-Gobuild looks up module versions through the Go module proxy. That's why
-shorthandversions like "@v1" don't resolve.
+Gobuild looks up module versions through the Go module proxy. Version queries
+like "@v1", "@v1.2", "@<v1.5", branch names like "@main" and commit hashes are
+resolved through the proxy and redirect to the URL with the canonical version,
+a tag or pseudo-version. Records in the transparency log always have canonical
+versions.
 
 Gobuild automatically downloads a Go toolchain (SDK) from https://go.dev/dl/
 when it is first referenced. It also periodically queries that page for the latest
 supported releases, for redirecting to the latest supported toolchains.
+The targets a toolchain can build for are read from "go tool dist list", and
+only those targets are built and linked to. Targets that require cgo for
+linking, such as android and ios, are not built.
 
 Gobuild can be configured to verify builds with other gobuild instances,
-requiring all to return the same hash for a build to be considered successful.
+requiring all, or a quorum, to return the same hash for a build to be considered
+successful. Verification can also happen after publishing, with disagreements
+logged. The verifier results are shown on the build page. When binaries differ,
+both are kept in data/quarantine, and /quarantine/ on the admin listener shows
+the differences in sections, build info and embedded paths.
+Gobuild can also follow the transparency logs of other gobuild instances (see
+the Follow config option), rebuilding each newly logged build and reporting
+binaries that differ. Rebuilds that fail temporarily are retried for a few
+hours, after which the record is reported and skipped. The status is shown at
+/follow on the admin listener.
+
+Queued and in-progress builds are stored in data/queue.json, and resumed when
+gobuild is restarted. Interrupted builds are started again from scratch. The
+queue is shown at /queue on the admin listener.
+
+Builds can be limited in duration with the BuildTimeout and BuildIdleTimeout
+config options, the latter for builds that stop writing output. A build is also
+stopped when all clients waiting for it have gone, unless it is already being
+published. Stopped builds are not stored as failed builds, a later request
+builds again.
+
+Builds are accounted to the client that requested them, by IP address, or by
+name for clients that send a token configured in ClientTokens in an
+"Authorization: Bearer" header. The queue alternates between clients, and the
+ClientMaxBuilds and ClientMaxQueued config options limit the builds per client.
+Builds for clients with a token, and for modules matching
+PriorityModulePrefixes, are started before other builds.
+
+Builds can be distributed over remote workers, started with "gobuild worker
+-url <gobuild-url> -tokenfile <file> [gobuild.conf]", with a token configured
+in the Workers config option. Workers connect to the gobuild instance over
+HTTP, advertising their capacity and installed Go toolchains, and are sent
+builds. A worker fetches the module and its dependencies and compiles in its own
+home and SDK directories, and returns the binary and build output. Gobuild
+itself still prepares each build, and calculates the hash, verifies and adds the
+build to the transparency log. A compile failure on a worker is only stored as
+failed build after a local compile fails too. Workers that already have the
+toolchain for a build are preferred, then local builds up to MaxBuilds. Multiple
+workers can run on a single machine, each with a config file with different
+directories. Connected workers are shown at /queue on the admin listener.
 
 It's easy to run a local instance, or an instance internal to your organization.
 
@@ -139,6 +242,52 @@ Test it with:
 By default, build results and sumdb files are stored in ./data, $HOME is set to
 ./home during builds and Go toolchains are installed in ./sdk.
 
+To limit disk usage, configure Retention to remove binaries that haven't been
+downloaded for a while, that are old, or when the binaries exceed a size
+budget. The record in the transparency log and the build log are kept. A
+download of a removed binary builds it again, and only serves and restores it
+if it has the hash from the transparency log.
+
+The caches in HomeDir grow with each module and build. Configure Cleanup to
+periodically remove extracted modules that haven't been used for a while (the
+downloaded zip files are kept), and to clean the go build cache when it exceeds
+a size. The disk usage of the caches, the SDKs and the result directory is
+exported as metrics.
+
+To reduce requests to GoProxy, configure GoProxyCache. Gobuild then runs a
+caching module proxy on a loopback address, used by go commands and for its own
+lookups. Module versions are kept permanently in DataDir/goproxy, version lists
+and latest versions are fetched again after a TTL.
+
+GoProxy can be a list of module proxies like GOPROXY: separated by "," to try
+the next proxy when a module is not found, or by "|" to try the next on any
+error. "direct" and "off" are not supported, modules are only fetched through
+module proxies. With GoProxyRoutes, modules with a path prefix, such as private
+modules, are fetched from other module proxies. Credentials for module proxies
+can be configured in a netrc file with Netrc. For lists, routes and credentials,
+gobuild runs the local module proxy, also without GoProxyCache, so go commands
+never see the credentials. The local module proxy only serves requests with a
+random secret path prefix, which is passed to go commands in GOPROXY, so other
+local users cannot fetch private modules through it. The secret is removed from
+logged commands and from output of go commands. GoPrivate and GoNoSumDB are
+passed to go commands as GOPRIVATE and GONOSUMDB, to skip checksum database
+verification of private modules. There is no GONOSUMCHECK setting: the go
+command has no such variable, GONOSUMDB (or GOPRIVATE) is how it skips checksum
+verification.
+
+The gzipped binaries and build logs of successful builds can be stored in an
+S3-compatible object storage bucket instead of the result directory, by
+configuring S3. Multiple gobuild instances can then share the stored binaries.
+Stored objects are never overwritten: an instance building a binary that is
+already stored checks it has the same hash, and uses the stored object.
+Retention only removes binaries of builds in an instance's own transparency
+log, based on its own downloads. When another instance removed a binary, a
+download builds and restores it again.
+With PresignDownloads, downloads of gzipped binaries are redirected to a
+presigned URL of the object storage. Any S3-compatible service with path-style
+URLs, signature version 4 and conditional writes (If-None-Match) works, such as
+a local MinIO for testing.
+
 You can configure your own signer key for your transparency log. Create new keys with:
 
 	gobuild genkey you.example.org
@@ -146,11 +295,42 @@ You can configure your own signer key for your transparency log. Create new keys
 Now configure the signer key in the config file. And run "gobuild get" with the
 -verifierkey flag.
 
+To check the consistency of the entire transparency log (records, hashes,
+recordnumber files and binaries), run:
+
+	gobuild verify-log [-repair] [-json] [gobuild.conf]
+
 Keep security in mind when offering public access to your gobuild instance.
 Run gobuild in a locked down environment, with restricted system access (files,
 network, processes, kernel features), possibly through systemd or with
 containers.
 
+On Linux, go commands can be run in a built-in sandbox by configuring Sandbox,
+instead of a wrapper like run.sh in Run. Go commands then run in new user,
+mount, pid, network, ipc and uts namespaces, with only system paths, the SDKs
+and a few directories in HomeDir available, writable only where needed, and with
+resource limits. Only go commands that download modules have network access,
+through a proxy in gobuild that only allows connections to GoProxy and the
+configured AllowHosts. Check that the sandbox works as intended with:
+
+	gobuild sandbox-test [gobuild.conf]
+
+Only go commands that download modules write to the shared module cache in
+HomeDir/go/pkg/mod. A module is only used after its download is complete and
+its zip file matches its hash. Builds (with go1.15 and later) use a module
+cache of their own in HomeDir/modcache, extracting modules from the downloads
+in the shared module cache, and remove it afterwards.
+
+On Linux, gobuild can run with privilege separation by configuring PrivSep, and
+starting "gobuild serve" as root. A privileged process opens the listeners and
+the transparency log, and starts a second gobuild process as ServeUser for the
+HTTP servers and coordinating builds. Go commands are started by the privileged
+process as BuildUser, optionally in the sandbox. With Sandbox configured, the
+privileged process only runs go commands in the sandbox, with mounts and limits
+from its own config. Only the privileged process writes the transparency log
+and the result directory in DataDir, it receives requests from the HTTP process
+over a unix socket. Ownership of directories is changed as needed at startup.
+
 You could make all outgoing network traffic go through an HTTPS proxy by
 setting an environment variable HTTPS_PROXY=... (refuse all other outgoing
 connections). The proxy should allow the following addresses:
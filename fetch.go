@@ -1,11 +1,21 @@
 package main
 
 import (
+	"archive/zip"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/mod/module"
@@ -27,21 +37,225 @@ func ensureModule(goversion, gobin, mod, version string) (string, []byte, error)
 	if err != nil {
 		return "", nil, fmt.Errorf("%w: %v", errBadVersion, err)
 	}
-	modDir := filepath.Join(homedir, "go", "pkg", "mod", filepath.Clean(modPath)+"@"+modVersion)
+	modDir := filepath.Join(modcacheDir(), filepath.Clean(modPath)+"@"+modVersion)
 
-	if _, err := os.Stat(modDir); err == nil {
-		return modDir, nil, nil
-	} else if !os.IsNotExist(err) {
-		return "", nil, fmt.Errorf("%w: checking if module is checked out locally: %v", errServer, err)
+	// The module is only available when its download is complete and verified, go
+	// writes the ziphash file after verifying the zip file. A module directory
+	// alone can be left behind by an interrupted download. Builds extract the zip
+	// file, so it must still match.
+	if err := checkModuleZip(modPath, modVersion); err == nil {
+		if _, err := os.Stat(modDir); err == nil {
+			return modDir, nil, nil
+		} else if !os.IsNotExist(err) {
+			return "", nil, fmt.Errorf("%w: checking if module is checked out locally: %v", errServer, err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("removing corrupt download of %s@%s from module cache: %v", mod, version, err)
+		zipPath := moduleZipPath(modPath, modVersion)
+		if err := os.Remove(zipPath + "hash"); err != nil && !os.IsNotExist(err) {
+			return "", nil, fmt.Errorf("%w: removing corrupt module download: %v", errServer, err)
+		} else if err := os.Remove(zipPath); err != nil && !os.IsNotExist(err) {
+			return "", nil, fmt.Errorf("%w: removing corrupt module download: %v", errServer, err)
+		}
 	}
 
 	// todo: for errors, want to know if module or version does not exist. probably requires parsing the error message for: 1. no module; 2. no version; 3. no package.
 	if output, err := fetchModule(goversion, gobin, mod, version); err != nil {
 		return "", output, err
 	}
+	if err := checkModuleZip(modPath, modVersion); err != nil {
+		return "", nil, fmt.Errorf("%w: checking downloaded module: %v", errServer, err)
+	}
 	return modDir, nil, nil
 }
 
+// Shared module cache. Only go commands downloading modules write to it. Builds
+// use their own module cache, see buildModcacheEnv.
+func modcacheDir() string {
+	return filepath.Join(homedir, "go", "pkg", "mod")
+}
+
+// Directory with the module caches of builds in progress.
+func buildModcachesDir() string {
+	return filepath.Join(homedir, "modcache")
+}
+
+func moduleZipPath(modPath, modVersion string) string {
+	return filepath.Join(modcacheDir(), "cache", "download", filepath.Clean(modPath), "@v", modVersion+".zip")
+}
+
+// Zip files already verified, with their modification time and hash. Verifying
+// means reading the entire zip file, we don't want to do that for each request.
+var verifiedZips = struct {
+	sync.Mutex
+	m map[string]verifiedZip
+}{m: map[string]verifiedZip{}}
+
+type verifiedZip struct {
+	mtime time.Time
+	hash  string
+}
+
+// Check the module zip file in the download cache matches its ziphash file.
+// Returns an error wrapping fs.ErrNotExist if the download is not complete.
+func checkModuleZip(modPath, modVersion string) error {
+	p := moduleZipPath(modPath, modVersion)
+	buf, err := os.ReadFile(p + "hash")
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	exp := strings.TrimSpace(string(buf))
+	verifiedZips.Lock()
+	vz, ok := verifiedZips.m[p]
+	verifiedZips.Unlock()
+	if ok && vz.mtime.Equal(fi.ModTime()) && vz.hash == exp {
+		return nil
+	}
+
+	h, err := hashModuleZip(p)
+	if err != nil {
+		return fmt.Errorf("hashing zip file: %v", err)
+	}
+	if h != exp {
+		return fmt.Errorf("zip file has hash %s, expected %s", h, exp)
+	}
+	verifiedZips.Lock()
+	verifiedZips.m[p] = verifiedZip{fi.ModTime(), h}
+	verifiedZips.Unlock()
+	return nil
+}
+
+// Calculate the hash of a module zip file like go does for the ziphash file, the
+// "h1:" hash from go.sum: a sha256 over lines with the sha256 of each file and
+// its name, sorted by name.
+func hashModuleZip(p string) (string, error) {
+	zr, err := zip.OpenReader(p)
+	if err != nil {
+		return "", err
+	}
+	defer zr.Close()
+	files := append([]*zip.File{}, zr.File...)
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+	h := sha256.New()
+	for _, f := range files {
+		if strings.Contains(f.Name, "\n") {
+			return "", fmt.Errorf("file name with newline")
+		}
+		r, err := f.Open()
+		if err != nil {
+			return "", err
+		}
+		fh := sha256.New()
+		_, err = io.Copy(fh, r)
+		r.Close()
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%x  %s\n", fh.Sum(nil), f.Name)
+	}
+	return "h1:" + base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// Random ID of this process, the prefix of the module caches of its builds. Other
+// processes, e.g. workers with the same HomeDir, have their own. While running, we
+// hold a lock on file "<id>.lock" in buildModcachesDir.
+var buildModcacheID string
+
+// Kept open for the lifetime of the process, for the lock.
+var buildModcacheLock *os.File
+
+// Register this process for module caches of builds, and remove module caches
+// left behind by processes that are gone.
+func initBuildModcaches() {
+	dir := buildModcachesDir()
+	os.MkdirAll(dir, 0777) // errors will be caught later
+	buf := make([]byte, 8)
+	if _, err := cryptorand.Read(buf); err != nil {
+		log.Fatalf("random id for module caches: %v", err)
+	}
+	buildModcacheID = fmt.Sprintf("%x", buf)
+	f, err := os.OpenFile(filepath.Join(dir, buildModcacheID+".lock"), os.O_CREATE|os.O_EXCL|os.O_RDWR, 0666)
+	if err != nil {
+		log.Fatalf("creating lock file for module caches: %v", err)
+	}
+	// The name is random, nobody else has the lock.
+	tryLockFile(f)
+	buildModcacheLock = f
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Fatalf("reading module caches of builds: %v", err)
+	}
+	remove := func(p string) {
+		if err := os.RemoveAll(p); err != nil {
+			log.Printf("removing leftover of interrupted build: %v", err)
+		}
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if id := strings.TrimSuffix(name, ".lock"); id != name {
+			if id == buildModcacheID {
+				continue
+			}
+			// If we can get the lock, the process is gone.
+			lf, err := os.Open(filepath.Join(dir, name))
+			if err != nil {
+				continue
+			}
+			if tryLockFile(lf) {
+				removeLeftovers(dir, id+"-*")
+				remove(lf.Name())
+			}
+			lf.Close()
+		} else if t := strings.SplitN(name, "-", 2); len(t) != 2 {
+			// From before module caches were per process.
+			remove(filepath.Join(dir, name))
+		} else if _, err := os.Stat(filepath.Join(dir, t[0]+".lock")); os.IsNotExist(err) {
+			remove(filepath.Join(dir, name))
+		}
+	}
+}
+
+// Make a path for the module cache of a build. It is created by the go command,
+// and must be removed when the build is done.
+func newBuildModcache() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := cryptorand.Read(buf); err != nil {
+		return "", err
+	}
+	return filepath.Join(buildModcachesDir(), fmt.Sprintf("%s-%x", buildModcacheID, buf)), nil
+}
+
+// Environment for a go command building with its own module cache at dir. It
+// extracts modules from the download cache of the shared module cache, used as
+// file-based module proxy, so builds cannot modify the shared module cache.
+// Downloads were verified when added to the shared module cache, so the checksum
+// database isn't consulted. Files are writable so the module cache can be removed.
+func buildModcacheEnv(dir string) []string {
+	proxy := filepath.ToSlash(filepath.Join(modcacheDir(), "cache", "download"))
+	if !strings.HasPrefix(proxy, "/") {
+		proxy = "/" + proxy
+	}
+	goflags := "-modcacherw"
+	for _, s := range config.Environment {
+		if strings.HasPrefix(s, "GOFLAGS=") {
+			goflags = strings.TrimPrefix(s, "GOFLAGS=") + " " + goflags
+		}
+	}
+	return []string{
+		"GOMODCACHE=" + dir,
+		"GOPROXY=file://" + proxy,
+		"GOSUMDB=off",
+		"GOFLAGS=" + goflags,
+	}
+}
+
 func fetchModule(goversion, gobin, mod, version string) ([]byte, error) {
 	t0 := time.Now()
 	defer func() {
@@ -64,7 +278,7 @@ func fetchModule(goversion, gobin, mod, version string) ([]byte, error) {
 	}
 	if output, err := cmd.CombinedOutput(); err != nil {
 		metricGogetErrors.Inc()
-		return output, fmt.Errorf("go get: %v", err)
+		return []byte(redactGoproxy(string(output))), fmt.Errorf("go get: %v", err)
 	}
 	return nil, nil
 }
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mjl-/gobuild/internal/sumdb"
+
+	"golang.org/x/mod/sumdb/note"
+	"golang.org/x/mod/sumdb/tlog"
+)
+
+// Status of a followed record after rebuilding.
+const (
+	followMatch    = "match"    // Our build has the same sum and size.
+	followMismatch = "mismatch" // Our build resulted in a different binary.
+	followInvalid  = "invalid"  // Record from stream not in remote transparency log.
+	followSkipped  = "skipped"  // Build not allowed by our config.
+	followFailed   = "failed"   // Our build failed, e.g. with a compile error.
+	followError    = "error"    // Temporary failure, e.g. network or timeout. Retried.
+	followGaveUp   = "gaveup"   // Temporary failures for followMaxAttempts, moved on.
+)
+
+// Attempts at rebuilding a record with temporary failures, over about 4 hours,
+// before moving on to the next record.
+const followMaxAttempts = 10
+
+// followResult is the outcome of rebuilding a record from a followed log.
+// Mismatches, failed builds and records we gave up on are stored as JSON lines
+// in data/follow/<name>/mismatches.json.
+type followResult struct {
+	Time         time.Time
+	RecordNumber int64
+	Key          string
+	Status       string
+	RemoteSum    string
+	LocalSum     string `json:",omitempty"`
+	Error        string `json:",omitempty"`
+
+	local *buildResult // Our build, for quarantining a mismatch.
+}
+
+// followState is shown on the /follow status page.
+type followState struct {
+	Name      string
+	URL       string
+	Next      int64 // Next record number to rebuild.
+	TreeSize  int64 // Last known size of the remote log.
+	Connected bool
+	LastError string
+	Stopped   string         // Set when following stopped permanently, after a security error.
+	Counts    map[string]int // Number of records per status.
+	Recent    []followResult // Most recent first.
+}
+
+type follower struct {
+	dir       string // data/follow/<name>
+	fromStart bool
+	client    *sumdb.Client
+	ops       *clientOps
+	verifier  note.Verifier
+
+	sync.Mutex
+	state followState
+	busy  bool // Whether a record is being rebuilt.
+}
+
+var followers []*follower
+
+// Start following the configured logs. Called at startup, after the coordinator
+// has started.
+func startFollowers() {
+	for _, fc := range config.Follow {
+		dir := filepath.Join(config.DataDir, "follow", fc.Name)
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			log.Fatalf("follow %s: making directory: %v", fc.Name, err)
+		}
+		verifier, err := note.NewVerifier(fc.VerifierKey)
+		if err != nil {
+			log.Fatalf("follow %s: parsing verifier key: %v", fc.Name, err)
+		}
+		url := strings.TrimRight(fc.URL, "/")
+		client, ops, err := newClientDir(fc.VerifierKey, url+"/tlog", filepath.Join(dir, "tlog"))
+		if err != nil {
+			log.Fatalf("follow %s: new tlog client: %v", fc.Name, err)
+		}
+		f := &follower{
+			dir:       dir,
+			fromStart: fc.FromStart,
+			client:    client,
+			ops:       ops,
+			verifier:  verifier,
+			state: followState{
+				Name:   fc.Name,
+				URL:    url,
+				Next:   -1,
+				Counts: map[string]int{},
+			},
+		}
+		ops.securityError = f.securityError
+		if buf, err := os.ReadFile(filepath.Join(dir, "next")); err == nil {
+			f.state.Next, err = strconv.ParseInt(strings.TrimSpace(string(buf)), 10, 64)
+			if err != nil {
+				log.Fatalf("follow %s: parsing next record number: %v", fc.Name, err)
+			}
+		} else if !os.IsNotExist(err) {
+			log.Fatalf("follow %s: reading next record number: %v", fc.Name, err)
+		}
+		followers = append(followers, f)
+		go f.run()
+	}
+}
+
+func (f *follower) snapshot() followState {
+	f.Lock()
+	defer f.Unlock()
+	s := f.state
+	s.Counts = map[string]int{}
+	for k, v := range f.state.Counts {
+		s.Counts[k] = v
+	}
+	s.Recent = append([]followResult{}, f.state.Recent...)
+	return s
+}
+
+func (f *follower) logf(format string, args ...interface{}) {
+	log.Printf("follow %s: %s", f.state.Name, fmt.Sprintf(format, args...))
+}
+
+func (f *follower) securityError(msg string) {
+	f.logf("ALERT: security error, transparency log misbehaving, stopping: %s", msg)
+	metricFollowSecurityErrors.WithLabelValues(f.state.Name).Inc()
+	f.Lock()
+	f.state.Stopped = msg
+	f.Unlock()
+}
+
+func (f *follower) setError(err error) {
+	f.Lock()
+	defer f.Unlock()
+	f.state.LastError = err.Error()
+	f.state.Connected = false
+	metricFollowConnected.WithLabelValues(f.state.Name).Set(0)
+}
+
+// Keep following the stream of the remote log, reconnecting after errors.
+func (f *follower) run() {
+	backoff := 10 * time.Second
+	for {
+		next := f.snapshot().Next
+		err := f.follow()
+		if f.snapshot().Stopped != "" {
+			return
+		}
+		f.logf("%v, reconnecting in %s", err, backoff)
+		f.setError(err)
+		time.Sleep(backoff)
+		if f.snapshot().Next > next {
+			backoff = 10 * time.Second
+		} else if backoff < 5*time.Minute {
+			backoff *= 2
+		}
+	}
+}
+
+// Read the signed latest tree of the remote log. The sumdb client verifies the
+// tree is consistent with earlier trees during lookups.
+func (f *follower) readLatest() (tlog.Tree, error) {
+	buf, err := f.ops.ReadRemote("/latest")
+	if err != nil {
+		return tlog.Tree{}, fmt.Errorf("reading latest tree: %v", err)
+	}
+	n, err := note.Open(buf, note.VerifierList(f.verifier))
+	if err != nil {
+		return tlog.Tree{}, fmt.Errorf("verifying latest tree: %v", err)
+	}
+	tree, err := tlog.ParseTree([]byte(n.Text))
+	if err != nil {
+		return tlog.Tree{}, fmt.Errorf("parsing latest tree: %v", err)
+	}
+	f.Lock()
+	f.state.TreeSize = tree.N
+	f.Unlock()
+	metricFollowTreeSize.WithLabelValues(f.state.Name).Set(float64(tree.N))
+	return tree, nil
+}
+
+// Connect to the stream of the remote log and rebuild records as they come in.
+// Returns when the connection fails or a record cannot be processed.
+func (f *follower) follow() error {
+	tree, err := f.readLatest()
+	if err != nil {
+		return err
+	}
+	if f.snapshot().Next < 0 {
+		next := tree.N
+		if f.fromStart {
+			next = 0
+		}
+		if err := f.writeNext(next); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", f.state.URL+"/tlog/stream", nil)
+	if err != nil {
+		return fmt.Errorf("new request: %v", err)
+	}
+	req.Header.Set("Last-Event-ID", fmt.Sprintf("%d", f.snapshot().Next-1))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("connecting to stream: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("connecting to stream: %s", resp.Status)
+	}
+	f.Lock()
+	f.state.Connected = true
+	f.state.LastError = ""
+	f.Unlock()
+	metricFollowConnected.WithLabelValues(f.state.Name).Set(1)
+
+	// Periodically check the remote tree. If it has grown but the stream hasn't made
+	// progress, the stream is stuck and we reconnect. This also notices a stream
+	// that leaves out records.
+	go func() {
+		t := time.NewTicker(10 * time.Minute)
+		defer t.Stop()
+		prev := int64(-1)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+			f.Lock()
+			next, busy := f.state.Next, f.busy
+			f.Unlock()
+			if tree, err := f.readLatest(); err != nil {
+				f.logf("periodic check: %v", err)
+			} else if tree.N > next && next == prev && !busy {
+				f.logf("stream not making progress, remote tree has %d records, waiting for %d, reconnecting", tree.N, next)
+				cancel()
+				return
+			}
+			prev = next
+		}
+	}()
+
+	// Parse the SSE stream, with fields on lines, and events ending with an empty line.
+	var event, data string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line != "" {
+			if strings.HasPrefix(line, "event: ") {
+				event = line[len("event: "):]
+			} else if strings.HasPrefix(line, "data: ") {
+				data = line[len("data: "):]
+			}
+			continue
+		}
+		if event == "record" {
+			var sr streamRecord
+			if err := json.Unmarshal([]byte(data), &sr); err != nil {
+				return fmt.Errorf("parsing record from stream: %v", err)
+			}
+			if err := f.process(ctx, sr); err != nil {
+				return err
+			}
+		}
+		event, data = "", ""
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading stream: %v", err)
+	}
+	return fmt.Errorf("stream closed")
+}
+
+// Process a record from the stream: verify it is in the log, rebuild it, and
+// compare the result. Only returns an error if following should stop.
+func (f *follower) process(ctx context.Context, sr streamRecord) error {
+	next := f.snapshot().Next
+	if sr.RecordNumber < next {
+		return nil
+	} else if sr.RecordNumber > next {
+		return fmt.Errorf("stream skipped records, got %d, expected %d", sr.RecordNumber, next)
+	}
+
+	f.Lock()
+	f.busy = true
+	if sr.RecordNumber+1 > f.state.TreeSize {
+		f.state.TreeSize = sr.RecordNumber + 1
+	}
+	f.Unlock()
+	defer func() {
+		f.Lock()
+		f.busy = false
+		f.Unlock()
+	}()
+
+	// Temporary failures are retried. After too many attempts we move on, so a single
+	// record cannot stop following, and record it as given up.
+	var fr followResult
+	for attempt, backoff := 1, time.Minute; ; attempt, backoff = attempt+1, backoff*2 {
+		fr = f.rebuild(ctx, sr)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		} else if fr.Status != followError {
+			break
+		}
+		if backoff > time.Hour {
+			backoff = time.Hour
+		}
+		metricFollowRecords.WithLabelValues(f.state.Name, fr.Status).Inc()
+		f.Lock()
+		f.state.LastError = fmt.Sprintf("record %d: %s", fr.RecordNumber, fr.Error)
+		f.Unlock()
+		if attempt >= followMaxAttempts {
+			fr.Status = followGaveUp
+			fr.Error = fmt.Sprintf("giving up after %d attempts: %s", attempt, fr.Error)
+			break
+		}
+		f.logf("record %d, %s: %s, retrying in %s", fr.RecordNumber, fr.Key, fr.Error, backoff)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+	}
+	f.record(fr)
+	if f.snapshot().Stopped != "" {
+		return errors.New("stopped after security error")
+	}
+	return f.writeNext(next + 1)
+}
+
+func (f *follower) rebuild(ctx context.Context, sr streamRecord) followResult {
+	fr := followResult{Time: time.Now(), RecordNumber: sr.RecordNumber}
+	result := func(status string, format string, args ...interface{}) followResult {
+		fr.Status = status
+		if format != "" {
+			fr.Error = fmt.Sprintf(format, args...)
+		}
+		return fr
+	}
+
+	br, err := parseRecord([]byte(sr.Record))
+	if err != nil {
+		return result(followInvalid, "parsing record: %v", err)
+	}
+	fr.Key = br.String()
+	fr.RemoteSum = br.Sum
+
+	// Verify the record is in the log, through the signed tree and tiles.
+	if id, data, err := f.client.Lookup(fr.Key); err != nil {
+		if errors.Is(err, sumdb.ErrSecurity) {
+			return result(followInvalid, "lookup: %v", err)
+		}
+		return result(followError, "lookup: %v", err)
+	} else if id != sr.RecordNumber {
+		return result(followInvalid, "lookup returned record %d", id)
+	} else if !bytes.Equal(data, []byte(sr.Record)) {
+		return result(followInvalid, "lookup returned different record %q", data)
+	}
+
+	if !moduleAllowed(br.Mod) {
+		return result(followSkipped, "module not allowed by config")
+	}
+
+	local, err := followBuild(ctx, br.buildSpec)
+	if err != nil {
+		if errors.Is(err, errBadGoversion) || errors.Is(err, errBadTarget) || errors.Is(err, errBadVariant) {
+			return result(followSkipped, "%v", err)
+		} else if errors.Is(err, errBuildFailed) || errors.Is(err, errCompile) || errors.Is(err, errNotExist) || errors.Is(err, errBadModule) || errors.Is(err, errBadVersion) || errors.Is(err, errBadOptions) {
+			return result(followFailed, "%v", err)
+		}
+		return result(followError, "%v", err)
+	}
+	fr.LocalSum = local.Sum
+	fr.local = local
+	if local.Sum != br.Sum {
+		return result(followMismatch, "")
+	} else if local.Filesize != br.Filesize {
+		return result(followMismatch, "filesize %d, remote %d", local.Filesize, br.Filesize)
+	}
+	return result(followMatch, "")
+}
+
+var errBuildFailed = errors.New("build failed")
+
+// Build through the coordinator, like a user-requested build. Returns an
+// existing result if we already have one.
+func followBuild(ctx context.Context, bs buildSpec) (*buildResult, error) {
+	if _, br, failed, err := (serverOps{}.lookupResult(ctx, bs)); err != nil {
+		return nil, fmt.Errorf("looking up result: %v", err)
+	} else if failed {
+		return nil, fmt.Errorf("%w earlier", errBuildFailed)
+	} else if br != nil {
+		return br, nil
+	}
+
+	if err := prepareBuild(bs); err != nil {
+		return nil, fmt.Errorf("preparing build: %w", err)
+	}
+
+	eventc := make(chan buildUpdate, 100)
+	registerBuild(bs, internalClient, eventc)
+	defer unregisterBuild(bs, eventc)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case update := <-eventc:
+			if !update.done {
+				continue
+			}
+			if update.err != nil {
+				return nil, fmt.Errorf("build failed: %w", update.err)
+			}
+			return update.result, nil
+		}
+	}
+}
+
+func (f *follower) record(fr followResult) {
+	metricFollowRecords.WithLabelValues(f.state.Name, fr.Status).Inc()
+
+	f.Lock()
+	f.state.Counts[fr.Status]++
+	f.state.Recent = append([]followResult{fr}, f.state.Recent...)
+	if len(f.state.Recent) > 50 {
+		f.state.Recent = f.state.Recent[:50]
+	}
+	f.Unlock()
+
+	if fr.Status != followMismatch && fr.Status != followInvalid && fr.Status != followFailed && fr.Status != followGaveUp {
+		return
+	}
+	f.logf("ALERT: %s for record %d, %s: remote sum %s, local sum %s %s", fr.Status, fr.RecordNumber, fr.Key, fr.RemoteSum, fr.LocalSum, fr.Error)
+	if fr.Status == followMismatch && fr.local != nil {
+		quarantineStored("follow", *fr.local, []quarantineRemote{{f.state.URL, fr.RemoteSum}})
+	}
+	buf, err := json.Marshal(fr)
+	if err != nil {
+		f.logf("marshal mismatch: %v", err)
+		return
+	}
+	p := filepath.Join(f.dir, "mismatches.json")
+	mf, err := os.OpenFile(p, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		f.logf("open mismatches file: %v", err)
+		return
+	}
+	defer mf.Close()
+	if _, err := mf.Write(append(buf, '\n')); err != nil {
+		f.logf("writing mismatch: %v", err)
+	}
+}
+
+// Store the next record number to process, so we continue there after a restart.
+func (f *follower) writeNext(next int64) error {
+	p := filepath.Join(f.dir, "next")
+	if err := os.WriteFile(p+".tmp", []byte(fmt.Sprintf("%d\n", next)), 0666); err != nil {
+		return fmt.Errorf("writing next record number: %v", err)
+	} else if err := os.Rename(p+".tmp", p); err != nil {
+		return fmt.Errorf("writing next record number: %v", err)
+	}
+	f.Lock()
+	f.state.Next = next
+	f.Unlock()
+	metricFollowNext.WithLabelValues(f.state.Name).Set(float64(next))
+	return nil
+}
+
+// Serve status of followed logs, on the admin listener.
+func serveFollow(w http.ResponseWriter, r *http.Request) {
+	var states []followState
+	for _, f := range followers {
+		states = append(states, f.snapshot())
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := followTemplate.Execute(w, map[string]interface{}{"Follow": states}); err != nil {
+		log.Printf("executing follow template: %v", err)
+	}
+}
@@ -1,14 +1,18 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"compress/gzip"
 	"context"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -16,6 +20,8 @@ import (
 	"time"
 
 	"github.com/mjl-/goreleases"
+
+	"github.com/mjl-/gobuild/internal/sumdb"
 )
 
 // Once gobuild is out of beta, this will be the verifier key for gobuilds.org.
@@ -27,25 +33,30 @@ func get(args []string) {
 	flags := flag.NewFlagSet("get", flag.ExitOnError)
 
 	var (
-		verifierKey = flags.String("verifierkey", gobuildsOrgVerifierKey, "Verifier key for transparency log.")
-		baseURL     = flags.String("url", "", "URL for lookups of hashes at the transparency log. If empty, this is set based on the name of the verifier key, using HTTPS if name contains a dot and plain HTTP otherwise.")
-		verbose     = flags.Bool("verbose", false, "Print actions.")
-		sum         = flags.String("sum", "", "Sum to verify.")
-		bindir      = flags.String("bindir", ".", "Directory to store binary in.")
-		target      = flags.String("target", "", "Target to retrieve binary for. Default is current GOOS/GOARCH.")
-		goversion   = flags.String("goversion", "latest", `Go toolchain/SDK version. Default "latest" resolves through go.dev/dl/, caching results for 1 hour.`)
-		download    = flags.Bool("download", true, "Download binary.")
-		goproxy     = flags.String("goproxy", "https://proxy.golang.org", `Go proxy to use for resolving "latest" module versions.`)
+		verifierKey  = flags.String("verifierkey", gobuildsOrgVerifierKey, "Verifier key for transparency log.")
+		baseURL      = flags.String("url", "", "URL for lookups of hashes at the transparency log. If empty, this is set based on the name of the verifier key, using HTTPS if name contains a dot and plain HTTP otherwise.")
+		verbose      = flags.Bool("verbose", false, "Print actions.")
+		sum          = flags.String("sum", "", "Sum to verify.")
+		bindir       = flags.String("bindir", ".", "Directory to store binary in.")
+		target       = flags.String("target", "", "Target to retrieve binary for, as goos/goarch, with optional microarchitecture variant like linux/arm/6 or linux/amd64/v3. Default is current GOOS/GOARCH.")
+		goversion    = flags.String("goversion", "latest", `Go toolchain/SDK version. Default "latest" resolves through go.dev/dl/, caching results for 1 hour. "module" resolves to the toolchain or go directive in the go.mod of the module, fetched through the goproxy.`)
+		download     = flags.Bool("download", true, "Download binary.")
+		goproxy      = flags.String("goproxy", "https://proxy.golang.org", `Go proxy to use for resolving "latest" module versions.`)
+		bySum        = flags.String("by-sum", "", "Find the build with this sum through the gobuild instance, and retrieve it. Instead of a module@version/package parameter.")
+		options      = flags.String("options", "", `Fingerprint of the build options declared by the module, "none" for a module without options. If empty, the options are discovered through the gobuild instance.`)
+		batchTargets = flags.String("targets", "", "Comma-separated targets, like linux/amd64,linux/arm/6,windows/amd64, to build as a batch at the gobuild instance. Each binary is stored in a subdirectory of bindir named after its target. Cannot be combined with -target or -by-sum.")
 	)
 
 	flags.Usage = func() {
 		log.Println("usage: gobuild get [flags] module@version/package")
+		log.Println("       gobuild get [flags] -by-sum sum")
+		log.Println("       gobuild get [flags] -targets goos/goarch,... module@version/package")
 		flags.PrintDefaults()
 		os.Exit(2)
 	}
 	flags.Parse(args)
 	args = flags.Args()
-	if len(args) != 1 {
+	if *bySum == "" && len(args) != 1 || *bySum != "" && len(args) != 0 || *batchTargets != "" && (*bySum != "" || *target != "") {
 		flags.Usage()
 	}
 
@@ -59,91 +70,364 @@ func get(args []string) {
 		}
 	}
 
-	// Parse specifier from command-line.
-	bs, err := parseGetSpec(args[0])
+	client, clientOps, err := newClient(*verifierKey, *baseURL)
 	if err != nil {
-		log.Fatalf("parsing module@version/package: %v", err)
+		log.Fatalf("new client: %v", err)
 	}
+	gobuildBaseURL := strings.TrimSuffix(clientOps.baseURL, "/tlog")
 
-	// Set goos & goarch based on -target or runtime.
-	if *target == "" {
-		bs.Goos = runtime.GOOS
-		bs.Goarch = runtime.GOARCH
-	} else {
-		t := strings.Split(*target, "/")
-		if len(t) != 2 {
-			log.Fatal("bad target")
+	if *batchTargets != "" {
+		bs := getSpec(args[0], "", *goversion, *goproxy)
+		if !getBatch(client, gobuildBaseURL, bs, strings.Split(*batchTargets, ","), *options, *bindir, *download) {
+			os.Exit(1)
 		}
-		bs.Goos = t[0]
-		bs.Goarch = t[1]
+		return
 	}
 
-	// Resolve latest version of go if needed.
-	if *goversion == "latest" {
-		getLog("resolving latest goversion")
-		bs.Goversion, err = resolveLatestGoversion()
+	var bs buildSpec
+	if *bySum != "" {
+		// Find the build for the sum. The result is verified through the transparency
+		// log below, like any other lookup.
+		if !isSum(*bySum) {
+			log.Fatalf("invalid sum %q", *bySum)
+		}
+		if *sum != "" && *sum != *bySum {
+			log.Fatalf("different values for -sum and -by-sum")
+		}
+		*sum = *bySum
+		bs, err = resolveSum(gobuildBaseURL, *bySum)
 		if err != nil {
-			log.Fatalf("resolving latest go version: %v", err)
+			log.Fatalf("looking up build by sum: %v", err)
 		}
-		getLog("latest goversion is %s", bs.Goversion)
+		getLog("sum is for build %s", bs)
 	} else {
-		bs.Goversion = *goversion
-	}
-
-	// Resolve latest module version at goproxy.
-	if bs.Version == "latest" {
-		getLog("resolving latest module version through goproxy")
-		if modVer, err := resolveModuleLatest(context.Background(), *goproxy, bs.Mod); err != nil {
-			log.Fatalf("resolving latest module: %v", err)
-		} else {
-			bs.Version = modVer.Version
-			log.Printf("latest module version is %s", bs.Version)
+		bs = getSpec(args[0], *target, *goversion, *goproxy)
+		switch *options {
+		case "none":
+		case "":
+			bs.Options, err = discoverOptions(gobuildBaseURL, bs)
+			if err != nil {
+				log.Fatalf("discovering build options: %v", err)
+			}
+			if bs.Options != "" {
+				getLog("module has build options %s", bs.Options)
+			}
+		default:
+			if !isOptionsFingerprint(*options) {
+				log.Fatalf("invalid options fingerprint %q", *options)
+			}
+			bs.Options = *options
 		}
 	}
 
-	client, clientOps, err := newClient(*verifierKey, *baseURL)
-	if err != nil {
-		log.Fatalf("new client: %v", err)
+	if err := retrieve(client, gobuildBaseURL, bs, *sum, *bindir, *download); err != nil {
+		log.Fatal(err)
 	}
+}
+
+// Look up the build in the transparency log, verify it against sum if not
+// empty, and download the binary to bindir if download is set.
+func retrieve(client *sumdb.Client, gobuildBaseURL string, bs buildSpec, sum, bindir string, download bool) error {
 	key := bs.String()
 	getLog("looking up key %s", key)
 	_, data, err := client.Lookup(key)
 	if err != nil {
-		log.Fatalf("lookup: %v", err)
+		return fmt.Errorf("lookup: %v", err)
 	}
 
 	br, err := parseRecord(data)
 	if err != nil {
-		log.Fatalf("parsing record from remote: %v", err)
+		return fmt.Errorf("parsing record from remote: %v", err)
 	}
 	getLog("filesize %.1fmb, sum %s", float64(br.Filesize)/(1024*1024), br.Sum)
 
 	rkey := br.String()
 	if rkey != key {
-		log.Fatalf("remote sent record for other key, got %s expected %s", rkey, key)
+		return fmt.Errorf("remote sent record for other key, got %s expected %s", rkey, key)
 	}
 
-	if *sum != "" {
-		if *sum != br.Sum {
-			log.Fatalf("remote has different sum %s, expected %s", br.Sum, *sum)
+	if sum != "" {
+		if sum != br.Sum {
+			return fmt.Errorf("remote has different sum %s, expected %s", br.Sum, sum)
 		}
 		getLog("sum matches")
 	}
 
-	if !*download {
-		return
+	if !download {
+		return nil
 	}
 
-	gobuildBaseURL := strings.TrimSuffix(clientOps.baseURL, "/tlog")
-
 	// Retrieve file to bindir with temp name, calculate checksum as we go.
-	if f, err := os.CreateTemp(*bindir, br.filename()+".gobuildget"); err != nil {
-		log.Fatalf("creating temp file for downloading: %v", err)
-	} else if err := fetch(f, gobuildBaseURL, br, *bindir); err != nil {
+	f, err := os.CreateTemp(bindir, br.filename()+".gobuildget")
+	if err != nil {
+		return fmt.Errorf("creating temp file for downloading: %v", err)
+	}
+	if err := fetch(f, gobuildBaseURL, br, bindir); err != nil {
+		f.Close()
 		if xerr := os.Remove(f.Name()); xerr != nil {
 			log.Printf("removing tempfile %s: %v", f.Name(), xerr)
 		}
-		log.Fatal(err)
+		return err
+	}
+	return nil
+}
+
+// Build the targets for bs as a batch at the gobuild instance, following progress
+// through its event stream. Successful builds are verified with the transparency
+// log and downloaded into a directory per target in bindir. Returns whether all
+// builds succeeded.
+func getBatch(client *sumdb.Client, gobuildBaseURL string, bs buildSpec, batchTargets []string, options, bindir string, download bool) bool {
+	breq := batchRequest{bs.Mod, bs.Version, bs.Dir, batchTargets, []string{bs.Goversion}}
+	reqbuf, err := json.Marshal(breq)
+	if err != nil {
+		log.Fatalf("marshal batch request: %v", err)
+	}
+	getLog("creating batch for %d targets", len(batchTargets))
+	req, err := http.NewRequest("POST", gobuildBaseURL+"/batch", bytes.NewReader(reqbuf))
+	if err != nil {
+		log.Fatalf("new request: %v", err)
+	}
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatalf("http request for batch: %v", err)
+	}
+	if resp.StatusCode != http.StatusCreated {
+		buf, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		log.Fatalf("creating batch: %s: %s", resp.Status, strings.TrimSpace(string(buf)))
+	}
+	var summary batchSummary
+	err = json.NewDecoder(resp.Body).Decode(&summary)
+	resp.Body.Close()
+	if err != nil {
+		log.Fatalf("parsing batch: %v", err)
+	}
+	getLog("batch %s created", summary.ID)
+
+	summary, err = followBatch(gobuildBaseURL, summary.ID)
+	if err != nil {
+		log.Fatalf("following batch: %v", err)
+	}
+
+	ok := true
+	for _, m := range summary.Members {
+		// The instance chooses the options, and the key is verified with the
+		// transparency log, but the build must be the one we asked for.
+		xbs := m.buildSpec
+		xbs.Goos = bs.Goos
+		xbs.Goarch = bs.Goarch
+		xbs.Variant = bs.Variant
+		xbs.Options = bs.Options
+		if xbs != bs {
+			log.Fatalf("batch has build for other module or goversion: %s", m.buildSpec)
+		}
+		if options == "none" && m.Options != "" || options != "none" && options != "" && m.Options != options {
+			log.Fatalf("batch build %s has other options, expected %q", m.buildSpec, options)
+		}
+
+		target := m.Goos + "/" + m.Goarch
+		if m.Variant != "" {
+			target += "/" + m.Variant
+		}
+		if m.Status != batchSuccess {
+			log.Printf("%s: build failed: %s", target, m.Error)
+			ok = false
+			continue
+		}
+		dir := filepath.Join(bindir, strings.ReplaceAll(target, "/", "-"))
+		if download {
+			if err := os.MkdirAll(dir, 0777); err != nil {
+				log.Fatalf("creating directory for binary: %v", err)
+			}
+		}
+		if err := retrieve(client, gobuildBaseURL, m.buildSpec, m.Sum, dir, download); err != nil {
+			log.Printf("%s: %v", target, err)
+			ok = false
+			continue
+		}
+		log.Printf("%s: %s", target, m.Sum)
+	}
+	return ok
+}
+
+// Read the event stream of a batch until it is done, logging progress. Returns
+// the summary from the final event.
+func followBatch(gobuildBaseURL, id string) (batchSummary, error) {
+	resp, err := httpGet(gobuildBaseURL + "/batch/" + id + "/events")
+	if err != nil {
+		return batchSummary{}, fmt.Errorf("http request: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return batchSummary{}, fmt.Errorf("http response: %s", resp.Status)
+	}
+
+	var event, data string
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if k, v, ok := strings.Cut(line, ": "); ok && k == "event" {
+			event = v
+			continue
+		} else if ok && k == "data" {
+			data = v
+			continue
+		} else if line != "" {
+			continue
+		}
+
+		switch event {
+		case "member":
+			var m batchMemberEvent
+			if err := json.Unmarshal([]byte(data), &m); err != nil {
+				return batchSummary{}, fmt.Errorf("parsing member event: %v", err)
+			}
+			switch {
+			case m.Status != batchPending:
+				getLog("%s: %s", m.buildSpec, m.Status)
+			case m.QueuePosition > 0:
+				getLog("%s: queue position %d", m.buildSpec, m.QueuePosition)
+			}
+		case "done":
+			var summary batchSummary
+			if err := json.Unmarshal([]byte(data), &summary); err != nil {
+				return batchSummary{}, fmt.Errorf("parsing summary: %v", err)
+			}
+			return summary, nil
+		}
+		event, data = "", ""
+	}
+	if err := scanner.Err(); err != nil {
+		return batchSummary{}, fmt.Errorf("reading events: %v", err)
+	}
+	return batchSummary{}, fmt.Errorf("event stream closed before batch was done")
+}
+
+// Parse specifier from command-line, with target and goversion from flags,
+// resolving "latest" versions.
+func getSpec(spec, target, goversion, goproxy string) buildSpec {
+	bs, err := parseGetSpec(spec)
+	if err != nil {
+		log.Fatalf("parsing module@version/package: %v", err)
+	}
+
+	// Set goos & goarch based on -target or runtime.
+	if target == "" {
+		bs.Goos = runtime.GOOS
+		bs.Goarch = runtime.GOARCH
+	} else {
+		t := strings.Split(target, "/")
+		if len(t) != 2 && len(t) != 3 {
+			log.Fatal("bad target")
+		}
+		bs.Goos = t[0]
+		bs.Goarch = t[1]
+		if len(t) == 3 {
+			bs.Variant = t[2]
+			if err := checkVariant(bs.Goarch, bs.Variant); err != nil {
+				log.Fatalf("bad target: %v", err)
+			}
+		}
+	}
+
+	// Resolve latest module version, or other queries like branches, at goproxy.
+	if !isCanonicalVersion(bs.Version) {
+		getLog("resolving module version %q through goproxy", bs.Version)
+		if modVer, err := resolveModuleQuery(context.Background(), goproxy, bs.Mod, bs.Version); err != nil {
+			log.Fatalf("resolving module version: %v", err)
+		} else {
+			log.Printf("module version %q is %s", bs.Version, modVer.Version)
+			bs.Version = modVer.Version
+		}
+	}
+
+	// Resolve latest version of go if needed.
+	if goversion == "latest" {
+		getLog("resolving latest goversion")
+		bs.Goversion, err = resolveLatestGoversion()
+		if err != nil {
+			log.Fatalf("resolving latest go version: %v", err)
+		}
+		getLog("latest goversion is %s", bs.Goversion)
+	} else if goversion == "module" {
+		// Needs the module version, resolved above.
+		getLog("resolving goversion from go.mod through goproxy")
+		v, err := fetchGoModVersions(context.Background(), goproxy, bs.Mod, bs.Version)
+		if err != nil {
+			log.Fatalf("resolving go version from go.mod: %v", err)
+		}
+		bs.Goversion = v.resolve()
+		getLog("goversion from go.mod is %s", bs.Goversion)
+	} else {
+		bs.Goversion = goversion
+	}
+	return bs
+}
+
+// Find the build for sum through the JSON lookup at the gobuild instance.
+func resolveSum(gobuildBaseURL, sum string) (buildSpec, error) {
+	link := gobuildBaseURL + "/s/" + sum + ".json"
+	getLog("looking up sum at %s", link)
+	resp, err := httpGet(link)
+	if err != nil {
+		return buildSpec{}, fmt.Errorf("http request: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return buildSpec{}, fmt.Errorf("http response: %s", resp.Status)
+	}
+	var l []sumResult
+	if err := json.NewDecoder(resp.Body).Decode(&l); err != nil {
+		return buildSpec{}, fmt.Errorf("parsing response: %v", err)
+	} else if len(l) == 0 {
+		return buildSpec{}, fmt.Errorf("no build found")
+	} else if l[0].Sum != sum {
+		return buildSpec{}, fmt.Errorf("remote returned build with other sum %s", l[0].Sum)
+	}
+	return l[0].buildSpec, nil
+}
+
+// Find the fingerprint of the build options of the module through the gobuild
+// instance, which redirects a build page to the URL with the options declared by
+// the module. The options are part of the key that is verified with the
+// transparency log.
+func discoverOptions(gobuildBaseURL string, bs buildSpec) (string, error) {
+	link := gobuildBaseURL + request{bs, "", pageIndex}.link()
+	getLog("discovering build options at %s", link)
+	req, err := http.NewRequest("GET", link, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("http request: %v", err)
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// Build page without redirect, so no options.
+		return "", nil
+	case http.StatusTemporaryRedirect:
+		u, err := resp.Location()
+		if err != nil {
+			return "", fmt.Errorf("parsing redirect: %v", err)
+		}
+		r, hint, ok := parseRequest(u.Path)
+		if !ok {
+			return "", fmt.Errorf("parsing redirect %s: %s", u.Path, hint)
+		}
+		return r.Options, nil
+	default:
+		return "", fmt.Errorf("http response: %s", resp.Status)
 	}
 }
 
@@ -3,11 +3,13 @@ package main
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"crypto/sha256"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -17,6 +19,7 @@ import (
 )
 
 var errTempFailure = errors.New("temporary failure")
+var errCompile = errors.New("compile failed")
 
 func ensureGobin(goversion string) (string, error) {
 	gobin := filepath.Join(config.SDKDir, goversion, "bin", "go"+goexe())
@@ -30,10 +33,25 @@ func ensureGobin(goversion string) (string, error) {
 }
 
 func prepareBuild(bs buildSpec) error {
+	cacheLock.RLock()
+	defer cacheLock.RUnlock()
+
+	if !isCanonicalVersion(bs.Version) {
+		return fmt.Errorf("%w: %q is not a canonical version", errBadVersion, bs.Version)
+	}
+
+	if err := checkVariantGoversion(bs); err != nil {
+		return err
+	}
+
 	if err := ensureSDK(bs.Goversion); err != nil {
 		return fmt.Errorf("ensuring toolchain %q: %w", bs.Goversion, err)
 	}
 
+	if err := checkTarget(bs); err != nil {
+		return err
+	}
+
 	gobin, err := ensureGobin(bs.Goversion)
 	if err != nil {
 		return err
@@ -44,30 +62,51 @@ func prepareBuild(bs buildSpec) error {
 		return fmt.Errorf("error fetching module from goproxy: %w\n\n# output from go get:\n%s", err, string(getOutput))
 	}
 
+	opts, err := checkOptions(bs, modDir)
+	if err != nil {
+		return err
+	}
+
+	if err := checkModuleGoversion(bs, modDir); err != nil {
+		return err
+	}
+
+	return checkPackage(bs, gobin, modDir, opts)
+}
+
+// Check that the package of bs, in the already fetched module at modDir, is a main
+// package without cgo dependencies. The "go list -deps" also downloads the
+// dependencies of the module, for Go1.18 and later "go mod download" doesn't, see
+// fetchModule. Used when preparing a build, and by workers before compiling.
+func checkPackage(bs buildSpec, gobin, modDir string, opts buildOptions) error {
 	pkgDir := filepath.Join(modDir, filepath.FromSlash(bs.Dir[1:]))
 
 	// Check if package is a main package, resulting in an executable when built.
 	goproxy := true
 	cgo := true
-	moreEnv := []string{
+	moreEnv := append([]string{
 		"GOOS=" + bs.Goos,
 		"GOARCH=" + bs.Goarch,
+	}, bs.variantEnv()...)
+	// Command line for "go list" with the build tags of the module.
+	listArgs := func(args ...string) []string {
+		return append(append([]string{gobin, "list"}, opts.tagsFlags()...), args...)
 	}
-	cmd := makeCommand(goproxy, pkgDir, cgo, moreEnv, gobin, "list", "-f", "{{.Name}}")
+	cmd := makeCommand(goproxy, pkgDir, cgo, moreEnv, listArgs("-f", "{{.Name}}")...)
 	stderr := &strings.Builder{}
 	cmd.Stderr = stderr
 	if nameOutput, err := cmd.Output(); err != nil {
-		return fmt.Errorf("error finding package name; perhaps package does not exist: %v\n\n# stdout from go list:\n%s\n\nstderr:\n%s", err, nameOutput, stderr.String())
+		return fmt.Errorf("error finding package name; perhaps package does not exist: %v\n\n# stdout from go list:\n%s\n\nstderr:\n%s", err, nameOutput, redactGoproxy(stderr.String()))
 	} else if string(nameOutput) != "main\n" {
 		return fmt.Errorf("package main %w, building would not result in executable binary (package %s)", errNotExist, strings.TrimRight(string(nameOutput), "\n"))
 	}
 
 	// Check that package does not depend on any cgo.
-	cmd = makeCommand(goproxy, pkgDir, cgo, moreEnv, gobin, "list", "-mod=mod", "-deps", "-f", `{{ if and (not .Standard) .CgoFiles }}{{ .ImportPath }}{{ end }}`)
+	cmd = makeCommand(goproxy, pkgDir, cgo, moreEnv, listArgs("-mod=mod", "-deps", "-f", `{{ if and (not .Standard) .CgoFiles }}{{ .ImportPath }}{{ end }}`)...)
 	stderr = &strings.Builder{}
 	cmd.Stderr = stderr
 	if cgoOutput, err := cmd.Output(); err != nil {
-		return fmt.Errorf("error determining whether cgo is required: %v\n\n# output from go list:\n%s\n\nstderr:\n%s", err, cgoOutput, stderr.String())
+		return fmt.Errorf("error determining whether cgo is required: %v\n\n# output from go list:\n%s\n\nstderr:\n%s", err, cgoOutput, redactGoproxy(stderr.String()))
 	} else if len(cgoOutput) != 0 {
 		return fmt.Errorf("build %w due to cgo dependencies:\n\n%s", errNotExist, cgoOutput)
 	}
@@ -77,77 +116,191 @@ func prepareBuild(bs buildSpec) error {
 // Build does the actual build. It is called from coordinate, ensuring the same
 // buildSpec isn't built multiple times concurrently, and preventing a few other
 // clashes. On success, a record has been added to the transparency log.
-func build(bs buildSpec) (int64, *buildResult, string, error) {
+// When ctx is canceled, or the configured timeouts expire, the go command is
+// stopped. Once the command has finished, the build is published regardless.
+func build(ctx context.Context, bs buildSpec) (int64, *buildResult, string, error) {
 	targets.increase(bs.Goos + "/" + bs.Goarch)
 
+	if config.BuildTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(config.BuildTimeout)*time.Second)
+		defer cancel()
+	}
+
 	gobin, err := ensureGobin(bs.Goversion)
 	if err != nil {
 		return -1, nil, "", fmt.Errorf("ensuring go version is available: %v (%w)", err, errTempFailure)
 	}
 
-	if _, output, err := ensureModule(bs.Goversion, gobin, bs.Mod, bs.Version); err != nil {
-		return -1, nil, "", fmt.Errorf("error fetching module from goproxy: %v (%w)\n\n# output from go get:\n%s", err, errTempFailure, output)
+	// Only while using the caches, not while publishing the result.
+	cacheLock.RLock()
+	cacheLocked := true
+	defer func() {
+		if cacheLocked {
+			cacheLock.RUnlock()
+		}
+	}()
+
+	modDir, getOutput, err := ensureModule(bs.Goversion, gobin, bs.Mod, bs.Version)
+	if err != nil {
+		return -1, nil, "", fmt.Errorf("error fetching module from goproxy: %v (%w)\n\n# output from go get:\n%s", err, errTempFailure, getOutput)
+	}
+
+	opts, err := checkOptions(bs, modDir)
+	if err != nil {
+		return -1, nil, "", err
+	}
+
+	// With a record in the transparency log, we are building to restore a binary
+	// removed by retention.
+	loggedNumber, logged, _, err := serverOps{}.lookupResult(ctx, bs)
+	if err != nil {
+		return -1, nil, "", fmt.Errorf("%w: looking up result: %v", errServer, err)
 	}
 
 	// Launch goroutines to let the verifiers build the same code and return their
 	// build result. After our build, we verify we all had the same result. If our
 	// build fails, we just ignore these results, and let the remote builds continue.
 	// They will not cancel the build anyway.
+	var verifyResult chan remoteBuild
+	if logged == nil {
+		verifyResult = startVerify(bs)
+	}
 
-	type remoteBuild struct {
-		verifyURL string
-		err       error
-		result    *buildResult
+	t0 := time.Now()
+	resultPath, output, cleanup, err := compileDispatch(ctx, bs, gobin, opts)
+	defer cleanup()
+	cacheLock.RUnlock()
+	cacheLocked = false
+	metricCompileDuration.WithLabelValues(bs.Goos, bs.Goarch, bs.Goversion).Observe(time.Since(t0).Seconds())
+	if reason, ok := buildAbortReason(err); ok {
+		// Not a compile error, don't store as failed build. A later request can try again.
+		metricCompileAborts.WithLabelValues(reason).Inc()
+		log.Printf("build %s stopped: %v", bs, err)
+		return -1, nil, string(output), fmt.Errorf("%v (%w)", err, errTempFailure)
+	} else if errors.Is(err, errCompile) {
+		metricCompileErrors.WithLabelValues(bs.Goos, bs.Goarch, bs.Goversion).Inc()
+		out := string(output)
+		if xerr := saveFailure(bs, err.Error()+"\n\n"+out); xerr != nil {
+			return -1, nil, "", fmt.Errorf("storing results of failure: %v (%w)", xerr, errTempFailure)
+		}
+		return -1, nil, out, err
+	} else if err != nil {
+		return -1, nil, "", err
 	}
 
-	verifyResult := make(chan remoteBuild, len(config.VerifierURLs))
-	verifyLink := request{bs, "", pageRecord}.link()
+	// Where we store the "recordnumber" file, binary.gz and log.gz.
+	tmpdir, err := os.MkdirTemp(stagingDir(), "tmpresult")
+	if err != nil {
+		return -1, nil, "", err
+	}
+	// On success, the directory will have been moved to its final destination,
+	// indicated by an empty tmpdir.
+	defer func() {
+		if tmpdir != "" {
+			os.RemoveAll(tmpdir)
+		}
+	}()
 
-	verify := func(verifierBaseURL string) (*buildResult, error) {
-		t0 := time.Now()
-		defer func() {
-			metricVerifyDuration.WithLabelValues(verifierBaseURL, bs.Goos, bs.Goarch, bs.Goversion).Observe(time.Since(t0).Seconds())
-		}()
+	br := buildResult{buildSpec: bs}
 
-		verifyURL := verifierBaseURL + verifyLink
-		resp, err := httpGet(verifyURL)
-		if err != nil {
-			return nil, fmt.Errorf("%w: http request: %v", errServer, err)
+	// Calculate our hash.
+	rf, err := os.Open(resultPath)
+	if err != nil {
+		return -1, nil, "", fmt.Errorf("open result: %v", err)
+	}
+	defer rf.Close()
+
+	if info, err := rf.Stat(); err != nil {
+		return -1, nil, "", fmt.Errorf("stat result: %v", err)
+	} else {
+		br.Filesize = info.Size()
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, rf); err != nil {
+		return -1, nil, "", fmt.Errorf("read result: %v", err)
+	} else if _, err := rf.Seek(0, 0); err != nil {
+		return -1, nil, "", fmt.Errorf("seek result: %v", err)
+	}
+	br.Sum = "0" + base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:20])
+
+	if logged != nil {
+		if err := restoreBinary(*logged, br, rf, tmpdir); err != nil {
+			return -1, nil, "", fmt.Errorf("restoring binary: %w", err)
 		}
-		defer resp.Body.Close()
-		if resp.StatusCode != 200 {
-			metricVerifyErrors.WithLabelValues(verifierBaseURL, bs.Goos, bs.Goarch, bs.Goversion).Inc()
-			buf, err := io.ReadAll(resp.Body)
-			msg := string(buf)
-			if err != nil {
-				msg = fmt.Sprintf("reading error message: %v", err)
+		return loggedNumber, logged, "", nil
+	}
+
+	// Verify the sums of the verifiers. In async mode, we publish now and store the
+	// results of the verifiers when they are done.
+	if len(verifierConfigs) > 0 {
+		var v verification
+		if config.VerifyAsync {
+			v = verification{Quorum: verifyQuorum(), Async: true}
+			for _, vc := range verifierConfigs {
+				v.Results = append(v.Results, verifierResult{URL: vc.URL, Status: verifyPending})
 			}
-			return nil, fmt.Errorf("%w: http error response: %s:\n%s", errRemote, resp.Status, msg)
+		} else {
+			v = collectVerify(verifyResult, br.Sum)
+			if err := v.check(br.Sum); err != nil {
+				// Keep the binaries for diagnosing the differences.
+				if remotes := v.disagreeing(); len(remotes) > 0 {
+					quarantine("verify", br, rf, remotes)
+				}
+				return -1, nil, "", err
+			}
+		}
+		if err := writeVerification(tmpdir, v); err != nil {
+			return -1, nil, "", fmt.Errorf("writing verification results: %v", err)
 		}
+	}
 
-		if msg, err := io.ReadAll(resp.Body); err != nil {
-			return nil, fmt.Errorf("reading build result from remote: %v", err)
-		} else if br, err := parseRecord(msg); err != nil {
-			return nil, fmt.Errorf("parsing build record from remote: %v", err)
-		} else {
-			return br, nil
+	// Write binary and log, and the options the binary was built with.
+	if err := writeGz(filepath.Join(tmpdir, "binary.gz"), rf); err != nil {
+		return -1, nil, "", err
+	}
+	if err := writeGz(filepath.Join(tmpdir, "log.gz"), bytes.NewReader(output)); err != nil {
+		return -1, nil, "", err
+	}
+	if !opts.Empty() {
+		if err := os.WriteFile(filepath.Join(tmpdir, "options.txt"), []byte(opts.String()), 0666); err != nil {
+			return -1, nil, "", err
 		}
 	}
 
-	for _, verifierBaseURL := range config.VerifierURLs {
-		go func(verifierBaseURL string) {
-			result, err := verify(verifierBaseURL)
-			if err != nil {
-				err = fmt.Errorf("verifying with %s: %w", verifierBaseURL, err)
-			}
-			verifyResult <- remoteBuild{verifierBaseURL, err, result}
-		}(verifierBaseURL)
+	// Finally, add to the transparency log, creating the "recordnumber" file and
+	// renaming tmpdir to the final directory in resultDir.
+	recordNumber, err := addSum(tmpdir, br)
+	if err != nil {
+		return -1, nil, "", fmt.Errorf("adding sum to tranparency log: %w", err)
 	}
+	tmpdir = ""
 
-	t0 := time.Now()
+	if config.VerifyAsync && len(verifierConfigs) > 0 {
+		go finishVerifyAsync(br, verifyResult)
+	}
+
+	recentBuilds.Lock()
+	recentBuilds.links = append(recentBuilds.links, request{bs, br.Sum, pageIndex}.link())
+	if len(recentBuilds.links) > 10 {
+		recentBuilds.links = recentBuilds.links[len(recentBuilds.links)-10:]
+	}
+	recentBuilds.Unlock()
+
+	return recordNumber, &br, "", nil
+}
+
+// Compile bs with gobin, writing the binary to resultPath, with the module
+// already fetched. The returned cleanup function must always be called when
+// done with the binary. If the go command fails, the error wraps errCompile,
+// or an error for a stopped build, and output holds its output. Used for local
+// builds, and by workers.
+func compile(ctx context.Context, bs buildSpec, gobin string, opts buildOptions) (resultPath string, output []byte, cleanup func(), err error) {
+	cleanup = func() {}
 
 	if err := ensurePrimedBuildCache(gobin, bs.Goos, bs.Goarch, bs.Goversion); err != nil {
-		return -1, nil, "", fmt.Errorf("%w: ensuring primed go build cache: %v", errServer, err)
+		return "", nil, cleanup, fmt.Errorf("%w: ensuring primed go build cache: %v", errServer, err)
 	}
 
 	// What to "go get".
@@ -161,7 +314,6 @@ func build(bs buildSpec) (int64, *buildResult, string, error) {
 	// module version information in the binary. That isn't possible with "go build".
 	// But only "go build" has an "-o" flag to specify the output. And "go get" won't
 	// build with $GOBIN set.
-	var resultPath string
 	if bs.Dir != "/" {
 		resultPath = filepath.Join(resultPath, filepath.Base(bs.Dir[1:]))
 	} else {
@@ -175,10 +327,10 @@ func build(bs buildSpec) (int64, *buildResult, string, error) {
 		resultPath = filepath.Join(bs.Goos+"_"+bs.Goarch, resultPath)
 	}
 
-	moreEnv := []string{
+	moreEnv := append([]string{
 		"GOOS=" + bs.Goos,
 		"GOARCH=" + bs.Goarch,
-	}
+	}, bs.variantEnv()...)
 
 	var gobuildbindir string
 	if config.BuildGobin {
@@ -188,11 +340,13 @@ func build(bs buildSpec) (int64, *buildResult, string, error) {
 		// builds.
 		gobuildbindir, err = os.MkdirTemp("", "gobuildbindir")
 		if err != nil {
-			return -1, nil, "", fmt.Errorf("making temp dir: %v", err)
+			return "", nil, cleanup, fmt.Errorf("making temp dir: %v", err)
 		}
 		moreEnv = append(moreEnv, "GOBUILD_GOBIN="+gobuildbindir)
 		resultPath = filepath.Join(gobuildbindir, resultPath)
-		defer os.RemoveAll(gobuildbindir)
+		cleanup = func() {
+			os.RemoveAll(gobuildbindir)
+		}
 	} else {
 		resultPath = filepath.Join(homedir, "go", "bin", resultPath)
 	}
@@ -201,11 +355,16 @@ func build(bs buildSpec) (int64, *buildResult, string, error) {
 	// This might be a leftover from some earlier build attempt.
 	err = os.Remove(resultPath)
 	if err != nil && !os.IsNotExist(err) {
-		return -1, nil, "", fmt.Errorf("attempting to remove preexisting binary: %v (%w)", err, errTempFailure)
+		cleanup()
+		return "", nil, func() {}, fmt.Errorf("attempting to remove preexisting binary: %v (%w)", err, errTempFailure)
 	}
 
-	// Always remove binary from $GOBIN when we're done here. We copied it on success.
-	defer os.Remove(resultPath)
+	// Always remove binary from $GOBIN when the caller is done with it.
+	removeDir := cleanup
+	cleanup = func() {
+		os.Remove(resultPath)
+		removeDir()
+	}
 
 	// We strip out the buildid. The first of the 4 slash-separated parts will vary
 	// with different setups (toolchains on different systems and/or their installation
@@ -217,109 +376,48 @@ func build(bs buildSpec) (int64, *buildResult, string, error) {
 
 	goproxy := false
 	cgo := false
+	args := append([]string{"-x", "-v", "-trimpath"}, opts.tagsFlags()...)
+	args = append(args, "-ldflags="+opts.ldflags(), "--", name)
 	var cmd *exec.Cmd
 	gv, err := parseGoVersion(bs.Goversion)
 	if err != nil {
-		return -1, nil, "", fmt.Errorf("%w: %s", errBadGoversion, err)
-	}
-	if gv.major == 1 && gv.minor >= 18 {
-		// Since Go1.18 we need to use "go install" to compile external programs.
-		cmd = makeCommand(goproxy, emptyDir, cgo, moreEnv, gobin, "install", "-x", "-v", "-trimpath", "-ldflags=-buildid=", "--", name)
-	} else {
-		cmd = makeCommand(goproxy, emptyDir, cgo, moreEnv, gobin, "get", "-x", "-v", "-trimpath", "-ldflags=-buildid=", "--", name)
+		return resultPath, nil, cleanup, fmt.Errorf("%w: %s", errBadGoversion, err)
 	}
-	output, err := cmd.CombinedOutput()
-	metricCompileDuration.WithLabelValues(bs.Goos, bs.Goarch, bs.Goversion).Observe(time.Since(t0).Seconds())
-	if err != nil {
-		metricCompileErrors.WithLabelValues(bs.Goos, bs.Goarch, bs.Goversion).Inc()
-		out := string(output)
-		if xerr := saveFailure(bs, err.Error()+"\n\n"+out); xerr != nil {
-			return -1, nil, "", fmt.Errorf("storing results of failure: %v (%w)", xerr, errTempFailure)
+	if gv.major == 1 && gv.minor >= 15 {
+		// Build with a module cache of our own, extracting modules from the verified
+		// downloads in the shared module cache. Before go1.15, GOMODCACHE wasn't
+		// available and we build with the shared module cache.
+		modcache, err := newBuildModcache()
+		if err != nil {
+			return resultPath, nil, cleanup, fmt.Errorf("%w: making module cache path: %v", errServer, err)
 		}
-		return -1, nil, out, err
-	}
-
-	// Where we store the "recordnumber" file, binary.gz and log.gz.
-	tmpdir, err := os.MkdirTemp(resultDir, "tmpresult")
-	if err != nil {
-		return -1, nil, "", err
-	}
-	// On success, the directory will have been moved to its final destination,
-	// indicated by an empty tmpdir.
-	defer func() {
-		if tmpdir != "" {
-			os.RemoveAll(tmpdir)
+		moreEnv = append(moreEnv, buildModcacheEnv(modcache)...)
+		removeBinary := cleanup
+		cleanup = func() {
+			if err := os.RemoveAll(modcache); err != nil {
+				log.Printf("removing module cache of build: %v", err)
+			}
+			removeBinary()
 		}
-	}()
-
-	br := buildResult{buildSpec: bs}
-
-	// Calculate our hash.
-	rf, err := os.Open(resultPath)
-	if err != nil {
-		return -1, nil, "", fmt.Errorf("open result: %v", err)
 	}
-	defer rf.Close()
-
-	if info, err := rf.Stat(); err != nil {
-		return -1, nil, "", fmt.Errorf("stat result: %v", err)
+	if gv.major == 1 && gv.minor >= 18 {
+		// Since Go1.18 we need to use "go install" to compile external programs.
+		cmd = makeCommand(goproxy, emptyDir, cgo, moreEnv, append([]string{gobin, "install"}, args...)...)
 	} else {
-		br.Filesize = info.Size()
-	}
-
-	h := sha256.New()
-	if _, err := io.Copy(h, rf); err != nil {
-		return -1, nil, "", fmt.Errorf("read result: %v", err)
-	} else if _, err := rf.Seek(0, 0); err != nil {
-		return -1, nil, "", fmt.Errorf("seek result: %v", err)
-	}
-	br.Sum = "0" + base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:20])
-
-	// Verify the sums of the verifiers.
-	matchesFrom := []string{}
-	mismatches := []string{}
-	for n := len(config.VerifierURLs); n > 0; n-- {
-		vr := <-verifyResult
-		if vr.err != nil {
-			return -1, nil, "", fmt.Errorf("build at verifier failed: %v (%w)", vr.err, errTempFailure)
-		}
-		if vr.result.Sum == br.Sum {
-			matchesFrom = append(matchesFrom, vr.verifyURL)
-		} else {
-			mismatches = append(mismatches, fmt.Sprintf("%s got %s", vr.verifyURL, vr.result.Sum))
-		}
-	}
-	if len(mismatches) > 0 {
-		return -1, nil, "", fmt.Errorf("build mismatches, we and %d others got %s, but %s (%w)", len(matchesFrom), br.Sum, strings.Join(mismatches, ", "), errTempFailure)
-	}
-
-	// Write binary and log.
-	if err := writeGz(filepath.Join(tmpdir, "binary.gz"), rf); err != nil {
-		return -1, nil, "", err
-	}
-	if err := writeGz(filepath.Join(tmpdir, "log.gz"), bytes.NewReader(output)); err != nil {
-		return -1, nil, "", err
-	}
-
-	// Finally, add to the transparency log, creating the "recordnumber" file and
-	// renaming tmpdir to the final directory in resultDir.
-	recordNumber, err := addSum(tmpdir, br)
-	if err != nil {
-		return -1, nil, "", fmt.Errorf("adding sum to tranparency log: %w", err)
+		cmd = makeCommand(goproxy, emptyDir, cgo, moreEnv, append([]string{gobin, "get"}, args...)...)
 	}
-	tmpdir = ""
-
-	recentBuilds.Lock()
-	recentBuilds.links = append(recentBuilds.links, request{bs, br.Sum, pageIndex}.link())
-	if len(recentBuilds.links) > 10 {
-		recentBuilds.links = recentBuilds.links[len(recentBuilds.links)-10:]
+	output, err = runCommand(ctx, cmd, time.Duration(config.BuildIdleTimeout)*time.Second)
+	if _, ok := buildAbortReason(err); err != nil && !ok {
+		err = fmt.Errorf("%w: %v", errCompile, err)
 	}
-	recentBuilds.Unlock()
-
-	return recordNumber, &br, "", nil
+	return resultPath, output, cleanup, err
 }
 
 func saveFailure(bs buildSpec, output string) error {
+	if privsepFrontend {
+		return privsepSaveFailure(bs, output)
+	}
+
 	tmpdir, err := os.MkdirTemp(resultDir, "tmpfail")
 	if err != nil {
 		return err
@@ -329,6 +427,11 @@ func saveFailure(bs buildSpec, output string) error {
 			os.RemoveAll(tmpdir)
 		}
 	}()
+	// With privilege separation, the frontend runs as another user and must be able
+	// to read the log.
+	if err := os.Chmod(tmpdir, 0755); err != nil {
+		return err
+	}
 
 	if err := writeGz(filepath.Join(tmpdir, "log.gz"), strings.NewReader(output)); err != nil {
 		return err
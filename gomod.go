@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+// Go version requirements from the go.mod of a module.
+type goModVersions struct {
+	Go        string // From "go" directive, e.g. "1.21.0" or "1.16". Empty if absent.
+	Toolchain string // From "toolchain" directive, e.g. "go1.21.5". Empty if absent.
+}
+
+func parseGoModVersions(data []byte) goModVersions {
+	var v goModVersions
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		t := strings.Fields(line)
+		if len(t) != 2 {
+			continue
+		}
+		switch t[0] {
+		case "go":
+			v.Go = t[1]
+		case "toolchain":
+			v.Toolchain = t[1]
+		}
+	}
+	return v
+}
+
+// Read the go and toolchain directives from go.mod in modDir.
+func readGoModVersions(modDir string) (goModVersions, error) {
+	buf, err := os.ReadFile(filepath.Join(modDir, "go.mod"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return goModVersions{}, nil
+		}
+		return goModVersions{}, fmt.Errorf("%w: reading go.mod: %v", errServer, err)
+	}
+	return parseGoModVersions(buf), nil
+}
+
+// Fetch the go.mod of mod@version from the goproxy and read its go and
+// toolchain directives.
+func fetchGoModVersions(ctx context.Context, goproxy, mod, version string) (goModVersions, error) {
+	modPath, err := module.EscapePath(mod)
+	if err != nil {
+		return goModVersions{}, fmt.Errorf("%w: %v", errBadModule, err)
+	}
+	modVersion, err := module.EscapeVersion(version)
+	if err != nil {
+		return goModVersions{}, fmt.Errorf("%w: %v", errBadVersion, err)
+	}
+	u := fmt.Sprintf("%s%s/@v/%s.mod", goproxy, modPath, modVersion)
+	resp, err := httpGetContext(ctx, u)
+	if err != nil {
+		return goModVersions{}, fmt.Errorf("%w: http request to goproxy: %v", errServer, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return goModVersions{}, fmt.Errorf("%w: error response from goproxy for go.mod: %s", errRemote, resp.Status)
+	}
+	buf, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return goModVersions{}, fmt.Errorf("%w: reading go.mod from goproxy: %v", errRemote, err)
+	}
+	return parseGoModVersions(buf), nil
+}
+
+// Name of the Go release for gv. Since go1.21, the first release of a minor
+// version has patch version 0 in its name.
+func releaseName(gv goVersion) string {
+	if gv.minor >= 21 && gv.patch == 0 && gv.more == "" {
+		return fmt.Sprintf("go%d.%d.0", gv.major, gv.minor)
+	}
+	return gv.String()
+}
+
+// Minimum Go release satisfying the go directive. Versions before go1.13 are
+// raised to go1.13, we don't build with older toolchains.
+func (v goModVersions) minimum() goVersion {
+	if gv, err := parseGoVersion("go" + v.Go); err == nil {
+		return gv
+	}
+	return goVersion{major: 1, minor: 13}
+}
+
+// Whether the go directive is a requirement that older toolchains refuse to
+// build with. Since go1.21 it is, before it only indicated the language version.
+func (v goModVersions) strict() bool {
+	return v.minimum().minor >= 21
+}
+
+// Resolve the "module" goversion alias: the toolchain directive if present and
+// not older than the go directive, otherwise the minimum release satisfying the go
+// directive.
+func (v goModVersions) resolve() string {
+	min := v.minimum()
+	if gv, err := parseGoVersion(v.Toolchain); err == nil && gv.num() >= min.num() {
+		return releaseName(gv)
+	}
+	return releaseName(min)
+}
+
+// Check the goversion of bs is not too old for the module in modDir. Returns an
+// error wrapping errBadGoversion if the toolchain would refuse to build the
+// module.
+func checkModuleGoversion(bs buildSpec, modDir string) error {
+	v, err := readGoModVersions(modDir)
+	if err != nil {
+		return err
+	}
+	gv, err := parseGoVersion(bs.Goversion)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errBadGoversion, err)
+	}
+	if min := v.minimum(); v.strict() && gv.num() < min.num() {
+		return fmt.Errorf("%w: module requires %s or newer through go directive in go.mod", errBadGoversion, releaseName(min))
+	}
+	return nil
+}
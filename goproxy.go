@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Upstream module proxies. GoProxy, and GoProxy of GoProxyRoutes, are lists like
+// GOPROXY for the go command: URLs separated by "," (try the next proxy on a 404
+// or 410 response) or "|" (try the next proxy on any error). With a list, routes
+// or Netrc, go commands and gobuild itself use the local module proxy (see
+// goproxycache.go), which implements the fallback, routing and credentials.
+var goproxies struct {
+	def    proxyList
+	routes []proxyRoute
+	netrc  map[string]netrcEntry // By host.
+}
+
+type proxyList []proxyEntry
+
+type proxyEntry struct {
+	url         string // With trailing slash.
+	fallbackAny bool   // Separated from the next proxy by "|".
+}
+
+type proxyRoute struct {
+	prefix  string
+	proxies proxyList
+}
+
+type netrcEntry struct {
+	login, password string
+}
+
+// Parse and check the upstream module proxy configuration, and start the local
+// module proxy if needed.
+func initGoproxy() {
+	var err error
+	goproxies.def, err = parseProxyList(config.GoProxy)
+	if err != nil {
+		log.Fatalf("parsing GoProxy: %v", err)
+	}
+	for _, r := range config.GoProxyRoutes {
+		l, err := parseProxyList(r.GoProxy)
+		if err != nil {
+			log.Fatalf("parsing GoProxy for prefix %q: %v", r.Prefix, err)
+		}
+		goproxies.routes = append(goproxies.routes, proxyRoute{strings.TrimSuffix(r.Prefix, "/"), l})
+	}
+	if config.Netrc != "" {
+		goproxies.netrc, err = readNetrc(config.Netrc)
+		if err != nil {
+			log.Fatalf("reading netrc: %v", err)
+		}
+	}
+
+	if config.GoProxyCache != nil || len(goproxies.def) > 1 || len(goproxies.routes) > 0 || goproxies.netrc != nil {
+		startLocalGoproxy()
+	}
+}
+
+func parseProxyList(s string) (proxyList, error) {
+	var l proxyList
+	for s != "" {
+		i := strings.IndexAny(s, ",|")
+		e := proxyEntry{url: s}
+		if i >= 0 {
+			e = proxyEntry{s[:i], s[i] == '|'}
+			s = s[i+1:]
+		} else {
+			s = ""
+		}
+		if e.url == "direct" || e.url == "off" {
+			return nil, fmt.Errorf("%q not supported, modules are only fetched through module proxies", e.url)
+		}
+		u, err := url.Parse(e.url)
+		if err != nil {
+			return nil, err
+		} else if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return nil, fmt.Errorf("module proxy %q must be an http or https URL", e.url)
+		}
+		if !strings.HasSuffix(e.url, "/") {
+			e.url += "/"
+		}
+		l = append(l, e)
+	}
+	if len(l) == 0 {
+		return nil, fmt.Errorf("no module proxy")
+	}
+	return l, nil
+}
+
+// Read machine, login and password from a netrc file.
+func readNetrc(p string) (map[string]netrcEntry, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	m := map[string]netrcEntry{}
+	var machine string
+	var e netrcEntry
+	flush := func() {
+		if machine != "" {
+			m[machine] = e
+		}
+		machine, e = "", netrcEntry{}
+	}
+	s := bufio.NewScanner(f)
+	s.Split(bufio.ScanWords)
+	for s.Scan() {
+		switch s.Text() {
+		case "machine":
+			flush()
+			if s.Scan() {
+				machine = s.Text()
+			}
+		case "default":
+			// Credentials for any host would be sent to public proxies too.
+			flush()
+		case "login":
+			if s.Scan() {
+				e.login = s.Text()
+			}
+		case "password":
+			if s.Scan() {
+				e.password = s.Text()
+			}
+		}
+	}
+	flush()
+	return m, s.Err()
+}
+
+// Module proxies for module path mod: of the longest matching prefix of
+// GoProxyRoutes, or GoProxy. Without mod, e.g. for the checksum database, GoProxy.
+func proxiesFor(mod string) proxyList {
+	var best *proxyRoute
+	for i, r := range goproxies.routes {
+		if (mod == r.prefix || strings.HasPrefix(mod, r.prefix+"/")) && (best == nil || len(r.prefix) > len(best.prefix)) {
+			best = &goproxies.routes[i]
+		}
+	}
+	if best != nil {
+		return best.proxies
+	}
+	return goproxies.def
+}
+
+// Fetch path p (e.g. "golang.org/x/mod/@v/list") from the upstream module
+// proxies for mod, with fallback like the go command. The response of the last
+// proxy tried is returned.
+func goproxyGet(ctx context.Context, mod, p string) (*http.Response, error) {
+	l := proxiesFor(mod)
+	for i, e := range l {
+		last := i == len(l)-1
+		req, err := http.NewRequestWithContext(ctx, "GET", e.url+p, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("User-Agent", userAgent)
+		if c, ok := goproxies.netrc[req.URL.Hostname()]; ok && req.URL.User == nil {
+			req.SetBasicAuth(c.login, c.password)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			if last || !e.fallbackAny {
+				return nil, err
+			}
+			log.Printf("module proxy %s: %v, trying next", e.url, err)
+			continue
+		}
+		notFound := resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone
+		if last || resp.StatusCode == http.StatusOK || !notFound && !e.fallbackAny {
+			return resp, nil
+		}
+		resp.Body.Close()
+	}
+	return nil, fmt.Errorf("no module proxies")
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseProxyList(t *testing.T) {
+	l, err := parseProxyList("https://a.example|https://b.example/,http://c.example/x")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	exp := proxyList{{"https://a.example/", true}, {"https://b.example/", false}, {"http://c.example/x/", false}}
+	if !reflect.DeepEqual(l, exp) {
+		t.Fatalf("got %v, expected %v", l, exp)
+	}
+
+	for _, s := range []string{"", "direct", "https://a.example,direct", "off", "ftp://a.example", "a.example", "https://a.example,,https://b.example"} {
+		if _, err := parseProxyList(s); err == nil {
+			t.Fatalf("parse %q succeeded, expected error", s)
+		}
+	}
+}
+
+func TestReadNetrc(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "netrc")
+	data := "machine a.example login alice password secret1\n\nmachine b.example\n\tlogin bob\n\tpassword secret2\ndefault login x password y\n"
+	if err := os.WriteFile(p, []byte(data), 0600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	m, err := readNetrc(p)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	exp := map[string]netrcEntry{"a.example": {"alice", "secret1"}, "b.example": {"bob", "secret2"}}
+	if !reflect.DeepEqual(m, exp) {
+		t.Fatalf("got %v, expected %v", m, exp)
+	}
+}
+
+func TestProxiesFor(t *testing.T) {
+	orig := goproxies
+	defer func() {
+		goproxies = orig
+	}()
+
+	def := proxyList{{"https://proxy.example/", false}}
+	corp := proxyList{{"https://corp.example/", false}}
+	team := proxyList{{"https://team.example/", false}}
+	goproxies.def = def
+	goproxies.routes = []proxyRoute{{"git.example/corp", corp}, {"git.example/corp/team", team}}
+	for mod, exp := range map[string]proxyList{
+		"golang.org/x/mod":            def,
+		"git.example/corp":            corp,
+		"git.example/corp/tool":       corp,
+		"git.example/corporate":       def,
+		"git.example/corp/team":       team,
+		"git.example/corp/team/tool":  team,
+		"git.example/corp/teammate/x": corp,
+		"":                            def,
+	} {
+		if l := proxiesFor(mod); !reflect.DeepEqual(l, exp) {
+			t.Fatalf("proxies for %q: got %v, expected %v", mod, l, exp)
+		}
+	}
+}
+
+func TestGoproxyGet(t *testing.T) {
+	orig := goproxies
+	defer func() {
+		goproxies = orig
+	}()
+
+	server := func(name string, status int) *httptest.Server {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+			user, pass, _ := r.BasicAuth()
+			io.WriteString(w, name+" "+user+":"+pass)
+		}))
+		t.Cleanup(s.Close)
+		return s
+	}
+	notFound := server("notfound", http.StatusNotFound)
+	gone := server("gone", http.StatusGone)
+	broken := server("broken", http.StatusInternalServerError)
+	ok := server("ok", http.StatusOK)
+
+	get := func(list string) (int, string) {
+		t.Helper()
+		l, err := parseProxyList(list)
+		if err != nil {
+			t.Fatalf("parse: %v", err)
+		}
+		goproxies.def = l
+		resp, err := goproxyGet(context.Background(), "example.com/mod", "example.com/mod/@v/list")
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		defer resp.Body.Close()
+		buf, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(buf)
+	}
+	check := func(list string, expStatus int, expBody string) {
+		t.Helper()
+		if status, body := get(list); status != expStatus || body != expBody {
+			t.Fatalf("%s: got %d %q, expected %d %q", list, status, body, expStatus, expBody)
+		}
+	}
+
+	// With ",", only not found falls back.
+	check(notFound.URL+","+gone.URL+","+ok.URL, http.StatusOK, "ok :")
+	check(broken.URL+","+ok.URL, http.StatusInternalServerError, "broken :")
+	// With "|", any error falls back.
+	check(broken.URL+"|"+ok.URL, http.StatusOK, "ok :")
+	// The response of the last proxy is returned.
+	check(ok.URL+","+notFound.URL, http.StatusOK, "ok :")
+	check(gone.URL+","+notFound.URL, http.StatusNotFound, "notfound :")
+
+	// Unreachable proxy only falls back with "|".
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	goproxies.def, _ = parseProxyList(dead.URL + "," + ok.URL)
+	if _, err := goproxyGet(context.Background(), "example.com/mod", "example.com/mod/@v/list"); err == nil {
+		t.Fatalf("get with unreachable proxy and \",\" succeeded")
+	}
+	check(dead.URL+"|"+ok.URL, http.StatusOK, "ok :")
+
+	// Credentials from netrc, by host.
+	goproxies.netrc = map[string]netrcEntry{"127.0.0.1": {"user", "pass"}}
+	check(ok.URL, http.StatusOK, "ok user:pass")
+}
+
+func TestRedactGoproxy(t *testing.T) {
+	defer func() {
+		localGoproxySecret = ""
+	}()
+	s := "reading http://127.0.0.1:1234/0123abcd/example.com/@v/list: 404 Not Found"
+	if got := redactGoproxy(s); got != s {
+		t.Fatalf("without local module proxy, got %q, expected %q", got, s)
+	}
+	localGoproxySecret = "0123abcd"
+	exp := "reading http://127.0.0.1:1234/redacted/example.com/@v/list: 404 Not Found"
+	if got := redactGoproxy(s); got != exp {
+		t.Fatalf("got %q, expected %q", got, exp)
+	}
+}
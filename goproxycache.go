@@ -0,0 +1,290 @@
+package main
+
+import (
+	cryptorand "crypto/rand"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/module"
+)
+
+// Gobuild can run a module proxy on a loopback address, in front of the upstream
+// module proxies. Go commands and gobuild itself make their module proxy requests
+// to it. It routes requests to the upstream module proxies, see goproxy.go. With
+// config GoProxyCache, it caches responses: Responses for module versions (.info,
+// .mod and .zip) don't change and are stored permanently in DataDir/goproxy.
+// Version lists, latest versions and queries like branch names are stored there
+// too, but fetched again after TTL. Requests for the checksum database are passed
+// through.
+
+// Set when the local module proxy is started. The path starts with a random
+// secret, other local users cannot make requests, e.g. for private modules
+// fetched with our credentials.
+var localGoproxyURL string
+
+// Secret path prefix of localGoproxyURL, removed from logs and go command output.
+var localGoproxySecret string
+
+// Default for GoProxyCache TTL.
+const goproxyCacheTTL = 5 * time.Minute
+
+// URL of the module proxy for go commands and our own requests, with trailing
+// slash.
+func goproxyURL() string {
+	if localGoproxyURL != "" {
+		return localGoproxyURL
+	}
+	return config.GoProxy
+}
+
+// Replace the secret of the local module proxy in s, e.g. the environment of a go
+// command for logging, or the output of a go command that is logged, stored or
+// returned to HTTP clients.
+func redactGoproxy(s string) string {
+	if localGoproxySecret == "" {
+		return s
+	}
+	return strings.ReplaceAll(s, localGoproxySecret, "redacted")
+}
+
+func startLocalGoproxy() {
+	buf := make([]byte, 16)
+	if _, err := cryptorand.Read(buf); err != nil {
+		log.Fatalf("random secret for local module proxy: %v", err)
+	}
+	c := goproxyCache{secret: fmt.Sprintf("%x", buf)}
+	if config.GoProxyCache != nil {
+		c.dir = filepath.Join(config.DataDir, "goproxy")
+		os.MkdirAll(c.dir, 0777) // errors will be caught later
+		// Module paths cannot start with a dot, so temporary files don't clash.
+		removeLeftovers(c.dir, ".tmp*")
+		c.ttl = goproxyCacheTTL
+		if config.GoProxyCache.TTL > 0 {
+			c.ttl = time.Duration(config.GoProxyCache.TTL) * time.Second
+		}
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatalf("listen for local module proxy: %v", err)
+	}
+	localGoproxyURL = fmt.Sprintf("http://%s/%s/", ln.Addr(), c.secret)
+	localGoproxySecret = c.secret
+	log.Printf("local module proxy for %s at http://%s/, caching %v", config.GoProxy, ln.Addr(), c.dir != "")
+	srv := &http.Server{Handler: c}
+	go func() {
+		log.Fatalf("serving local module proxy: %v", srv.Serve(ln))
+	}()
+}
+
+type goproxyCache struct {
+	secret string // First path element of all requests.
+	dir    string // Empty if not caching.
+	ttl    time.Duration
+}
+
+// Fetches from the upstream module proxy in progress, by path. Concurrent
+// requests for a path wait for the first.
+var goproxyFetches = struct {
+	sync.Mutex
+	m map[string]chan struct{}
+}{m: map[string]chan struct{}{}}
+
+func (c goproxyCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "405 - method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	prefix := "/" + c.secret + "/"
+	if len(r.URL.Path) < len(prefix) || subtle.ConstantTimeCompare([]byte(r.URL.Path[:len(prefix)]), []byte(prefix)) != 1 {
+		http.NotFound(w, r)
+		return
+	}
+	p := r.URL.Path[len(prefix):]
+	if strings.HasPrefix(p, "sumdb/") {
+		metricGoproxyCacheRequests.WithLabelValues("sumdb", "passthrough").Inc()
+		c.passthrough(w, r, "", p)
+		return
+	}
+
+	mod, kind, immutable, ok := goproxyCachePath(p)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	} else if c.dir == "" {
+		metricGoproxyCacheRequests.WithLabelValues(kind, "passthrough").Inc()
+		c.passthrough(w, r, mod, p)
+		return
+	}
+
+	file := filepath.Join(c.dir, filepath.FromSlash(p))
+	for {
+		if fi, err := os.Stat(file); err == nil && (immutable || time.Since(fi.ModTime()) < c.ttl) {
+			metricGoproxyCacheRequests.WithLabelValues(kind, "hit").Inc()
+			c.serveFile(w, file, kind)
+			return
+		}
+
+		goproxyFetches.Lock()
+		fetch, busy := goproxyFetches.m[p]
+		if !busy {
+			fetch = make(chan struct{})
+			goproxyFetches.m[p] = fetch
+		}
+		goproxyFetches.Unlock()
+		if busy {
+			// Check the cache again when the other fetch is done.
+			<-fetch
+			continue
+		}
+		break
+	}
+	defer func() {
+		goproxyFetches.Lock()
+		close(goproxyFetches.m[p])
+		delete(goproxyFetches.m, p)
+		goproxyFetches.Unlock()
+	}()
+
+	resp, err := goproxyGet(r.Context(), mod, p)
+	if err != nil || resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound && resp.StatusCode != http.StatusGone {
+		if err == nil {
+			resp.Body.Close()
+			err = fmt.Errorf("status %s", resp.Status)
+		}
+		// Better a stale version list than none.
+		if _, serr := os.Stat(file); serr == nil {
+			metricGoproxyCacheRequests.WithLabelValues(kind, "stale").Inc()
+			log.Printf("goproxy cache: fetching %s: %v, serving stale copy", p, err)
+			c.serveFile(w, file, kind)
+			return
+		}
+		metricGoproxyCacheRequests.WithLabelValues(kind, "error").Inc()
+		http.Error(w, fmt.Sprintf("502 - bad gateway: fetching from goproxy: %v", err), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	metricGoproxyCacheRequests.WithLabelValues(kind, "miss").Inc()
+	if resp.StatusCode != http.StatusOK {
+		// Not found may change, e.g. when a version is tagged, so not cached.
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, io.LimitReader(resp.Body, 64*1024)) // nothing to do for errors
+		return
+	}
+
+	if err := c.store(file, resp.Body); err != nil {
+		log.Printf("goproxy cache: storing %s: %v", p, err)
+		http.Error(w, "500 - internal server error: storing response from goproxy", http.StatusInternalServerError)
+		return
+	}
+	c.serveFile(w, file, kind)
+}
+
+// Module path and kind of proxy request for path p, for metrics, and whether its
+// response never changes. Paths are checked to be proper escaped module paths and
+// versions.
+func goproxyCachePath(p string) (mod, kind string, immutable, ok bool) {
+	var modPath, elem string
+	if strings.HasSuffix(p, "/@latest") {
+		modPath, kind = strings.TrimSuffix(p, "/@latest"), "latest"
+	} else if t := strings.SplitN(p, "/@v/", 2); len(t) == 2 {
+		modPath, elem = t[0], t[1]
+	} else {
+		return "", "", false, false
+	}
+	mod, err := module.UnescapePath(modPath)
+	if err != nil {
+		return "", "", false, false
+	}
+	if kind == "latest" {
+		return mod, kind, false, true
+	}
+	if elem == "list" {
+		return mod, "list", false, true
+	}
+	ext := path.Ext(elem)
+	switch ext {
+	case ".info", ".mod", ".zip":
+	default:
+		return "", "", false, false
+	}
+	version, err := module.UnescapeVersion(strings.TrimSuffix(elem, ext))
+	if err != nil {
+		return "", "", false, false
+	}
+	// Queries like branch names can resolve to other versions later.
+	return mod, ext[1:], isCanonicalVersion(version), true
+}
+
+func (c goproxyCache) serveFile(w http.ResponseWriter, file, kind string) {
+	f, err := os.Open(file)
+	if err != nil {
+		http.Error(w, "500 - internal server error: open cached file", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	ct := "text/plain; charset=utf-8"
+	switch kind {
+	case "latest", "info":
+		ct = "application/json"
+	case "zip":
+		ct = "application/zip"
+	}
+	w.Header().Set("Content-Type", ct)
+	io.Copy(w, f) // nothing to do for errors
+}
+
+// Write the response to file, through a temporary file, so readers never see a
+// partial file.
+func (c goproxyCache) store(file string, src io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0777); err != nil {
+		return err
+	}
+	tf, err := os.CreateTemp(c.dir, ".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if tf != nil {
+			tf.Close()
+			os.Remove(tf.Name())
+		}
+	}()
+	if _, err := io.Copy(tf, src); err != nil {
+		return err
+	}
+	if err := tf.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tf.Name(), file); err != nil {
+		return err
+	}
+	tf = nil
+	return nil
+}
+
+// Forward a request for module mod to the upstream module proxies, without
+// caching.
+func (c goproxyCache) passthrough(w http.ResponseWriter, r *http.Request, mod, p string) {
+	resp, err := goproxyGet(r.Context(), mod, p)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("502 - bad gateway: fetching from goproxy: %v", err), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body) // nothing to do for errors
+}
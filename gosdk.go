@@ -48,17 +48,16 @@ func (t target) osarch() string {
 	return t.Goos + "/" + t.Goarch
 }
 
-// List of targets from "go tool dist list", bound to be out of date here; should probably generate on startup, or when we get the first sdk installed.
-// Android and darwin/arm* cannot build on my linux/amd64 machine.
+// List of known targets, for autodetecting targets and linking to them. Starts
+// with the targets below, and is extended with the targets from "go tool dist
+// list" of installed toolchains. Whether a toolchain supports a target is checked
+// with checkTarget.
 // Note: list will be sorted after startup by readRecentBuilds, most used first.
 type xtargets struct {
 	sync.Mutex
 	use      map[string]int // Used for popularity, and for validating build requests.
 	totalUse int
 	list     []target
-
-	// Targets available for buildling. Use without lock.
-	available map[string]struct{}
 }
 
 var targets = &xtargets{
@@ -67,14 +66,8 @@ var targets = &xtargets{
 	0,
 	[]target{
 		{"aix", "ppc64"},
-		//	{"android", "386"},
-		//	{"android", "amd64"},
-		//	{"android", "arm"},
-		//	{"android", "arm64"},
-		{"darwin", "386"},
 		{"darwin", "amd64"},
-		//	{"darwin", "arm"},
-		//	{"darwin", "arm64"},
+		{"darwin", "arm64"},
 		{"dragonfly", "amd64"},
 		{"freebsd", "386"},
 		{"freebsd", "amd64"},
@@ -109,14 +102,13 @@ var targets = &xtargets{
 		{"windows", "386"},
 		{"windows", "amd64"},
 		{"windows", "arm"},
+		{"windows", "arm64"},
 	},
-	map[string]struct{}{},
 }
 
 func init() {
 	for _, t := range targets.list {
 		targets.use[t.osarch()] = 0
-		targets.available[t.osarch()] = struct{}{}
 	}
 }
 
@@ -133,6 +125,23 @@ func (t *xtargets) valid(target string) bool {
 	return ok
 }
 
+// Add targets not yet known.
+func (t *xtargets) merge(l []distTarget) {
+	t.Lock()
+	defer t.Unlock()
+	n := len(t.list)
+	for _, dt := range l {
+		nt := target{dt.GOOS, dt.GOARCH}
+		if _, ok := t.use[nt.osarch()]; !ok {
+			t.use[nt.osarch()] = 0
+			t.list = append(t.list, nt)
+		}
+	}
+	if len(t.list) != n {
+		t.sort()
+	}
+}
+
 // must be called with lock held.
 func (t *xtargets) sort() {
 	n := make([]target, len(t.list))
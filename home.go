@@ -98,6 +98,15 @@ func serveHome(w http.ResponseWriter, r *http.Request) {
 }
 
 func checkAllowedRespond(w http.ResponseWriter, module string) bool {
+	if moduleAllowed(module) {
+		return true
+	}
+	http.Error(w, "403 - Module path not allowed", http.StatusForbidden)
+	return false
+}
+
+// Whether builds for module are allowed by config ModulePrefixes.
+func moduleAllowed(module string) bool {
 	if len(config.ModulePrefixes) == 0 {
 		return true
 	}
@@ -106,6 +115,5 @@ func checkAllowedRespond(w http.ResponseWriter, module string) bool {
 			return true
 		}
 	}
-	http.Error(w, "403 - Module path not allowed", http.StatusForbidden)
 	return false
 }
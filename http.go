@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
 	"net/http"
 )
 
 const userAgent = "Go-http-client/1.1 (https://github.com/mjl-/gobuild)"
 
 func httpGet(url string) (*http.Response, error) {
-	req, err := http.NewRequest("GET", url, nil)
+	return httpGetContext(context.Background(), url)
+}
+
+func httpGetContext(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -2,8 +2,11 @@ package main
 
 import (
 	"compress/gzip"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"log"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -50,7 +53,7 @@ func serveIndex(w http.ResponseWriter, r *http.Request, bs buildSpec, br *buildR
 			c <- response{fmt.Errorf("bad module path: %v", err), nil}
 			return
 		}
-		u := fmt.Sprintf("%s%s/@v/list", config.GoProxy, modPath)
+		u := fmt.Sprintf("%s%s/@v/list", goproxyURL(), modPath)
 		mreq, err := http.NewRequestWithContext(r.Context(), "GET", u, nil)
 		if err != nil {
 			c <- response{fmt.Errorf("%w: preparing new http request: %v", errServer, err), nil}
@@ -78,6 +81,13 @@ func serveIndex(w http.ResponseWriter, r *http.Request, bs buildSpec, br *buildR
 			if s != "" {
 				vbs := bs
 				vbs.Version = s
+				// Options can differ per version. We know them for modules in the local module
+				// cache. Others link without options, we redirect to the right options when
+				// followed.
+				vbs.Options = ""
+				if fp, ok := cachedModuleOptions(vbs.Mod, vbs.Version); ok {
+					vbs.Options = fp
+				}
 				success := fileExists(filepath.Join(vbs.storeDir(), "recordnumber"))
 				p := request{vbs, "", pageIndex}.link()
 				link := versionLink{s, p, success, p == xlink}
@@ -129,22 +139,63 @@ func serveIndex(w http.ResponseWriter, r *http.Request, bs buildSpec, br *buildR
 		goversionLinks = append(goversionLinks, goversionLink{goversion, p, success, false, p == xlink})
 	}
 
+	// Only link to targets supported by the toolchain, marking first-class ports.
+	firstClass := map[string]bool{}
+	if l, err := sdkTargets(bs.Goversion); err != nil {
+		log.Printf("listing targets for %s: %v", bs.Goversion, err)
+	} else {
+		for _, t := range l {
+			firstClass[t.GOOS+"/"+t.GOARCH] = t.FirstClass
+		}
+	}
 	type targetLink struct {
-		Goos    string
-		Goarch  string
-		URLPath string
-		Success bool
-		Active  bool
+		Goos       string
+		Goarch     string
+		URLPath    string
+		Success    bool
+		Active     bool
+		FirstClass bool
 	}
 	targetLinks := []targetLink{}
 	for _, target := range targets.get() {
+		fc, ok := firstClass[target.osarch()]
+		if !ok && len(firstClass) > 0 {
+			continue
+		}
 		tbs := bs
 		tbs.Goos = target.Goos
 		tbs.Goarch = target.Goarch
+		tbs.Variant = ""
 		success := fileExists(filepath.Join(tbs.storeDir(), "recordnumber"))
 		p := request{tbs, "", pageIndex}.link()
-		targetLinks = append(targetLinks, targetLink{target.Goos, target.Goarch, p, success, p == xlink})
+		targetLinks = append(targetLinks, targetLink{target.Goos, target.Goarch, p, success, p == xlink, fc})
+	}
+
+	// Links to microarchitecture variants of the goarch, if any, starting with the default.
+	type variantLink struct {
+		Variant string // Value for the environment variable.
+		URLPath string
+		Success bool
+		Active  bool
 	}
+	var variantLinks []variantLink
+	if av, ok := variants[bs.Goarch]; ok {
+		for _, v := range append([]string{""}, variantList(bs.Goarch)...) {
+			vbs := bs
+			vbs.Variant = v
+			success := fileExists(filepath.Join(vbs.storeDir(), "recordnumber"))
+			p := request{vbs, "", pageIndex}.link()
+			if v == "" {
+				v = av.Default
+			}
+			variantLinks = append(variantLinks, variantLink{v, p, success, p == xlink})
+		}
+	}
+
+	// Link to build with the goversion from the go.mod of the module.
+	mbs := bs
+	mbs.Goversion = "module"
+	moduleGoversionURL := request{mbs, "", pageIndex}.link()
 
 	pkgGoDevURL := fmt.Sprintf("https://pkg.go.dev/%s@%s/%s", bs.Mod, bs.Version, bs.Dir[1:])
 	pkgGoDevURL = pkgGoDevURL[:len(pkgGoDevURL)-1] + "?tab=doc"
@@ -152,11 +203,41 @@ func serveIndex(w http.ResponseWriter, r *http.Request, bs buildSpec, br *buildR
 	resp := <-c
 
 	var filesizeGz string
+	var binaryRemoved bool
+	var verifyResults *verification
 	if br == nil {
 		br = &buildResult{buildSpec: bs}
 	} else {
-		if info, err := os.Stat(filepath.Join(bs.storeDir(), "binary.gz")); err == nil {
-			filesizeGz = fmt.Sprintf("%.1f MB", float64(info.Size())/(1024*1024))
+		if info, err := blobs.stat(bs.storeKey() + "/binary.gz"); err == nil {
+			filesizeGz = fmt.Sprintf("%.1f MB", float64(info.Size)/(1024*1024))
+		} else if errors.Is(err, fs.ErrNotExist) {
+			binaryRemoved = true
+		}
+		var err error
+		verifyResults, err = readVerification(bs.storeDir())
+		if err != nil {
+			failf(w, "%w: reading verification results: %v", errServer, err)
+			return
+		}
+	}
+
+	// Options of a finished build are stored with the build, for others we read them
+	// from the module.
+	var options buildOptions
+	if buf, err := os.ReadFile(filepath.Join(bs.storeDir(), "options.txt")); err == nil {
+		options, err = parseOptionsText(string(buf))
+		if err != nil {
+			failf(w, "%w: parsing stored build options: %v", errServer, err)
+			return
+		}
+	} else if !os.IsNotExist(err) {
+		failf(w, "%w: reading build options: %v", errServer, err)
+		return
+	} else if bs.Options != "" {
+		options, err = moduleOptions(bs)
+		if err != nil {
+			failf(w, "reading build options: %w", err)
+			return
 		}
 	}
 
@@ -180,10 +261,13 @@ func serveIndex(w http.ResponseWriter, r *http.Request, bs buildSpec, br *buildR
 		"DirPrepend":             prependDir,       // eg "" or /cmd/x"
 		"GoversionLinks":         goversionLinks,
 		"TargetLinks":            targetLinks,
+		"VariantLinks":           variantLinks,
+		"VariantEnv":             strings.Join(bs.variantEnv(), " "), // eg "GOAMD64=v3", or empty
 		"Mod":                    resp,
 		"GoProxy":                config.GoProxy,
 		"DownloadFilename":       xreq.downloadFilename(),
 		"PkgGoDevURL":            pkgGoDevURL,
+		"ModuleGoversionURL":     moduleGoversionURL,
 		"GobuildVersion":         gobuildVersion,
 		"VerifierKey":            config.VerifierKey,
 		"GobuildsOrgVerifierKey": gobuildsOrgVerifierKey,
@@ -197,6 +281,15 @@ func serveIndex(w http.ResponseWriter, r *http.Request, bs buildSpec, br *buildR
 		// Below only meaningful when "success".
 		"Filesize":   fmt.Sprintf("%.1f MB", float64(br.Filesize)/(1024*1024)),
 		"FilesizeGz": filesizeGz,
+
+		// Binary was removed by retention, downloading builds it again.
+		"BinaryRemoved": binaryRemoved,
+
+		// Nil if no verifiers were configured at the time of the build.
+		"Verification": verifyResults,
+
+		// Build options declared by the module, empty if none.
+		"Options": options,
 	}
 
 	if br.Sum == "" {
@@ -214,7 +307,11 @@ func readGzipFile(p string) ([]byte, error) {
 		return nil, err
 	}
 	defer f.Close()
-	if fgz, err := gzip.NewReader(f); err != nil {
+	return readGzip(f)
+}
+
+func readGzip(r io.Reader) ([]byte, error) {
+	if fgz, err := gzip.NewReader(r); err != nil {
 		return nil, err
 	} else {
 		return io.ReadAll(fgz)
@@ -6,9 +6,11 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 	"time"
 
 	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
 )
 
 type modVersion struct {
@@ -54,3 +56,134 @@ func resolveModuleLatest(ctx context.Context, goproxy, mod string) (*modVersion,
 	}
 	return &info, nil
 }
+
+// Whether v is a canonical module version, as used in build records.
+func isCanonicalVersion(v string) bool {
+	return v != "" && module.CanonicalVersion(v) == v
+}
+
+// Resolve a version query to a canonical version through the goproxy. Queries
+// are "latest", semver prefixes like "v1" and "v1.2", comparisons like "<v1.5",
+// and branch names and commit hashes. Branches and commits resolve to tags or
+// pseudo-versions through the goproxy's .info endpoint.
+func resolveModuleQuery(ctx context.Context, goproxy, mod, query string) (*modVersion, error) {
+	if query == "latest" {
+		return resolveModuleLatest(ctx, goproxy, mod)
+	}
+
+	modPath, err := module.EscapePath(mod)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadModule, err)
+	}
+
+	if isSemverQuery(query) {
+		versions, err := listModuleVersions(ctx, goproxy, modPath)
+		if err != nil {
+			return nil, err
+		}
+		v, ok := matchSemverQuery(query, versions)
+		if !ok {
+			return nil, fmt.Errorf("%w: no version matching %q", errNotExist, query)
+		}
+		return &modVersion{Version: v}, nil
+	}
+
+	escQuery, err := module.EscapeVersion(query)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadVersion, err)
+	}
+	u := fmt.Sprintf("%s%s/@v/%s.info", goproxy, modPath, escQuery)
+	resp, err := httpGetContext(ctx, u)
+	if err != nil {
+		return nil, fmt.Errorf("%w: http request to goproxy: %v", errServer, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+		return nil, fmt.Errorf("%w: goproxy cannot resolve version %q: %s", errNotExist, query, resp.Status)
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: error response from goproxy, status %s", errRemote, resp.Status)
+	}
+	var info modVersion
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, fmt.Errorf("%w: parsing json returned by goproxy: %v", errRemote, err)
+	} else if !isCanonicalVersion(info.Version) {
+		return nil, fmt.Errorf("%w: goproxy resolved %q to non-canonical version %q", errRemote, query, info.Version)
+	}
+	return &info, nil
+}
+
+// Tagged versions of a module from the goproxy.
+func listModuleVersions(ctx context.Context, goproxy, modPath string) ([]string, error) {
+	u := fmt.Sprintf("%s%s/@v/list", goproxy, modPath)
+	resp, err := httpGetContext(ctx, u)
+	if err != nil {
+		return nil, fmt.Errorf("%w: http request to goproxy: %v", errServer, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		metricGoproxyListErrors.WithLabelValues(fmt.Sprintf("%d", resp.StatusCode)).Inc()
+		return nil, fmt.Errorf("%w: error response from goproxy, status %s", errRemote, resp.Status)
+	}
+	buf, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: reading versions from goproxy: %v", errRemote, err)
+	}
+	var l []string
+	for _, s := range strings.Split(string(buf), "\n") {
+		if isCanonicalVersion(s) {
+			l = append(l, s)
+		}
+	}
+	return l, nil
+}
+
+// Whether query is a semver prefix like "v1" or "v1.2", or a comparison like
+// "<v1.5" or ">=v1.2.3".
+func isSemverQuery(query string) bool {
+	v := strings.TrimLeft(query, "<>=")
+	switch query[:len(query)-len(v)] {
+	case "":
+		return semver.IsValid(v) && strings.Count(v, ".") < 2 && semver.Prerelease(v) == "" && semver.Build(v) == ""
+	case "<", "<=", ">", ">=":
+		return semver.IsValid(v)
+	}
+	return false
+}
+
+// Find the version matching query, with the rules of the go command: Releases
+// are preferred over prereleases. Prefixes and "<" select the highest matching
+// version, ">" the lowest.
+func matchSemverQuery(query string, versions []string) (string, bool) {
+	v := strings.TrimLeft(query, "<>=")
+	op := query[:len(query)-len(v)]
+	match := func(x string) bool {
+		c := semver.Compare(x, v)
+		switch op {
+		case "<":
+			return c < 0
+		case "<=":
+			return c <= 0
+		case ">":
+			return c > 0
+		case ">=":
+			return c >= 0
+		}
+		return strings.HasPrefix(x, v+".")
+	}
+	lowest := op == ">" || op == ">="
+	for _, prerelease := range []bool{false, true} {
+		var best string
+		for _, x := range versions {
+			if !match(x) || (semver.Prerelease(x) != "") != prerelease {
+				continue
+			}
+			if best == "" || lowest && semver.Compare(x, best) < 0 || !lowest && semver.Compare(x, best) > 0 {
+				best = x
+			}
+		}
+		if best != "" {
+			return best, true
+		}
+	}
+	return "", false
+}
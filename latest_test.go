@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSemverQuery(t *testing.T) {
+	queries := map[string]bool{
+		"v1":        true,
+		"v1.2":      true,
+		"<v1.5":     true,
+		"<=v1.5.0":  true,
+		">v1":       true,
+		">=v1.2.3":  true,
+		"v1.2.3":    false, // Full version, not a query.
+		"v1.2-pre":  false,
+		"latest":    false,
+		"master":    false,
+		"abcdef012": false,
+		"<":         false,
+		"=v1":       false,
+		"<>v1":      false,
+		"v":         false,
+	}
+	for q, exp := range queries {
+		if got := isSemverQuery(q); got != exp {
+			t.Fatalf("isSemverQuery(%q) = %v, expected %v", q, got, exp)
+		}
+	}
+
+	versions := []string{"v1.0.0", "v1.2.0", "v1.2.5", "v1.10.0", "v1.11.0-rc1", "v2.0.0-beta", "v0.9.0"}
+	tests := []struct {
+		query string
+		exp   string // Empty if no match.
+	}{
+		{"v1", "v1.10.0"},
+		{"v1.2", "v1.2.5"},
+		{"v1.1", ""}, // Not a prefix of v1.10.0.
+		{"v1.11", "v1.11.0-rc1"},
+		{"v2", "v2.0.0-beta"}, // Prereleases when there is no release.
+		{"v3", ""},
+		{"<v1.2.5", "v1.2.0"},
+		{"<=v1.2.5", "v1.2.5"},
+		{"<v1", "v0.9.0"},
+		{">v1.2.0", "v1.2.5"},
+		{">=v1.2.0", "v1.2.0"},
+		{">v1.10.0", "v1.11.0-rc1"},
+		{">v2.0.0", ""},
+		{"<v0.9.0", ""},
+	}
+	for _, tc := range tests {
+		v, ok := matchSemverQuery(tc.query, versions)
+		if ok != (tc.exp != "") || v != tc.exp {
+			t.Fatalf("matchSemverQuery(%q) = %q %v, expected %q", tc.query, v, ok, tc.exp)
+		}
+	}
+}
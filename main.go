@@ -18,9 +18,12 @@ func usage() {
 	log.Println("usage: gobuild config")
 	log.Println("       gobuild testconfig gobuild.conf")
 	log.Println("       gobuild serve [flags] [gobuild.conf]")
+	log.Println("       gobuild worker [flags] [gobuild.conf]")
 	log.Println("       gobuild genkey name")
 	log.Println("       gobuild get [flags] module[@version/package]")
 	log.Println("       gobuild sum < file")
+	log.Println("       gobuild verify-log [flags] [gobuild.conf]")
+	log.Println("       gobuild sandbox-test [gobuild.conf]")
 	flag.PrintDefaults()
 	os.Exit(2)
 }
@@ -55,6 +58,8 @@ func main() {
 		log.Printf("config OK")
 	case "serve":
 		serve(args)
+	case "worker":
+		worker(args)
 	case "genkey":
 		if len(args) != 1 {
 			usage()
@@ -69,6 +74,19 @@ func main() {
 		}
 	case "get":
 		get(args)
+	case "verify-log":
+		verifyLog(args)
+	case "sandbox-test":
+		sandboxTest(args)
+	case "sandbox-exec":
+		// Internal, started by gobuild for running a command in the sandbox.
+		sandboxExec(args)
+	case "privsep-exec":
+		// Internal, started by gobuild for running a command with privilege separation.
+		privsepExecClient(args)
+	case "sandbox-probe":
+		// Internal, started in the sandbox by sandbox-test.
+		sandboxRunProbe(args)
 	case "sum":
 		if len(args) != 0 {
 			usage()
@@ -39,6 +39,14 @@ var (
 		[]string{"code"},
 	)
 
+	metricGoproxyCacheRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gobuild_goproxy_cache_requests_total",
+			Help: "Number of requests to the goproxy cache, per kind (list, latest, info, mod, zip, sumdb) and result (hit, miss, stale, error, passthrough).",
+		},
+		[]string{"kind", "result"},
+	)
+
 	metricPageDuration = promauto.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Name:    "gobuild_page_duration_seconds",
@@ -77,6 +85,13 @@ var (
 		},
 		[]string{"goos", "goarch", "goversion"},
 	)
+	metricCompileAborts = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gobuild_compile_aborts_total",
+			Help: "Number of go builds stopped before completion, per reason: timeout, idle or canceled.",
+		},
+		[]string{"reason"},
+	)
 
 	metricVerifyDuration = promauto.NewHistogramVec(
 		prometheus.HistogramOpts{
@@ -93,6 +108,20 @@ var (
 		},
 		[]string{"baseurl", "goos", "goarch", "goversion"},
 	)
+	metricQuarantined = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gobuild_quarantined_total",
+			Help: "Number of builds with mismatching binaries that were quarantined, per reason (verify, verify-async, follow, restore).",
+		},
+		[]string{"reason"},
+	)
+	metricVerifyMismatches = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gobuild_verify_mismatches_total",
+			Help: "Number of builds for which a verifier returned a different sum.",
+		},
+		[]string{"baseurl"},
+	)
 
 	metricTlogAddErrors = promauto.NewCounter(
 		prometheus.CounterOpts{
@@ -112,6 +141,94 @@ var (
 			Help: "Number of records in the transparency log.",
 		},
 	)
+	metricFollowRecords = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gobuild_follow_records_total",
+			Help: "Number of records from followed transparency logs that were rebuilt, per log and status (match, mismatch, invalid, skipped, failed, error, gaveup). Errors are temporary and counted for each attempt, gaveup is for records with errors for too many attempts.",
+		},
+		[]string{"log", "status"},
+	)
+	metricFollowSecurityErrors = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gobuild_follow_security_errors_total",
+			Help: "Number of security errors for followed transparency logs, after which following stops.",
+		},
+		[]string{"log"},
+	)
+	metricFollowNext = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gobuild_follow_next_record",
+			Help: "Next record number to rebuild from followed transparency log.",
+		},
+		[]string{"log"},
+	)
+	metricFollowTreeSize = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gobuild_follow_tree_size",
+			Help: "Last known number of records in followed transparency log.",
+		},
+		[]string{"log"},
+	)
+	metricFollowConnected = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gobuild_follow_connected",
+			Help: "Whether we are connected to the stream of the followed transparency log.",
+		},
+		[]string{"log"},
+	)
+
+	metricBatches = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "gobuild_batches_total",
+			Help: "Number of batches of builds created.",
+		},
+	)
+
+	metricTlogStreamListeners = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "gobuild_tlog_stream_listeners",
+			Help: "Number of connected listeners for new records in the transparency log.",
+		},
+	)
+
+	metricBinariesRemoved = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "gobuild_binaries_removed_total",
+			Help: "Number of binaries removed by retention.",
+		},
+	)
+	metricBinariesRestored = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "gobuild_binaries_restored_total",
+			Help: "Number of binaries removed by retention that were built again and restored.",
+		},
+	)
+	metricBinaryRestoreMismatches = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "gobuild_binary_restore_mismatches_total",
+			Help: "Number of rebuilds of binaries removed by retention with a different sum than in the transparency log.",
+		},
+	)
+
+	metricDiskUsage = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gobuild_disk_usage_bytes",
+			Help: "Size of files in directory in bytes, per directory: modcache (shared module cache), buildcache (go build cache), sdk and result. Updated periodically.",
+		},
+		[]string{"dir"},
+	)
+	metricModulesPruned = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "gobuild_modules_pruned_total",
+			Help: "Number of idle extracted module directories removed from the module cache.",
+		},
+	)
+	metricBuildCacheCleans = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "gobuild_buildcache_cleans_total",
+			Help: "Number of times the go build cache was cleaned for exceeding its size limit.",
+		},
+	)
 
 	metricTlogOpsSignedErrors       = newOpsErrorCounter("signed")
 	metricTlogOpsReadrecordsErrors  = newOpsErrorCounter("readrecords")
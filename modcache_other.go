@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"os"
+)
+
+// Locks are only used on Linux. Elsewhere, module caches of other processes are
+// never considered left behind, and are only removed by their own process.
+func tryLockFile(f *os.File) bool {
+	return false
+}
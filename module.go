@@ -18,7 +18,7 @@ func serveModules(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	info, err := resolveModuleLatest(r.Context(), config.GoProxy, mod)
+	info, err := resolveModuleLatest(r.Context(), goproxyURL(), mod)
 	if err != nil {
 		failf(w, "resolving latest for module: %w", err)
 		return
@@ -41,11 +41,17 @@ func serveModules(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	opts, err := readModuleOptions(modDir, info.Version)
+	if err != nil {
+		failf(w, "reading build options: %w", err)
+		return
+	}
+
 	goos, goarch := autodetectTarget(r)
 
-	bs := buildSpec{mod, info.Version, "", goos, goarch, goversion}
+	bs := buildSpec{mod, info.Version, "", goos, goarch, "", goversion, opts.fingerprint()}
 
-	mainDirs, err := listMainPackages(gobin, modDir)
+	mainDirs, err := listMainPackages(gobin, modDir, opts)
 	if err != nil {
 		failf(w, "listing main packages in module: %w", err)
 		return
@@ -90,15 +96,17 @@ func serveModules(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func listMainPackages(gobin string, modDir string) ([]string, error) {
+func listMainPackages(gobin string, modDir string, opts buildOptions) ([]string, error) {
 	goproxy := true
 	cgo := true
-	cmd := makeCommand(goproxy, modDir, cgo, nil, gobin, "list", "-f", "{{.Name}} {{ .Dir }}", "./...")
+	argv := append([]string{gobin, "list"}, opts.tagsFlags()...)
+	argv = append(argv, "-f", "{{.Name}} {{ .Dir }}", "./...")
+	cmd := makeCommand(goproxy, modDir, cgo, nil, argv...)
 	stderr := &strings.Builder{}
 	cmd.Stderr = stderr
 	output, err := cmd.Output()
 	if err != nil {
-		return nil, fmt.Errorf("%w\n\n# output from go list:\n%s\n\nstderr:\n%s", err, output, stderr.String())
+		return nil, fmt.Errorf("%w\n\n# output from go list:\n%s\n\nstderr:\n%s", err, output, redactGoproxy(stderr.String()))
 	}
 	r := []string{}
 	for _, s := range strings.Split(string(output), "\n") {
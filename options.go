@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+var errBadOptions = errors.New("bad build options")
+
+// Module authors can declare build options with comment directives in go.mod of
+// the module:
+//
+//	//gobuild:tags netgo,osusergo
+//	//gobuild:X main.version=$version
+//	//gobuild:strip
+//
+// Tags are passed with -tags. Each X is passed as -X in -ldflags, with $version
+// replaced by the module version. Strip adds -s -w to -ldflags. The options
+// apply to all commands in the module.
+//
+// A buildSpec has a fingerprint of the options, so builds with options get a
+// different key, URL and result directory.
+type buildOptions struct {
+	Tags  []string // Sorted, unique.
+	X     []string // As "name=value", sorted by name, unique names.
+	Strip bool
+}
+
+// Parse directives from a go.mod file.
+func parseGoModOptions(data []byte, version string) (buildOptions, error) {
+	var o buildOptions
+	tags := map[string]struct{}{}
+	xnames := map[string]struct{}{}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "//gobuild:") {
+			continue
+		}
+		t := strings.SplitN(strings.TrimPrefix(line, "//gobuild:"), " ", 2)
+		var arg string
+		if len(t) == 2 {
+			arg = strings.TrimSpace(t[1])
+		}
+		lineErr := func(format string, args ...interface{}) error {
+			return fmt.Errorf("%w: go.mod line %d: %s", errBadOptions, i+1, fmt.Sprintf(format, args...))
+		}
+		if strings.ContainsAny(arg, " \t'\"\\") {
+			return o, lineErr("whitespace, quotes and backslash not allowed")
+		}
+		switch t[0] {
+		case "tags":
+			for _, tag := range strings.Split(arg, ",") {
+				if tag == "" {
+					return o, lineErr("empty tag")
+				}
+				if _, ok := tags[tag]; !ok {
+					tags[tag] = struct{}{}
+					o.Tags = append(o.Tags, tag)
+				}
+			}
+		case "X":
+			name, value, ok := strings.Cut(arg, "=")
+			if !ok || name == "" {
+				return o, lineErr("X must be of the form importpath.name=value")
+			}
+			if _, ok := xnames[name]; ok {
+				return o, lineErr("duplicate X for %s", name)
+			}
+			xnames[name] = struct{}{}
+			o.X = append(o.X, name+"="+strings.ReplaceAll(value, "$version", version))
+		case "strip":
+			if arg != "" {
+				return o, lineErr("strip does not take parameters")
+			}
+			o.Strip = true
+		default:
+			return o, lineErr("unknown directive %q", t[0])
+		}
+	}
+	sort.Strings(o.Tags)
+	sort.Strings(o.X)
+	return o, nil
+}
+
+// Read the build options from go.mod in modDir.
+func readModuleOptions(modDir, version string) (buildOptions, error) {
+	buf, err := os.ReadFile(filepath.Join(modDir, "go.mod"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			// Modules without go.mod have no options.
+			return buildOptions{}, nil
+		}
+		return buildOptions{}, fmt.Errorf("%w: reading go.mod: %v", errServer, err)
+	}
+	return parseGoModOptions(buf, version)
+}
+
+// Parse options in the canonical text form, as stored in options.txt.
+func parseOptionsText(s string) (buildOptions, error) {
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSuffix(s, "\n"), "\n") {
+		lines = append(lines, "//gobuild:"+line)
+	}
+	// Placeholders have already been replaced.
+	return parseGoModOptions([]byte(strings.Join(lines, "\n")), "")
+}
+
+func (o buildOptions) Empty() bool {
+	return len(o.Tags) == 0 && len(o.X) == 0 && !o.Strip
+}
+
+// Canonical text form of the options, one per line, as shown on the build page,
+// and used for the fingerprint.
+func (o buildOptions) String() string {
+	var s string
+	if len(o.Tags) > 0 {
+		s += "tags " + strings.Join(o.Tags, ",") + "\n"
+	}
+	for _, x := range o.X {
+		s += "X " + x + "\n"
+	}
+	if o.Strip {
+		s += "strip\n"
+	}
+	return s
+}
+
+// Fingerprint for use in buildSpec.Options. Empty for no options.
+func (o buildOptions) fingerprint() string {
+	if o.Empty() {
+		return ""
+	}
+	h := sha256.Sum256([]byte(o.String()))
+	return base64.RawURLEncoding.EncodeToString(h[:9])
+}
+
+// Whether s is a valid fingerprint.
+func isOptionsFingerprint(s string) bool {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	return err == nil && len(buf) == 9
+}
+
+// Flags for go list and go build/install.
+func (o buildOptions) tagsFlags() []string {
+	if len(o.Tags) == 0 {
+		return nil
+	}
+	return []string{o.TagsFlag()}
+}
+
+// Flag for -tags for use in a shell command, empty if no tags.
+func (o buildOptions) TagsFlag() string {
+	if len(o.Tags) == 0 {
+		return ""
+	}
+	return "-tags=" + strings.Join(o.Tags, ",")
+}
+
+// Flag for -ldflags for use in a shell command, quoted if needed.
+func (o buildOptions) LdflagsFlag() string {
+	s := "-ldflags=" + o.ldflags()
+	if strings.Contains(s, " ") {
+		s = "'" + s + "'"
+	}
+	return s
+}
+
+// Value for -ldflags, always with empty buildid.
+func (o buildOptions) ldflags() string {
+	s := "-buildid="
+	if o.Strip {
+		s += " -s -w"
+	}
+	for _, x := range o.X {
+		s += " -X " + x
+	}
+	return s
+}
+
+// Read the build options of the module in modDir, and check they match bs.
+// Returns an error wrapping errBadOptions if they don't.
+func checkOptions(bs buildSpec, modDir string) (buildOptions, error) {
+	opts, err := readModuleOptions(modDir, bs.Version)
+	if err != nil {
+		return buildOptions{}, err
+	}
+	if fp := opts.fingerprint(); fp != bs.Options {
+		return opts, fmt.Errorf("%w: module declares options %q, not %q", errBadOptions, fp, bs.Options)
+	}
+	return opts, nil
+}
+
+// Fingerprint of the options of mod@version if it is in the local module cache,
+// for showing which versions have been built. The go.mod from the download cache
+// is read, the module doesn't have to be extracted.
+func cachedModuleOptions(mod, version string) (string, bool) {
+	modPath, err := module.EscapePath(mod)
+	if err != nil {
+		return "", false
+	}
+	modVersion, err := module.EscapeVersion(version)
+	if err != nil {
+		return "", false
+	}
+	p := filepath.Join(modcacheDir(), "cache", "download", filepath.Clean(modPath), "@v", modVersion+".mod")
+	buf, err := os.ReadFile(p)
+	if err != nil {
+		return "", false
+	}
+	opts, err := parseGoModOptions(buf, version)
+	if err != nil {
+		return "", false
+	}
+	return opts.fingerprint(), true
+}
+
+// Fetch the module of bs if needed, and return the build options it declares.
+func moduleOptions(bs buildSpec) (buildOptions, error) {
+	gobin, err := ensureGobin(bs.Goversion)
+	if err != nil {
+		return buildOptions{}, err
+	}
+	modDir, getOutput, err := ensureModule(bs.Goversion, gobin, bs.Mod, bs.Version)
+	if err != nil {
+		return buildOptions{}, fmt.Errorf("error fetching module from goproxy: %w\n\n# output from go get:\n%s", err, string(getOutput))
+	}
+	return readModuleOptions(modDir, bs.Version)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCachedModuleOptions(t *testing.T) {
+	origHomedir := homedir
+	defer func() {
+		homedir = origHomedir
+	}()
+	homedir = t.TempDir()
+
+	dir := filepath.Join(modcacheDir(), "cache", "download", "example.com", "!cmd", "@v")
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	write := func(version, gomod string) {
+		if err := os.WriteFile(filepath.Join(dir, version+".mod"), []byte(gomod), 0666); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	write("v1.0.0", "module example.com/Cmd\n")
+	write("v1.1.0", "module example.com/Cmd\n\n//gobuild:strip\n")
+
+	opts, err := parseGoModOptions([]byte("//gobuild:strip\n"), "v1.1.0")
+	if err != nil {
+		t.Fatalf("parse options: %v", err)
+	}
+	tests := []struct {
+		version string
+		exp     string
+		ok      bool
+	}{
+		{"v1.0.0", "", true},
+		{"v1.1.0", opts.fingerprint(), true},
+		{"v1.2.0", "", false}, // Not in module cache.
+	}
+	for _, tc := range tests {
+		fp, ok := cachedModuleOptions("example.com/Cmd", tc.version)
+		if fp != tc.exp || ok != tc.ok {
+			t.Fatalf("options for %s: got %q %v, expected %q %v", tc.version, fp, ok, tc.exp, tc.ok)
+		}
+	}
+}
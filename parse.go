@@ -16,7 +16,9 @@ type buildSpec struct {
 	Dir       string // Always starts with slash. Never ends with slash unless "/".
 	Goos      string
 	Goarch    string
+	Variant   string // Microarchitecture variant like "v3" for GOAMD64, empty for the default.
 	Goversion string
+	Options   string // Fingerprint of build options declared in go.mod, empty if none.
 }
 
 // filename to store the binary as. With .exe for windows.
@@ -46,7 +48,21 @@ func (bs buildSpec) appendDir() string {
 // Used in transparency log lookups, and used to calculate directory where build results are stored.
 // Can be parsed with parseBuildSpec.
 func (bs buildSpec) String() string {
-	return fmt.Sprintf("%s@%s/%s%s-%s-%s/", bs.Mod, bs.Version, bs.appendDir(), bs.Goos, bs.Goarch, bs.Goversion)
+	return fmt.Sprintf("%s@%s/%s%s/", bs.Mod, bs.Version, bs.appendDir(), bs.targetElem())
+}
+
+// Last path element of a buildSpec: goos-goarch[-variant]-goversion, with
+// "+options" if the build has options.
+func (bs buildSpec) targetElem() string {
+	s := bs.Goos + "-" + bs.Goarch + "-"
+	if bs.Variant != "" {
+		s += bs.Variant + "-"
+	}
+	s += bs.Goversion
+	if bs.Options != "" {
+		s += "+" + bs.Options
+	}
+	return s
 }
 
 // GOBIN-relative name of file created by "go get". Used as key to prevent
@@ -69,9 +85,15 @@ func (bs buildSpec) outputPath() string {
 // Local directory where results are stored, both successful and failed.
 // Directories of failed builds can be removed, for a retry.
 func (bs buildSpec) storeDir() string {
+	return filepath.Join(resultDir, filepath.FromSlash(bs.storeKey()))
+}
+
+// Path of the build directory relative to the result directory, with slashes.
+// Also used in keys for the blob store.
+func (bs buildSpec) storeKey() string {
 	sha := sha256.Sum256([]byte(bs.String()))
 	sum := base64.RawURLEncoding.EncodeToString(sha[:20])
-	return filepath.Join(resultDir, sum[:1], sum)
+	return sum[:1] + "/" + sum
 }
 
 type buildResult struct {
@@ -80,7 +102,7 @@ type buildResult struct {
 	Sum      string
 }
 
-// Parse string of the form: module@version/dir/goos-goarch-goversion/.
+// Parse string of the form: module@version/dir/goos-goarch[-variant]-goversion[+options]/.
 // String generates strings that parseBuildSpec parses.
 func parseBuildSpec(s string) (buildSpec, error) {
 	bs := buildSpec{}
@@ -94,16 +116,37 @@ func parseBuildSpec(s string) (buildSpec, error) {
 	last := t[len(t)-1]
 	s = s[:len(s)-len(last)]
 
+	// The options fingerprint can contain dashes, take it off first.
+	if i := strings.Index(last, "+"); i >= 0 {
+		bs.Options = last[i+1:]
+		last = last[:i]
+		if !isOptionsFingerprint(bs.Options) {
+			return bs, fmt.Errorf("bad options %q", bs.Options)
+		}
+	}
+
 	t = strings.Split(last, "-")
-	if len(t) != 3 {
+	if len(t) != 3 && len(t) != 4 {
 		return bs, fmt.Errorf("bad goos-goarch-goversion %q", last)
 	}
 	bs.Goos = t[0]
 	bs.Goarch = t[1]
-	if _, ok := targets.available[bs.Goos+"/"+bs.Goarch]; !ok {
-		return bs, fmt.Errorf("unsupported target %s/%s", bs.Goos, bs.Goarch)
+	// Whether the toolchain supports the target is checked when building.
+	if !isTargetName(bs.Goos) || !isTargetName(bs.Goarch) {
+		return bs, fmt.Errorf("bad target %s/%s", bs.Goos, bs.Goarch)
+	}
+	if len(t) == 4 {
+		bs.Variant = t[2]
+		// Without variant, the element is left out. An empty variant would be another
+		// name for the same build.
+		if bs.Variant == "" {
+			return bs, fmt.Errorf("%w: empty variant", errBadVariant)
+		}
+		if err := checkVariant(bs.Goarch, bs.Variant); err != nil {
+			return bs, err
+		}
 	}
-	bs.Goversion = t[2]
+	bs.Goversion = t[len(t)-1]
 
 	t = strings.SplitN(s, "@", 2)
 	if len(t) != 2 {
@@ -144,6 +187,16 @@ func parseBuildSpec(s string) (buildSpec, error) {
 	return bs, nil
 }
 
+// Whether s is a syntactically valid goos or goarch.
+func isTargetName(s string) bool {
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return s != ""
+}
+
 // Parse module[@version/dir].
 func parseGetSpec(s string) (buildSpec, error) {
 	bs := buildSpec{}
@@ -189,14 +242,33 @@ func parseRecord(data []byte) (*buildResult, error) {
 	}
 	msg = msg[:len(msg)-1]
 	t := strings.Split(msg, " ")
-	if len(t) != 8 {
-		return nil, fmt.Errorf("bad record, got %d records, expected 8", len(t))
+	if len(t) < 8 {
+		return nil, fmt.Errorf("bad record, got %d records, expected at least 8", len(t))
 	}
 	size, err := strconv.ParseInt(t[6], 10, 64)
 	if err != nil {
 		return nil, fmt.Errorf("bad filesize %s: %v", t[6], err)
 	}
-	br := &buildResult{buildSpec{t[0], t[1], t[2], t[3], t[4], t[5]}, size, t[7]}
+	br := &buildResult{buildSpec{t[0], t[1], t[2], t[3], t[4], "", t[5], ""}, size, t[7]}
+
+	// Optional fields after the sum are of the form name=value.
+	for _, f := range t[8:] {
+		k, v, _ := strings.Cut(f, "=")
+		switch k {
+		case "variant":
+			if br.Variant != "" || checkVariant(br.Goarch, v) != nil || v == "" {
+				return nil, fmt.Errorf("bad variant field %q", f)
+			}
+			br.Variant = v
+		case "options":
+			if br.Options != "" || !isOptionsFingerprint(v) {
+				return nil, fmt.Errorf("bad options field %q", f)
+			}
+			br.Options = v
+		default:
+			return nil, fmt.Errorf("unknown field %q", f)
+		}
+	}
 	return br, nil
 }
 
@@ -211,6 +283,12 @@ func (br buildResult) packRecord() ([]byte, error) {
 		fmt.Sprintf("%d", br.Filesize),
 		br.Sum,
 	}
+	if br.Variant != "" {
+		fields = append(fields, "variant="+br.Variant)
+	}
+	if br.Options != "" {
+		fields = append(fields, "options="+br.Options)
+	}
 	for i, f := range fields {
 		if f == "" {
 			return nil, fmt.Errorf("bad empty field %d", i)
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRecord(t *testing.T) {
+	sum := "0" + strings.Repeat("a", 27)
+	base := "example.com/cmd v1.0.0 / linux amd64 go1.21.0 123 " + sum
+
+	// Records that parse, and pack to the same record.
+	valid := []string{
+		base,
+		"example.com/cmd v1.0.0 /cmd/x windows arm64 go1.21.0 123 " + sum,
+		base + " options=AAAAAAAAAAAA",
+		base + " variant=v3",
+		base + " variant=v3 options=AAAAAAAAAAAA",
+	}
+	for _, s := range valid {
+		br, err := parseRecord([]byte(s + "\n"))
+		if err != nil {
+			t.Fatalf("parse record %q: %v", s, err)
+		}
+		buf, err := br.packRecord()
+		if err != nil {
+			t.Fatalf("pack record %q: %v", s, err)
+		}
+		if string(buf) != s+"\n" {
+			t.Fatalf("packed record %q, expected %q", buf, s+"\n")
+		}
+	}
+	br, err := parseRecord([]byte(base + " options=AAAAAAAAAAAA\n"))
+	if err != nil {
+		t.Fatalf("parse record: %v", err)
+	}
+	if br.Options != "AAAAAAAAAAAA" || br.Filesize != 123 || br.Sum != sum || br.Dir != "/" {
+		t.Fatalf("parsed record %#v", br)
+	}
+
+	invalid := []string{
+		base, // No newline.
+		"example.com/cmd v1.0.0 / linux amd64 go1.21.0 " + sum + "\n",   // Missing field.
+		"example.com/cmd v1.0.0 / linux amd64 go1.21.0 x " + sum + "\n", // Bad filesize.
+		base + " options=AAAAAAAAAAAA options=AAAAAAAAAAAA\n",           // Duplicate field.
+		base + " options=short\n",                                       // Bad fingerprint.
+		base + " options=\n",                                            // Empty fingerprint.
+		base + " variant=v3 variant=v3\n",                               // Duplicate field.
+		base + " variant=v9\n",                                          // Unknown variant.
+		base + " variant=\n",                                            // Empty variant.
+		base + " other=x\n",                                             // Unknown field.
+		base + " x\n",                                                   // Not a field.
+	}
+	for _, s := range invalid {
+		if _, err := parseRecord([]byte(s)); err == nil {
+			t.Fatalf("parse record %q succeeded, expected error", s)
+		}
+	}
+
+	// Records that cannot be packed.
+	for _, br := range []buildResult{
+		{buildSpec{Mod: "example.com/cmd", Version: "v1.0.0", Dir: "/", Goos: "linux", Goarch: "amd64", Goversion: "go1.21.0"}, 0, sum},
+		{buildSpec{Mod: "example.com/cmd", Version: "v1.0.0", Dir: "/", Goos: "linux", Goarch: "amd64", Goversion: "go1.21.0"}, 1, "0short"},
+		{buildSpec{Mod: "example.com/cmd", Version: "v1.0.0", Dir: "/", Goos: "linux", Goarch: "amd64"}, 1, sum},
+		{buildSpec{Mod: "example.com/cmd", Version: "v1.0.0", Dir: "/a b", Goos: "linux", Goarch: "amd64", Goversion: "go1.21.0"}, 1, sum},
+	} {
+		if _, err := br.packRecord(); err == nil {
+			t.Fatalf("pack record %#v succeeded, expected error", br)
+		}
+	}
+}
+
+func TestBuildSpec(t *testing.T) {
+	valid := []string{
+		"example.com/cmd@v1.0.0/linux-amd64-go1.21.0/",
+		"example.com/cmd@v1.0.0/cmd/x/linux-amd64-go1.21.0/",
+		"example.com/cmd@v1.0.0/linux-amd64-go1.21.0+AAAAAAAAAAAA/",
+		"example.com/cmd@v1.0.0/linux-amd64-v3-go1.21.0+AAAAAAAAAAAA/",
+		"example.com/cmd@v1.0.0/linux-arm-6-go1.21.0/",
+	}
+	for _, s := range valid {
+		bs, err := parseBuildSpec(s)
+		if err != nil {
+			t.Fatalf("parse build spec %q: %v", s, err)
+		}
+		if bs.String() != s {
+			t.Fatalf("build spec %q formatted as %q", s, bs.String())
+		}
+	}
+
+	invalid := []string{
+		"example.com/cmd@v1.0.0/linux-amd64-go1.21.0",
+		"example.com/cmd@v1.0.0/linux-go1.21.0/",
+		"example.com/cmd/linux-amd64-go1.21.0/",
+		"cmd@v1.0.0/linux-amd64-go1.21.0/",
+		"example.com/cmd@v1.0.0/linux-amd64-go1.21.0+bad/",
+		"example.com/cmd@v1.0.0/linux-amd64-v9-go1.21.0/",
+		"example.com/cmd@v1.0.0/linux-amd64--go1.21.0/",
+		"example.com/cmd@v1.0.0/linux-arm64-v3-go1.21.0/",
+		"example.com/cmd@v1.0.0/cmd/../x/linux-amd64-go1.21.0/",
+	}
+	for _, s := range invalid {
+		if _, err := parseBuildSpec(s); err == nil {
+			t.Fatalf("parse build spec %q succeeded, expected error", s)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// With config PrivSep, gobuild is started as root. The privileged process opens
+// the transparency log, and is the only process writing the log and the result
+// directory. It binds the listeners, and starts gobuild again as ServeUser for
+// the HTTP servers and coordinating builds: the frontend. The frontend sends
+// requests over a unix socket to add a build to the log, to store a failed build
+// or verification results, and to start go commands, which the privileged process
+// runs as BuildUser.
+
+// Set in the frontend process, started by the privileged process.
+var privsepFrontend bool
+
+// Request to the privileged process, one per connection.
+type privsepRequest struct {
+	Op           string        // "addsum", "restore", "failure", "verification", "prunemodules" or "exec".
+	Tmpdir       string        `json:",omitempty"` // For addsum and restore, directory in staging dir with build files.
+	BuildResult  *buildResult  `json:",omitempty"`
+	BuildSpec    *buildSpec    `json:",omitempty"`
+	Output       string        `json:",omitempty"`
+	Verification *verification `json:",omitempty"`
+	Exec         *privsepExec  `json:",omitempty"`
+}
+
+// Command to run as BuildUser. The file descriptors for stdin, stdout, stderr
+// and ExtraFiles are passed along with the request.
+type privsepExec struct {
+	Path       string
+	Args       []string
+	Env        []string
+	Dir        string
+	Sandbox    bool // Start as sandbox helper, in new namespaces.
+	ExtraFiles int
+}
+
+type privsepResponse struct {
+	Error        string `json:",omitempty"`
+	RecordNumber int64  `json:",omitempty"`
+	Pruned       int    `json:",omitempty"` // For prunemodules, number of modules removed.
+	ExitCode     int    `json:",omitempty"`
+}
+
+// Unix socket the privileged process listens on. Absolute, go commands run in
+// other directories.
+func privsepSocketPath() string {
+	dataDir := config.DataDir
+	if !filepath.IsAbs(dataDir) {
+		dataDir = filepath.Join(workdir, dataDir)
+	}
+	return filepath.Join(dataDir, "privsep.sock")
+}
+
+// Directory where the frontend prepares files for the privileged process.
+// Without privilege separation, this is the result directory.
+func stagingDir() string {
+	if config.PrivSep == nil {
+		return resultDir
+	}
+	return filepath.Join(config.DataDir, "staging")
+}
+
+// Send a request without file descriptors to the privileged process.
+func privsepCall(req privsepRequest) (privsepResponse, error) {
+	var resp privsepResponse
+	conn, err := net.Dial("unix", privsepSocketPath())
+	if err != nil {
+		return resp, fmt.Errorf("connecting to privileged process: %v", err)
+	}
+	defer conn.Close()
+	// First byte can carry file descriptors.
+	if _, err := conn.Write([]byte{0}); err != nil {
+		return resp, fmt.Errorf("writing request: %v", err)
+	}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return resp, fmt.Errorf("writing request: %v", err)
+	}
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return resp, fmt.Errorf("reading response: %v", err)
+	}
+	if resp.Error != "" {
+		return resp, fmt.Errorf("privileged process: %s", resp.Error)
+	}
+	return resp, nil
+}
+
+// Have the privileged process add the build files in tmpdir, in the staging
+// directory, to the transparency log.
+func privsepAddSum(tmpdir string, br buildResult) (int64, error) {
+	resp, err := privsepCall(privsepRequest{Op: "addsum", Tmpdir: tmpdir, BuildResult: &br})
+	if err != nil {
+		return -1, err
+	}
+	return resp.RecordNumber, nil
+}
+
+// Have the privileged process store the rebuilt binary in tmpdir, in the staging
+// directory, of a build whose binary was removed by retention.
+func privsepRestoreBinary(tmpdir string, br buildResult) error {
+	_, err := privsepCall(privsepRequest{Op: "restore", Tmpdir: tmpdir, BuildResult: &br})
+	return err
+}
+
+func privsepSaveFailure(bs buildSpec, output string) error {
+	_, err := privsepCall(privsepRequest{Op: "failure", BuildSpec: &bs, Output: output})
+	return err
+}
+
+func privsepWriteVerification(bs buildSpec, v verification) error {
+	_, err := privsepCall(privsepRequest{Op: "verification", BuildSpec: &bs, Verification: &v})
+	return err
+}
+
+// Have the privileged process remove idle extracted modules from the module
+// cache, see pruneModules.
+func privsepPruneModules() (int, error) {
+	resp, err := privsepCall(privsepRequest{Op: "prunemodules"})
+	return resp.Pruned, err
+}
+
+// Check that tmpdir is a directory in the staging dir, as made by the frontend.
+func checkStagingPath(tmpdir, prefix string) error {
+	if filepath.Dir(tmpdir) != filepath.Clean(stagingDir()) || !strings.HasPrefix(filepath.Base(tmpdir), prefix) {
+		return fmt.Errorf("path %q not in staging directory", tmpdir)
+	}
+	return nil
+}
+
+// Listener for name, passed by the privileged process to the frontend.
+func privsepListener(name string) net.Listener {
+	for i, n := range strings.Split(os.Getenv("GOBUILD_PRIVSEP"), ",") {
+		if n != name {
+			continue
+		}
+		f := os.NewFile(uintptr(3+i), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("listener %s from privileged process: %v", name, err)
+		}
+		return ln
+	}
+	log.Fatalf("no listener %s from privileged process", name)
+	return nil
+}
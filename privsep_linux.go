@@ -0,0 +1,647 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+type privsepUser struct {
+	uid, gid int
+}
+
+func lookupPrivsepUser(name string) privsepUser {
+	u, err := user.Lookup(name)
+	if err != nil {
+		log.Fatalf("looking up user: %v", err)
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		log.Fatalf("parsing uid of user %q: %v", name, err)
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		log.Fatalf("parsing gid of user %q: %v", name, err)
+	}
+	return privsepUser{uid, gid}
+}
+
+// Run the privileged process. It prepares the directories, opens the
+// transparency log and the listeners, starts the frontend as ServeUser, and
+// handles its requests until it stops.
+func privsepRoot(listenHTTP, listenAdmin string) {
+	if os.Getuid() != 0 {
+		log.Fatalf("privilege separation requires starting as root")
+	}
+	if config.BuildGobin {
+		log.Fatalf("BuildGobin is not supported with PrivSep")
+	}
+	serveUser := lookupPrivsepUser(config.PrivSep.ServeUser)
+	buildUser := lookupPrivsepUser(config.PrivSep.BuildUser)
+	if serveUser.uid == 0 || buildUser.uid == 0 || serveUser.uid == buildUser.uid {
+		log.Fatalf("ServeUser and BuildUser must be different users, other than root")
+	}
+
+	// Go commands create group-writable files, so the frontend can remove binaries
+	// and module caches of builds from HomeDir.
+	syscall.Umask(0o002)
+
+	initBuildDirs()
+	initResultDirs()
+	if err := privsepPrepareDirs(serveUser, buildUser); err != nil {
+		log.Fatalf("preparing directories: %v", err)
+	}
+
+	var err error
+	sums, err = openFileStore(filepath.Join(config.DataDir, "sum"))
+	if err != nil {
+		log.Fatalf("opening transparency log: %v", err)
+	}
+	if _, err := verifySumState(); err != nil {
+		log.Fatal(err)
+	}
+	if config.LogDir != "" {
+		// LogDir is owned by ServeUser, don't follow a symlink it may have made.
+		sumLogFile, err = os.OpenFile(filepath.Join(config.LogDir, "sum.log"), os.O_CREATE|os.O_APPEND|os.O_WRONLY|syscall.O_NOFOLLOW, 0644)
+		if err != nil {
+			log.Fatalf("open sum.log: %v", err)
+		}
+	} else {
+		sumLogFile = os.Stderr
+	}
+	removeLeftovers(resultDir, "tmpresult*", "tmpfail*")
+	if config.Retention != nil {
+		go retainBinaries()
+	}
+
+	// We listen as root, so privileged ports can be used. The listeners are passed
+	// to the frontend.
+	var names []string
+	var files []*os.File
+	addListener := func(name, addr string) {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Fatalf("listen: %v", err)
+		}
+		f, err := ln.(*net.TCPListener).File()
+		if err != nil {
+			log.Fatalf("listener file: %v", err)
+		}
+		ln.Close()
+		names = append(names, name)
+		files = append(files, f)
+	}
+	if listenHTTP != "" {
+		addListener("http", listenHTTP)
+	}
+	if config.HTTPS != nil {
+		addListener("https", ":443")
+	}
+	if listenAdmin != "" {
+		addListener("admin", listenAdmin)
+	}
+
+	sockPath := privsepSocketPath()
+	os.Remove(sockPath)
+	sockListener, err := net.Listen("unix", sockPath)
+	if err != nil {
+		log.Fatalf("listen on privsep socket: %v", err)
+	}
+	if err := os.Chown(sockPath, serveUser.uid, serveUser.gid); err != nil {
+		log.Fatalf("chown privsep socket: %v", err)
+	} else if err := os.Chmod(sockPath, 0600); err != nil {
+		log.Fatalf("chmod privsep socket: %v", err)
+	}
+
+	cmd := exec.Command("/proc/self/exe")
+	cmd.Args = os.Args
+	cmd.Env = append(os.Environ(), "GOBUILD_PRIVSEP="+strings.Join(names, ","))
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: uint32(serveUser.uid), Gid: uint32(serveUser.gid)},
+		Pdeathsig:  syscall.SIGKILL,
+	}
+	if err := cmd.Start(); err != nil {
+		log.Fatalf("starting frontend: %v", err)
+	}
+	for _, f := range files {
+		f.Close()
+	}
+
+	// When shutting down, make sure no modifications to transparency log are in progress.
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigc
+		addSumMutex.Lock()
+		cmd.Process.Signal(syscall.SIGTERM)
+		log.Fatal("shutdown after sigint or sigterm")
+	}()
+
+	go func() {
+		for {
+			conn, err := sockListener.Accept()
+			if err != nil {
+				log.Fatalf("accept on privsep socket: %v", err)
+			}
+			go privsepServeConn(conn.(*net.UnixConn), serveUser, buildUser)
+		}
+	}()
+
+	err = cmd.Wait()
+	log.Fatalf("frontend stopped: %v", err)
+}
+
+// Set ownership and permissions. Only root can write the transparency log and
+// results. The frontend can write the other files in the data directory, but
+// cannot remove the transparency log and results because of the sticky bit.
+// HomeDir is for go commands.
+func privsepPrepareDirs(serveUser, buildUser privsepUser) error {
+	for _, dir := range []string{config.DataDir, stagingDir()} {
+		if err := os.MkdirAll(dir, 0770); err != nil {
+			return err
+		} else if err := os.Chown(dir, 0, serveUser.gid); err != nil {
+			return err
+		} else if err := os.Chmod(dir, os.ModeSticky|0770); err != nil {
+			return err
+		}
+	}
+	entries, err := os.ReadDir(config.DataDir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		p := filepath.Join(config.DataDir, e.Name())
+		switch e.Name() {
+		case "sum", "result":
+			err = chownTree(p, 0, 0)
+		case "staging", "privsep.sock":
+		default:
+			err = chownTree(p, serveUser.uid, serveUser.gid)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	gopkg := filepath.Join(homedir, "go", "pkg")
+	gobin := filepath.Join(homedir, "go", "bin")
+	modcaches := buildModcachesDir()
+	for _, dir := range []string{gopkg, filepath.Join(homedir, ".cache"), gobin, modcaches} {
+		if err := os.MkdirAll(dir, 0775); err != nil {
+			return err
+		}
+	}
+	if err := chownTree(homedir, buildUser.uid, buildUser.gid); err != nil {
+		return err
+	}
+	// The frontend removes binaries and module caches after a build, and corrupt
+	// downloads from the module cache. Files and directories created by go commands
+	// get the group of the directory.
+	if err := chownTree(gopkg, buildUser.uid, serveUser.gid); err != nil {
+		return err
+	}
+	for _, dir := range []string{gopkg, gobin, modcaches} {
+		if err := os.Chown(dir, buildUser.uid, serveUser.gid); err != nil {
+			return err
+		} else if err := os.Chmod(dir, os.ModeSetgid|0775); err != nil {
+			return err
+		}
+	}
+
+	// The frontend installs SDKs, writes logs and stores certificates.
+	dirs := []string{config.SDKDir}
+	if config.LogDir != "" {
+		dirs = append(dirs, config.LogDir)
+	}
+	if config.HTTPS != nil {
+		dirs = append(dirs, config.HTTPS.ACME.CertDir)
+	}
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		} else if err := chownTree(dir, serveUser.uid, serveUser.gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Change owner of all files in dir, if dir isn't owned by uid and gid already.
+func chownTree(dir string, uid, gid int) error {
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && int(st.Uid) == uid && int(st.Gid) == gid {
+		return nil
+	}
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(p, uid, gid)
+	})
+}
+
+// Handle a request from the frontend, or from a privsep-exec helper it started.
+func privsepServeConn(conn *net.UnixConn, serveUser, buildUser privsepUser) {
+	defer conn.Close()
+
+	if uid, err := peerUID(conn); err != nil {
+		log.Printf("privsep: peer credentials: %v", err)
+		return
+	} else if uid != serveUser.uid {
+		log.Printf("privsep: connection from uid %d, not ServeUser", uid)
+		return
+	}
+
+	buf := make([]byte, 1)
+	oob := make([]byte, syscall.CmsgSpace(8*4))
+	_, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		log.Printf("privsep: reading request: %v", err)
+		return
+	}
+	files, err := receiveFiles(oob[:oobn])
+	if err != nil {
+		log.Printf("privsep: receiving files: %v", err)
+		return
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	var req privsepRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		log.Printf("privsep: parsing request: %v", err)
+		return
+	}
+
+	var resp privsepResponse
+	switch req.Op {
+	case "addsum":
+		if req.BuildResult == nil {
+			err = fmt.Errorf("missing build result")
+		} else {
+			resp.RecordNumber, err = privsepStoreResult(req.Tmpdir, *req.BuildResult)
+		}
+	case "restore":
+		if req.BuildResult == nil {
+			err = fmt.Errorf("missing build result")
+		} else {
+			err = privsepStoreRestored(req.Tmpdir, req.BuildResult.buildSpec)
+		}
+	case "failure":
+		if req.BuildSpec == nil {
+			err = fmt.Errorf("missing build spec")
+		} else {
+			err = saveFailure(*req.BuildSpec, req.Output)
+		}
+	case "verification":
+		if req.BuildSpec == nil || req.Verification == nil {
+			err = fmt.Errorf("missing build spec or verification")
+		} else if _, err = os.Stat(filepath.Join(req.BuildSpec.storeDir(), "recordnumber")); err == nil {
+			err = writeVerification(req.BuildSpec.storeDir(), *req.Verification)
+		}
+	case "prunemodules":
+		if config.Cleanup == nil || config.Cleanup.ModuleIdleHours <= 0 {
+			err = fmt.Errorf("pruning modules not configured")
+		} else {
+			resp.Pruned, err = pruneModules(time.Now())
+		}
+	case "exec":
+		if req.Exec == nil {
+			err = fmt.Errorf("missing command")
+		} else if config.Sandbox == nil {
+			resp.ExitCode, err = privsepRunExec(conn, *req.Exec, files, buildUser)
+		} else if x, xerr := privsepSandboxExec(*req.Exec); xerr != nil {
+			err = xerr
+		} else {
+			resp.ExitCode, err = privsepRunExec(conn, x, files, buildUser)
+		}
+	default:
+		err = fmt.Errorf("unknown operation %q", req.Op)
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		log.Printf("privsep: writing response: %v", err)
+	}
+}
+
+func peerUID(conn *net.UnixConn) (int, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+	var cred *syscall.Ucred
+	var cerr error
+	if err := rc.Control(func(fd uintptr) {
+		cred, cerr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return -1, err
+	} else if cerr != nil {
+		return -1, cerr
+	}
+	return int(cred.Uid), nil
+}
+
+func receiveFiles(oob []byte) ([]*os.File, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	var files []*os.File
+	for _, m := range msgs {
+		fds, err := syscall.ParseUnixRights(&m)
+		if err != nil {
+			return nil, err
+		}
+		for _, fd := range fds {
+			syscall.CloseOnExec(fd)
+			files = append(files, os.NewFile(uintptr(fd), "privsep"))
+		}
+	}
+	return files, nil
+}
+
+// Copy the files of a successful build from the staging directory, check the
+// binary matches the build result, and add it to the transparency log.
+func privsepStoreResult(stagedir string, br buildResult) (int64, error) {
+	if err := checkStagingPath(stagedir, "tmpresult"); err != nil {
+		return -1, err
+	}
+	defer os.RemoveAll(stagedir)
+
+	// The staged directory is owned by the frontend. Don't follow symlinks.
+	dirfd, err := syscall.Open(stagedir, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, fmt.Errorf("open staged directory: %v", err)
+	}
+	defer syscall.Close(dirfd)
+
+	tmpdir, err := os.MkdirTemp(resultDir, "tmpresult")
+	if err != nil {
+		return -1, err
+	}
+	defer func() {
+		if tmpdir != "" {
+			os.RemoveAll(tmpdir)
+		}
+	}()
+	// Readable for the frontend.
+	if err := os.Chmod(tmpdir, 0755); err != nil {
+		return -1, err
+	}
+
+	for _, name := range []string{"binary.gz", "log.gz", "options.txt", "verifiers.json"} {
+		optional := name == "options.txt" || name == "verifiers.json"
+		if err := copyStagedFile(dirfd, name, filepath.Join(tmpdir, name)); err != nil && !(optional && errors.Is(err, fs.ErrNotExist)) {
+			return -1, fmt.Errorf("copying %s: %w", name, err)
+		}
+	}
+	sum, size, err := sumGzipFile(filepath.Join(tmpdir, "binary.gz"))
+	if err != nil {
+		return -1, err
+	}
+	if sum != br.Sum || size != br.Filesize {
+		return -1, fmt.Errorf("binary has sum %s and size %d, build result has %s and %d", sum, size, br.Sum, br.Filesize)
+	}
+
+	recordNumber, err := addSum(tmpdir, br)
+	if err != nil {
+		return -1, err
+	}
+	tmpdir = ""
+	return recordNumber, nil
+}
+
+// Copy a rebuilt binary from the staging directory to the build directory, if it
+// matches the record in the transparency log.
+func privsepStoreRestored(stagedir string, bs buildSpec) error {
+	if err := checkStagingPath(stagedir, "tmpresult"); err != nil {
+		return err
+	}
+	defer os.RemoveAll(stagedir)
+
+	_, logged, _, err := serverOps{}.lookupResult(context.Background(), bs)
+	if err != nil {
+		return err
+	} else if logged == nil {
+		return fmt.Errorf("no record for build")
+	}
+
+	dirfd, err := syscall.Open(stagedir, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("open staged directory: %v", err)
+	}
+	defer syscall.Close(dirfd)
+
+	tmp := filepath.Join(bs.storeDir(), "binary.gz.tmp")
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	if err := copyStagedFile(dirfd, "binary.gz", tmp); err != nil {
+		return fmt.Errorf("copying binary.gz: %w", err)
+	}
+	return storeRestoredBinary(tmp, *logged)
+}
+
+// Copy regular file name in directory dirfd to dst.
+func copyStagedFile(dirfd int, name, dst string) error {
+	fd, err := syscall.Openat(dirfd, name, syscall.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	sf := os.NewFile(uintptr(fd), name)
+	defer sf.Close()
+	if fi, err := sf.Stat(); err != nil {
+		return err
+	} else if !fi.Mode().IsRegular() {
+		return fmt.Errorf("not a regular file")
+	}
+	df, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(df, sf); err != nil {
+		df.Close()
+		return err
+	}
+	return df.Close()
+}
+
+// Make the sandbox helper command for a command from the frontend. We don't let
+// the frontend run commands outside the sandbox, or choose the mounts and limits
+// of the sandbox: only the command to run in it is taken from the frontend, the
+// remainder of the sandbox spec comes from our config.
+func privsepSandboxExec(x privsepExec) (privsepExec, error) {
+	if !x.Sandbox || len(x.Args) != 3 || x.Args[1] != "sandbox-exec" {
+		return privsepExec{}, fmt.Errorf("command without sandbox refused, sandbox is required by config")
+	}
+	var fspec sandboxSpec
+	if err := json.Unmarshal([]byte(x.Args[2]), &fspec); err != nil {
+		return privsepExec{}, fmt.Errorf("parsing sandbox spec: %v", err)
+	}
+	// BuildGobin is not supported with PrivSep, no GOBUILD_GOBIN mount. Forwarded
+	// addresses are dialed by the frontend, so they are taken from its spec.
+	spec := sandboxSpec{
+		Root:        emptyDir,
+		Mounts:      sandboxMounts(fspec.Network, nil),
+		Dir:         fspec.Dir,
+		Argv:        fspec.Argv,
+		Env:         fspec.Env,
+		Network:     fspec.Network,
+		Forward:     fspec.Forward,
+		MaxFileSize: config.Sandbox.MaxFileSize,
+		MaxCPUTime:  config.Sandbox.MaxCPUTime,
+		MaxMemory:   config.Sandbox.MaxMemory,
+		Probe:       fspec.Probe,
+	}
+	buf, err := json.Marshal(spec)
+	if err != nil {
+		return privsepExec{}, fmt.Errorf("marshal sandbox spec: %v", err)
+	}
+	x.Path = "/proc/self/exe"
+	x.Args = []string{"gobuild", "sandbox-exec", string(buf)}
+	x.Dir = "/"
+	return x, nil
+}
+
+// Run a command as BuildUser, with the files passed by the privsep-exec helper.
+// The command is killed when the helper goes away. Returns the exit code.
+func privsepRunExec(conn *net.UnixConn, x privsepExec, files []*os.File, buildUser privsepUser) (int, error) {
+	if len(files) != 3+x.ExtraFiles {
+		return -1, fmt.Errorf("got %d files, expected %d", len(files), 3+x.ExtraFiles)
+	}
+	cmd := &exec.Cmd{
+		Path:       x.Path,
+		Args:       x.Args,
+		Env:        x.Env,
+		Dir:        x.Dir,
+		Stdin:      files[0],
+		Stdout:     files[1],
+		Stderr:     files[2],
+		ExtraFiles: files[3:],
+	}
+	if x.Sandbox {
+		// Root in the user namespace of the sandbox is BuildUser. The credentials
+		// are set in the user namespace, clearing our supplementary groups.
+		cmd.SysProcAttr = sandboxSysProcAttr(buildUser.uid, buildUser.gid)
+		cmd.SysProcAttr.GidMappingsEnableSetgroups = true
+		cmd.SysProcAttr.Credential = &syscall.Credential{}
+	} else {
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Credential: &syscall.Credential{Uid: uint32(buildUser.uid), Gid: uint32(buildUser.gid)},
+			Pdeathsig:  syscall.SIGKILL,
+		}
+	}
+	// Without sandbox, the processes started by the command are only killed with
+	// its process group. The sandbox has its own pid namespace.
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return -1, err
+	}
+	// Close our copies, so the frontend notices when the command is done writing.
+	for _, f := range files {
+		f.Close()
+	}
+
+	go func() {
+		// The helper doesn't write anything more, we get an error when it is gone.
+		conn.Read(make([]byte, 1))
+		killCommand(cmd)
+	}()
+
+	err := cmd.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			return 128 + int(ws.Signal()), nil
+		}
+		return exitErr.ExitCode(), nil
+	}
+	return 0, err
+}
+
+// Make a command that has the privileged process run cmd as BuildUser, through
+// the privsep-exec helper.
+func privsepCommand(cmd *exec.Cmd) *exec.Cmd {
+	if cmd.Err != nil {
+		return cmd
+	}
+	x := privsepExec{
+		Path:       cmd.Path,
+		Args:       cmd.Args,
+		Env:        cmd.Env,
+		Dir:        cmd.Dir,
+		Sandbox:    cmd.SysProcAttr != nil && cmd.SysProcAttr.Cloneflags != 0,
+		ExtraFiles: len(cmd.ExtraFiles),
+	}
+	pcmd := exec.Command("/proc/self/exe")
+	buf, err := json.Marshal(x)
+	if err != nil {
+		pcmd.Err = fmt.Errorf("marshal command: %v", err)
+		return pcmd
+	}
+	pcmd.Args = []string{"gobuild", "privsep-exec", privsepSocketPath(), string(buf)}
+	pcmd.Dir = "/"
+	pcmd.ExtraFiles = cmd.ExtraFiles
+	return pcmd
+}
+
+// Helper started by the frontend for a command. It passes its standard files and
+// extra files to the privileged process, which starts the command as BuildUser.
+// Exits with the status of the command.
+func privsepExecClient(args []string) {
+	log.SetPrefix("privsep-exec: ")
+	if len(args) != 2 {
+		log.Fatalf("missing socket or command")
+	}
+	var x privsepExec
+	if err := json.Unmarshal([]byte(args[1]), &x); err != nil {
+		log.Fatalf("parsing command: %v", err)
+	}
+	c, err := net.Dial("unix", args[0])
+	if err != nil {
+		log.Fatalf("connecting to privileged process: %v", err)
+	}
+	conn := c.(*net.UnixConn)
+	fds := []int{0, 1, 2}
+	for i := 0; i < x.ExtraFiles; i++ {
+		fds = append(fds, 3+i)
+	}
+	if _, _, err := conn.WriteMsgUnix([]byte{0}, syscall.UnixRights(fds...), nil); err != nil {
+		log.Fatalf("passing files: %v", err)
+	}
+	if err := json.NewEncoder(conn).Encode(privsepRequest{Op: "exec", Exec: &x}); err != nil {
+		log.Fatalf("writing request: %v", err)
+	}
+	var resp privsepResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		log.Fatalf("reading response: %v", err)
+	}
+	if resp.Error != "" {
+		log.Fatalf("running command: %s", resp.Error)
+	}
+	os.Exit(resp.ExitCode)
+}
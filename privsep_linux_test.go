@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// The frontend only chooses the command to run in the sandbox, not the mounts and
+// limits.
+func TestPrivsepSandboxExec(t *testing.T) {
+	origConfig, origHomedir, origEmptyDir := config, homedir, emptyDir
+	defer func() {
+		config, homedir, emptyDir = origConfig, origHomedir, origEmptyDir
+	}()
+	homedir = t.TempDir()
+	emptyDir = homedir + "/tmp"
+	config.SDKDir = t.TempDir()
+	if err := json.Unmarshal([]byte(`{"Sandbox": {"MaxMemory": 100}}`), &config); err != nil {
+		t.Fatalf("config: %v", err)
+	}
+
+	if _, err := privsepSandboxExec(privsepExec{Path: "/bin/sh", Args: []string{"sh", "-c", "id"}}); err == nil {
+		t.Fatalf("command without sandbox allowed")
+	}
+	if _, err := privsepSandboxExec(privsepExec{Path: "/bin/sh", Args: []string{"sh", "sandbox-exec", "{}"}, Sandbox: true}); err != nil {
+		t.Fatalf("sandbox command: %v", err)
+	}
+
+	fspec := sandboxSpec{
+		Root:    "/",
+		Mounts:  []sandboxMount{{"/", "/", true, false}},
+		Dir:     "/src",
+		Argv:    []string{"/usr/bin/go", "build"},
+		Env:     []string{"GOBUILD_GOBIN=/"},
+		Network: true,
+		Forward: []string{"127.0.0.1:1234"},
+	}
+	buf, err := json.Marshal(fspec)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	x, err := privsepSandboxExec(privsepExec{Path: "/bin/sh", Args: []string{"gobuild", "sandbox-exec", string(buf)}, Sandbox: true, ExtraFiles: 1})
+	if err != nil {
+		t.Fatalf("sandbox command: %v", err)
+	}
+	if x.Path != "/proc/self/exe" || len(x.Args) != 3 || x.Args[1] != "sandbox-exec" || x.ExtraFiles != 1 {
+		t.Fatalf("got command %s %v, expected sandbox helper", x.Path, x.Args)
+	}
+	var spec sandboxSpec
+	if err := json.Unmarshal([]byte(x.Args[2]), &spec); err != nil {
+		t.Fatalf("parsing spec: %v", err)
+	}
+	if spec.Root != emptyDir || spec.MaxMemory != 100 {
+		t.Fatalf("got root %q, max memory %d, expected from config", spec.Root, spec.MaxMemory)
+	}
+	for _, m := range spec.Mounts {
+		if m.Source == "/" {
+			t.Fatalf("mount of / from frontend spec")
+		}
+	}
+	if spec.Dir != fspec.Dir || len(spec.Argv) != 2 || !spec.Network || len(spec.Forward) != 1 {
+		t.Fatalf("got spec %#v, expected command from frontend spec", spec)
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"log"
+	"os/exec"
+)
+
+func privsepRoot(listenHTTP, listenAdmin string) {
+	log.Fatalf("privilege separation only supported on linux")
+}
+
+func privsepCommand(cmd *exec.Cmd) *exec.Cmd {
+	pcmd := exec.Command("gobuild")
+	pcmd.Err = errors.New("privilege separation only supported on linux")
+	return pcmd
+}
+
+func privsepExecClient(args []string) {
+	log.Fatalf("privilege separation only supported on linux")
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// When builds don't match, we keep our binary and the binaries of the others in
+// data/quarantine/<id>/, for diagnosing reproducibility problems through the
+// report page on the admin listener.
+
+// quarantineInfo is stored as info.json in the quarantine directory.
+type quarantineInfo struct {
+	Time     time.Time
+	Key      string
+	Reason   string // "verify", "verify-async", "follow" or "restore".
+	Binaries []quarantineBinary
+}
+
+type quarantineBinary struct {
+	Name  string // "ours", or the base URL of the other gobuild instance.
+	File  string // Gzipped binary in the quarantine directory. Empty if not available.
+	Sum   string // Sum reported for the binary.
+	Error string `json:",omitempty"` // If downloading failed.
+}
+
+// Other gobuild instance with a different build result.
+type quarantineRemote struct {
+	BaseURL string
+	Sum     string
+}
+
+func quarantineDir() string {
+	return filepath.Join(config.DataDir, "quarantine")
+}
+
+// Quarantine our binary, read from src (uncompressed), and download the binaries
+// of the remotes in the background. Errors are logged, they don't change the
+// outcome of the build.
+func quarantine(reason string, br buildResult, src io.Reader, remotes []quarantineRemote) {
+	if err := os.MkdirAll(quarantineDir(), 0777); err != nil {
+		log.Printf("quarantine: making directory: %v", err)
+		return
+	}
+	dir, err := os.MkdirTemp(quarantineDir(), time.Now().UTC().Format("20060102-150405")+"-")
+	if err != nil {
+		log.Printf("quarantine: making directory: %v", err)
+		return
+	}
+	info := quarantineInfo{
+		Time:     time.Now(),
+		Key:      br.String(),
+		Reason:   reason,
+		Binaries: []quarantineBinary{{"ours", "ours.gz", br.Sum, ""}},
+	}
+	if err := writeGz(filepath.Join(dir, "ours.gz"), src); err != nil {
+		info.Binaries[0].File = ""
+		info.Binaries[0].Error = fmt.Sprintf("storing binary: %v", err)
+	}
+	for _, r := range remotes {
+		info.Binaries = append(info.Binaries, quarantineBinary{r.BaseURL, "", r.Sum, "downloading"})
+	}
+	if err := writeQuarantineInfo(dir, info); err != nil {
+		log.Printf("quarantine: %v", err)
+		return
+	}
+	log.Printf("quarantined binaries for %s in %s", br.String(), dir)
+	metricQuarantined.WithLabelValues(reason).Inc()
+
+	go func() {
+		for i, r := range remotes {
+			qb := &info.Binaries[1+i]
+			qb.Error = ""
+			file := fmt.Sprintf("remote-%d.gz", i)
+			if err := downloadRemoteBinary(filepath.Join(dir, file), r.BaseURL, br.buildSpec, r.Sum); err != nil {
+				qb.Error = err.Error()
+			} else {
+				qb.File = file
+			}
+		}
+		if err := writeQuarantineInfo(dir, info); err != nil {
+			log.Printf("quarantine: %v", err)
+		}
+	}()
+}
+
+// Quarantine the binary of a published build, with the results of others.
+func quarantineStored(reason string, br buildResult, remotes []quarantineRemote) {
+	rc, err := blobs.open(br.storeKey() + "/binary.gz")
+	if err != nil {
+		log.Printf("quarantine: reading binary: %v", err)
+		return
+	}
+	defer rc.Close()
+	data, err := readGzip(rc)
+	if err != nil {
+		log.Printf("quarantine: reading binary: %v", err)
+		return
+	}
+	quarantine(reason, br, bytes.NewReader(data), remotes)
+}
+
+func writeQuarantineInfo(dir string, info quarantineInfo) error {
+	buf, err := json.MarshalIndent(info, "", "\t")
+	if err != nil {
+		return fmt.Errorf("marshal quarantine info: %v", err)
+	}
+	p := filepath.Join(dir, "info.json")
+	if err := os.WriteFile(p+".tmp", buf, 0666); err != nil {
+		return fmt.Errorf("writing quarantine info: %v", err)
+	}
+	if err := os.Rename(p+".tmp", p); err != nil {
+		return fmt.Errorf("writing quarantine info: %v", err)
+	}
+	return nil
+}
+
+func readQuarantineInfo(dir string) (quarantineInfo, error) {
+	var info quarantineInfo
+	buf, err := os.ReadFile(filepath.Join(dir, "info.json"))
+	if err != nil {
+		return info, err
+	}
+	err = json.Unmarshal(buf, &info)
+	return info, err
+}
+
+// Download the binary of a build at another gobuild instance to p (gzipped),
+// checking it has the sum.
+func downloadRemoteBinary(p, baseURL string, bs buildSpec, sum string) error {
+	u := baseURL + request{bs, sum, pageDownload}.link()
+	resp, err := httpGet(u)
+	if err != nil {
+		return fmt.Errorf("downloading %s: %v", u, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("downloading %s: %s", u, resp.Status)
+	}
+	h := sha256.New()
+	if err := writeGz(p, io.TeeReader(resp.Body, h)); err != nil {
+		os.Remove(p)
+		return fmt.Errorf("downloading %s: %v", u, err)
+	}
+	if xsum := "0" + base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:20]); xsum != sum {
+		os.Remove(p)
+		return fmt.Errorf("downloaded binary has sum %s, expected %s", xsum, sum)
+	}
+	return nil
+}
+
+// Serve list of quarantined builds at /quarantine/, and a report comparing the
+// binaries at /quarantine/<id>/, on the admin listener.
+func serveQuarantine(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/quarantine/"), "/")
+	if id == "" {
+		serveQuarantineList(w, r)
+		return
+	}
+	if strings.Contains(id, "/") || strings.HasPrefix(id, ".") || !strings.HasSuffix(r.URL.Path, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	dir := filepath.Join(quarantineDir(), id)
+	info, err := readQuarantineInfo(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+		} else {
+			http.Error(w, "500 - Server Error - "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	var analyses []binaryAnalysis
+	for _, qb := range info.Binaries {
+		if qb.File == "" {
+			analyses = append(analyses, binaryAnalysis{Error: "binary not available"})
+			continue
+		}
+		data, err := readGzipFile(filepath.Join(dir, qb.File))
+		if err != nil {
+			analyses = append(analyses, binaryAnalysis{Error: err.Error()})
+			continue
+		}
+		analyses = append(analyses, analyzeBinary(data))
+	}
+
+	args := map[string]interface{}{
+		"ID":     id,
+		"Info":   info,
+		"Report": compareBinaries(analyses),
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := quarantineTemplate.Execute(w, args); err != nil {
+		log.Printf("executing quarantine template: %v", err)
+	}
+}
+
+func serveQuarantineList(w http.ResponseWriter, r *http.Request) {
+	type entry struct {
+		ID   string
+		Info quarantineInfo
+	}
+	var entries []entry
+	l, err := os.ReadDir(quarantineDir())
+	if err != nil && !os.IsNotExist(err) {
+		http.Error(w, "500 - Server Error - "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, e := range l {
+		if !e.IsDir() {
+			continue
+		}
+		info, err := readQuarantineInfo(filepath.Join(quarantineDir(), e.Name()))
+		if err != nil {
+			log.Printf("quarantine: reading info for %s: %v", e.Name(), err)
+			continue
+		}
+		entries = append(entries, entry{e.Name(), info})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ID > entries[j].ID
+	})
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := quarantineTemplate.Execute(w, map[string]interface{}{"IsList": true, "List": entries}); err != nil {
+		log.Printf("executing quarantine template: %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The coordinator stores its queued and in-progress builds in data/queue.json
+// after each change, so they can be resumed after a restart.
+
+// queuedBuild is a build waiting for its turn, or in progress.
+type queuedBuild struct {
+	buildSpec
+	Queued   time.Time
+	Building bool
+	Client   string
+	Priority bool
+}
+
+// Last written queue, for the admin page.
+var queueState = struct {
+	sync.Mutex
+	l []queuedBuild
+}{}
+
+func queuePath() string {
+	return filepath.Join(config.DataDir, "queue.json")
+}
+
+// Store the queue, called by the coordinator.
+func writeQueue(l []queuedBuild) {
+	queueState.Lock()
+	queueState.l = l
+	queueState.Unlock()
+
+	buf, err := json.Marshal(l)
+	if err != nil {
+		log.Printf("marshal queue: %v", err)
+		return
+	}
+	p := queuePath()
+	if err := os.WriteFile(p+".tmp", buf, 0666); err != nil {
+		log.Printf("writing queue: %v", err)
+	} else if err := os.Rename(p+".tmp", p); err != nil {
+		log.Printf("writing queue: %v", err)
+	}
+}
+
+// Read the queue stored before a restart. Builds that were in progress are
+// returned first, they must be started again. Leftovers of those builds in the
+// result directory are removed.
+func readQueue() []queuedBuild {
+	buf, err := os.ReadFile(queuePath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("reading queue: %v", err)
+		}
+		return nil
+	}
+	var l []queuedBuild
+	if err := json.Unmarshal(buf, &l); err != nil {
+		log.Printf("parsing queue: %v", err)
+		return nil
+	}
+
+	removeLeftovers(stagingDir(), "tmpresult*", "tmpfail*", "tmpworker*")
+
+	var building, queued []queuedBuild
+	for _, qb := range l {
+		if qb.Building {
+			qb.Building = false
+			building = append(building, qb)
+		} else {
+			queued = append(queued, qb)
+		}
+	}
+	return append(building, queued...)
+}
+
+// Serve the queue read-only on the admin listener.
+func serveQueue(w http.ResponseWriter, r *http.Request) {
+	queueState.Lock()
+	l := queueState.l
+	queueState.Unlock()
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := queueTemplate.Execute(w, map[string]interface{}{"Queue": l, "Workers": workerList()}); err != nil {
+		log.Printf("executing queue template: %v", err)
+	}
+}
+
+// Remove leftover temporary files of interrupted builds from dir.
+func removeLeftovers(dir string, patterns ...string) {
+	for _, pattern := range patterns {
+		matches, _ := filepath.Glob(filepath.Join(dir, pattern))
+		for _, p := range matches {
+			if err := os.RemoveAll(p); err != nil {
+				log.Printf("removing leftover of interrupted build: %v", err)
+			}
+		}
+	}
+}
@@ -9,7 +9,7 @@ import (
 // It reads the 1000 most recent records, marks them in targets.use, then sorts the targets.
 // It keeps the last 10 builds in memory, for display on the front page.
 func readRecentBuilds() {
-	n, err := treeSize()
+	n, err := sums.treeSize()
 	if err != nil {
 		log.Fatalf("getting sum tree size: %v", err)
 	}
@@ -50,7 +50,7 @@ type request struct {
 
 // Path in URL for this request, for linking to other pages.
 func (r request) link() string {
-	s := fmt.Sprintf("/%s@%s/%s%s-%s-%s/", r.Mod, r.Version, r.appendDir(), r.Goos, r.Goarch, r.Goversion)
+	s := fmt.Sprintf("/%s@%s/%s%s/", r.Mod, r.Version, r.appendDir(), r.targetElem())
 	if r.Sum != "" {
 		s += r.Sum + "/"
 	}
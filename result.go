@@ -1,13 +1,13 @@
 package main
 
 import (
+	"io"
 	"net/http"
-	"os"
-	"path/filepath"
+	"path"
 )
 
 func serveResult(w http.ResponseWriter, r *http.Request, req request) {
-	storeDir := req.storeDir()
+	key := req.storeKey() + "/binary.gz"
 
 	_, br, failed, err := serverOps{}.lookupResult(r.Context(), req.buildSpec)
 	if err != nil {
@@ -22,30 +22,12 @@ func serveResult(w http.ResponseWriter, r *http.Request, req request) {
 			failf(w, "preparing build: %w", err)
 			return
 		}
-
-		eventc := make(chan buildUpdate, 100)
-		registerBuild(req.buildSpec, eventc)
-		ctx := r.Context()
-
-	loop:
-		for {
-			select {
-			case <-ctx.Done():
-				unregisterBuild(req.buildSpec, eventc)
-				return
-			case update := <-eventc:
-				if !update.done {
-					continue
-				}
-				unregisterBuild(req.buildSpec, eventc)
-				if update.err != nil {
-					failf(w, "build failed: %w", update.err)
-					return
-				}
-				r := *update.result
-				br = &r
-				break loop
-			}
+		br, err = waitBuild(r, req.buildSpec, false)
+		if err != nil {
+			failf(w, "build failed: %w", err)
+			return
+		} else if br == nil {
+			return
 		}
 	}
 
@@ -54,24 +36,51 @@ func serveResult(w http.ResponseWriter, r *http.Request, req request) {
 		return
 	}
 
+	if req.Page == pageDownload || req.Page == pageDownloadGz {
+		if binaryRemoved(req.buildSpec) {
+			// Removed by retention, build again to restore it.
+			if err := prepareBuild(req.buildSpec); err != nil {
+				failf(w, "preparing build: %w", err)
+				return
+			}
+			if rbr, err := waitBuild(r, req.buildSpec, true); err != nil {
+				failf(w, "restoring binary: %w", err)
+				return
+			} else if rbr == nil {
+				return
+			}
+		}
+		markBinaryAccess(req.buildSpec)
+	}
+
 	switch req.Page {
 	case pageLog:
-		serveLog(w, r, filepath.Join(storeDir, "log.gz"))
+		serveLog(w, r, req.buildSpec)
 	case pageDownloadRedirect:
 		link := request{req.buildSpec, br.Sum, pageDownload}.link()
 		http.Redirect(w, r, link, http.StatusTemporaryRedirect)
 	case pageDownload:
-		p := filepath.Join(storeDir, "binary.gz")
-		f, err := os.Open(p)
+		f, err := blobs.open(key)
 		if err != nil {
 			failf(w, "%w: open binary: %v", errServer, err)
 			return
 		}
 		defer f.Close()
-		serveGzipFile(w, r, p, f)
+		serveGzipFile(w, r, "binary.gz", f)
 	case pageDownloadGz:
-		p := filepath.Join(storeDir, "binary.gz")
-		http.ServeFile(w, r, p)
+		if u, err := blobs.downloadURL(key, path.Base(r.URL.Path)); err != nil {
+			failf(w, "%w: url for binary: %v", errServer, err)
+		} else if u != "" {
+			http.Redirect(w, r, u, http.StatusTemporaryRedirect)
+		} else if ls, ok := blobs.(localStore); ok {
+			http.ServeFile(w, r, ls.path(key))
+		} else if f, err := blobs.open(key); err != nil {
+			failf(w, "%w: open binary: %v", errServer, err)
+		} else {
+			defer f.Close()
+			w.Header().Set("Content-Type", "application/gzip")
+			io.Copy(w, f) // nothing to do for errors
+		}
 	case pageRecord:
 		if msg, err := br.packRecord(); err != nil {
 			failf(w, "%w: packing record: %v", errServer, err)
@@ -85,3 +94,31 @@ func serveResult(w http.ResponseWriter, r *http.Request, req request) {
 		failf(w, "%w: unknown page %v", errServer, req.Page)
 	}
 }
+
+// Register interest in a build and wait until it is done. With restore, the build
+// is done again to restore its binary. The result is nil without error if the
+// request was canceled.
+func waitBuild(r *http.Request, bs buildSpec, restore bool) (*buildResult, error) {
+	eventc := make(chan buildUpdate, 100)
+	if restore {
+		registerRestore(bs, requestClient(r), eventc)
+	} else {
+		registerBuild(bs, requestClient(r), eventc)
+	}
+	defer unregisterBuild(bs, eventc)
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return nil, nil
+		case update := <-eventc:
+			if !update.done {
+				continue
+			}
+			if update.err != nil {
+				return nil, update.err
+			}
+			return update.result, nil
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// With config Retention, binaries of successful builds are removed from the
+// result directory when they haven't been downloaded for a while, are too old, or
+// don't fit in the size budget. The record in the transparency log, the build log
+// and the other files are kept. When a removed binary is downloaded, it is built
+// again, and only restored if it has the sum from the transparency log.
+
+// Last download of binaries, by name of the build directory in the result
+// directory. Kept by the process serving HTTP, and written to DataDir
+// periodically, for the process removing binaries.
+var binaryAccess = struct {
+	sync.Mutex
+	m     map[string]time.Time
+	dirty bool
+}{m: map[string]time.Time{}}
+
+func binaryAccessPath() string {
+	return filepath.Join(config.DataDir, "binaryaccess.json")
+}
+
+func readBinaryAccess() (map[string]time.Time, error) {
+	m := map[string]time.Time{}
+	buf, err := os.ReadFile(binaryAccessPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return m, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Register a download of the binary of a build.
+func markBinaryAccess(bs buildSpec) {
+	if config.Retention == nil {
+		return
+	}
+	binaryAccess.Lock()
+	defer binaryAccess.Unlock()
+	binaryAccess.m[path.Base(bs.storeKey())] = time.Now()
+	binaryAccess.dirty = true
+}
+
+// Write the download times of binaries every few minutes, merged with those
+// already written.
+func writeBinaryAccessLoop() {
+	if m, err := readBinaryAccess(); err != nil {
+		log.Printf("reading binary access times: %v", err)
+	} else {
+		binaryAccess.Lock()
+		for name, t := range m {
+			if t.After(binaryAccess.m[name]) {
+				binaryAccess.m[name] = t
+			}
+		}
+		binaryAccess.Unlock()
+	}
+
+	for {
+		time.Sleep(5 * time.Minute)
+		if err := writeBinaryAccess(); err != nil {
+			log.Printf("writing binary access times: %v", err)
+		}
+	}
+}
+
+func writeBinaryAccess() error {
+	binaryAccess.Lock()
+	if !binaryAccess.dirty {
+		binaryAccess.Unlock()
+		return nil
+	}
+	buf, err := json.Marshal(binaryAccess.m)
+	binaryAccess.dirty = false
+	binaryAccess.Unlock()
+	if err != nil {
+		return err
+	}
+	p := binaryAccessPath()
+	if err := os.WriteFile(p+".tmp", buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(p+".tmp", p)
+}
+
+// Whether the binary of a successful build was removed by retention.
+func binaryRemoved(bs buildSpec) bool {
+	_, err := blobs.stat(bs.storeKey() + "/binary.gz")
+	return errors.Is(err, fs.ErrNotExist)
+}
+
+// Remove binaries according to config Retention, every hour. Run by the process
+// writing the result directory.
+func retainBinaries() {
+	for {
+		if err := removeColdBinaries(time.Now()); err != nil {
+			log.Printf("removing binaries for retention: %v", err)
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+func removeColdBinaries(now time.Time) error {
+	access, err := readBinaryAccess()
+	if err != nil {
+		return fmt.Errorf("reading binary access times: %v", err)
+	}
+
+	type binary struct {
+		key  string
+		size int64
+		last time.Time // Last download, or when built.
+	}
+	var removed int
+	var freed int64
+	remove := func(b binary) {
+		if err := blobs.remove(b.key); err != nil {
+			log.Printf("removing binary for retention: %v", err)
+			return
+		}
+		removed++
+		freed += b.size
+		metricBinariesRemoved.Inc()
+	}
+
+	days := func(n int) time.Duration {
+		return time.Duration(n) * 24 * time.Hour
+	}
+	ret := config.Retention
+	var keep []binary
+	var total int64
+	err = blobs.list("binary.gz", func(key string, info blobInfo) {
+		// With a shared blob store, only consider binaries of builds in our own
+		// transparency log, we don't know about downloads of other instances.
+		if _, err := os.Stat(filepath.Join(resultDir, filepath.FromSlash(path.Dir(key)), "recordnumber")); err != nil {
+			return
+		}
+		b := binary{key, info.Size, info.Modified}
+		if t := access[path.Base(path.Dir(key))]; t.After(b.last) {
+			b.last = t
+		}
+		if ret.MaxAgeDays > 0 && now.Sub(info.Modified) > days(ret.MaxAgeDays) || ret.MaxIdleDays > 0 && now.Sub(b.last) > days(ret.MaxIdleDays) {
+			remove(b)
+		} else {
+			keep = append(keep, b)
+			total += b.size
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// Remove least recently downloaded binaries until we are within budget.
+	if max := int64(ret.MaxSizeMB) * 1024 * 1024; max > 0 && total > max {
+		sort.Slice(keep, func(i, j int) bool {
+			return keep[i].last.Before(keep[j].last)
+		})
+		for _, b := range keep {
+			if total <= max {
+				break
+			}
+			remove(b)
+			total -= b.size
+		}
+	}
+	if removed > 0 {
+		log.Printf("retention: removed %d binaries, %.1f MB", removed, float64(freed)/(1024*1024))
+	}
+	return nil
+}
+
+// Store the binary of a build again after it was removed by retention. The
+// rebuilt binary must be the same as in the transparency log. If not, it is
+// quarantined for diagnosis.
+func restoreBinary(logged, br buildResult, rf *os.File, tmpdir string) error {
+	if br.Sum != logged.Sum || br.Filesize != logged.Filesize {
+		metricBinaryRestoreMismatches.Inc()
+		quarantine("restore", br, rf, nil)
+		return fmt.Errorf("%w: rebuilt binary has sum %s and size %d, transparency log has %s and %d", errServer, br.Sum, br.Filesize, logged.Sum, logged.Filesize)
+	}
+	err := writeGz(filepath.Join(tmpdir, "binary.gz"), rf)
+	if err != nil {
+		return err
+	}
+	if privsepFrontend {
+		err = privsepRestoreBinary(tmpdir, br)
+	} else {
+		err = storeRestoredBinary(filepath.Join(tmpdir, "binary.gz"), logged)
+	}
+	if err == nil {
+		metricBinariesRestored.Inc()
+	}
+	return err
+}
+
+// Store the gzipped binary at src for the build, after checking it matches the
+// build result from the transparency log.
+func storeRestoredBinary(src string, logged buildResult) error {
+	sum, size, err := sumGzipFile(src)
+	if err != nil {
+		return err
+	}
+	if sum != logged.Sum || size != logged.Filesize {
+		return fmt.Errorf("binary has sum %s and size %d, transparency log has %s and %d", sum, size, logged.Sum, logged.Filesize)
+	}
+	return putBuildBlob(logged.storeKey()+"/binary.gz", src, logged)
+}
@@ -2,7 +2,8 @@
 set -e
 
 # This script uses bwrap (bubblewrap) to make the minimum selection of
-# paths available for writing to the go commands.
+# paths available for writing to the go commands. On Linux, the built-in
+# sandbox (config option Sandbox) is an alternative.
 # Modify the config file:
 # - Specify GOSDK= for Environment. Must be the directory containing the SDKs.
 # - Add script to Run.
@@ -16,6 +17,10 @@ fi
 if ! test -d "$HOME/.cache"; then
 	mkdir -p "$HOME/.cache"
 fi
+# Builds extract modules in their own module cache in this directory.
+if ! test -d "$HOME/modcache"; then
+	mkdir -p "$HOME/modcache"
+fi
 
 
 # Only "go get -d", "go mod download" and "go list" get access to the network.
@@ -68,10 +73,12 @@ exec /usr/bin/bwrap \
 	--unshare-pid \
 	--unshare-cgroup \
 	--unshare-uts \
+	--die-with-parent \
 	--hostname gobuilds.org \
 	--ro-bind $GOSDK $GOSDK \
 	--bind $HOME/.cache $HOME/.cache \
 	$gopkgbind $HOME/go/pkg $HOME/go/pkg \
+	--bind $HOME/modcache $HOME/modcache \
 	$gobinbind \
 	$net \
 	/usr/bin/nice \
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3Store keeps blobs in a bucket of an S3-compatible object storage service.
+// Requests use path-style URLs, and are signed with AWS signature version 4.
+// Only the few operations gobuild needs are implemented.
+type s3Store struct {
+	endpoint  *url.URL // Without trailing slash.
+	region    string
+	bucket    string
+	prefix    string
+	accessKey string
+	secretKey string
+	presign   bool
+}
+
+var _ blobStore = (*s3Store)(nil)
+
+// Presigned download URLs are valid for this long.
+const s3PresignExpires = time.Hour
+
+// A stalled endpoint must not hang downloads or the retention loop. The overall
+// timeout includes reading the body, so leaves room for large binaries.
+var s3Client = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: time.Minute,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConnsPerHost:   10,
+	},
+	Timeout: 10 * time.Minute,
+}
+
+func newS3Store() *s3Store {
+	c := config.S3
+	u, err := url.Parse(strings.TrimSuffix(c.Endpoint, "/"))
+	if err != nil {
+		log.Fatalf("parsing S3 endpoint: %v", err)
+	} else if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		log.Fatalf("S3 endpoint %q must be an http or https URL", c.Endpoint)
+	}
+	return &s3Store{u, c.Region, c.Bucket, c.Prefix, c.AccessKeyID, c.SecretAccessKey, c.PresignDownloads}
+}
+
+// URL for the object with key, or the bucket for an empty key.
+func (s *s3Store) url(key string) *url.URL {
+	u := *s.endpoint
+	u.Path += "/" + s.bucket + "/"
+	if key != "" {
+		u.Path += s.prefix + key
+	}
+	u.RawPath = s3Escape(u.Path, true)
+	return &u
+}
+
+// Escape s as for the canonical request of a signature: everything except
+// unreserved characters, and slashes for paths.
+func s3Escape(s string, isPath bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' || isPath && c == '/' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3CanonicalQuery(q url.Values) string {
+	var l []string
+	for k, vl := range q {
+		for _, v := range vl {
+			l = append(l, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	sort.Strings(l)
+	return strings.Join(l, "&")
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(s))
+	return m.Sum(nil)
+}
+
+func sha256Hex(buf []byte) string {
+	h := sha256.Sum256(buf)
+	return hex.EncodeToString(h[:])
+}
+
+// Credential scope and signature for a canonical request at time t.
+func (s *s3Store) sign(t time.Time, canonicalRequest string) (scope, signature string) {
+	date := t.Format("20060102")
+	scope = date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + t.Format("20060102T150405Z") + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return scope, hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// Do a signed request. The response has a 2xx status, or an error is returned,
+// wrapping fs.ErrNotExist for a 404, and fs.ErrExist for a failed If-None-Match.
+func (s *s3Store) do(method, key string, query url.Values, header http.Header, body io.ReadSeeker, size int64) (*http.Response, error) {
+	payloadHash := sha256Hex(nil)
+	if body != nil {
+		h := sha256.New()
+		if _, err := io.Copy(h, body); err != nil {
+			return nil, err
+		} else if _, err := body.Seek(0, 0); err != nil {
+			return nil, err
+		}
+		payloadHash = hex.EncodeToString(h.Sum(nil))
+	}
+
+	u := s.url(key)
+	u.RawQuery = s3CanonicalQuery(query)
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Body = io.NopCloser(body)
+		req.ContentLength = size
+	}
+	for k, vl := range header {
+		req.Header[k] = vl
+	}
+	t := time.Now().UTC()
+	req.Header.Set("X-Amz-Date", t.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		method,
+		u.EscapedPath(),
+		u.RawQuery,
+		"host:" + u.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + t.Format("20060102T150405Z"),
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope, signature := s.sign(t, canonicalRequest)
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.accessKey, scope, signedHeaders, signature))
+
+	resp, err := s3Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: s3 object %s", fs.ErrNotExist, key)
+	} else if resp.StatusCode == http.StatusPreconditionFailed && header.Get("If-None-Match") == "*" {
+		return nil, fmt.Errorf("%w: s3 object %s", fs.ErrExist, key)
+	}
+	var xerr struct {
+		Code    string
+		Message string
+	}
+	buf, _ := io.ReadAll(io.LimitReader(resp.Body, 16*1024))
+	if xml.Unmarshal(buf, &xerr) == nil && xerr.Code != "" {
+		return nil, fmt.Errorf("s3 %s %s: %s: %s: %s", method, key, resp.Status, xerr.Code, xerr.Message)
+	}
+	return nil, fmt.Errorf("s3 %s %s: %s", method, key, resp.Status)
+}
+
+func (s *s3Store) put(key, p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	// Only create, never overwrite a blob that another instance sharing the bucket
+	// stored.
+	resp, err := s.do("PUT", key, nil, http.Header{"If-None-Match": {"*"}}, f, fi.Size())
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return os.Remove(p)
+}
+
+func (s *s3Store) open(key string) (io.ReadCloser, error) {
+	resp, err := s.do("GET", key, nil, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *s3Store) stat(key string) (blobInfo, error) {
+	resp, err := s.do("HEAD", key, nil, nil, nil, 0)
+	if err != nil {
+		return blobInfo{}, err
+	}
+	resp.Body.Close()
+	modified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return blobInfo{resp.ContentLength, modified}, nil
+}
+
+func (s *s3Store) remove(key string) error {
+	resp, err := s.do("DELETE", key, nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Store) list(name string, fn func(key string, info blobInfo)) error {
+	var token string
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {s.prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		resp, err := s.do("GET", "", q, nil, nil, 0)
+		if err != nil {
+			return err
+		}
+		var result struct {
+			Contents []struct {
+				Key          string
+				Size         int64
+				LastModified time.Time
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("parsing s3 list response: %v", err)
+		}
+		for _, c := range result.Contents {
+			key := strings.TrimPrefix(c.Key, s.prefix)
+			if strings.HasSuffix(key, "/"+name) {
+				fn(key, blobInfo{c.Size, c.LastModified})
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// Presigned URL for downloading the object, if configured.
+func (s *s3Store) downloadURL(key, filename string) (string, error) {
+	if !s.presign {
+		return "", nil
+	}
+	q := url.Values{"response-content-disposition": {fmt.Sprintf(`attachment; filename="%s"`, filename)}}
+	return s.presignURL(time.Now().UTC(), s.url(key), s3PresignExpires, q), nil
+}
+
+// Presign a GET request for u at time t, with additional query parameters q.
+func (s *s3Store) presignURL(t time.Time, u *url.URL, expires time.Duration, q url.Values) string {
+	scope := t.Format("20060102") + "/" + s.region + "/s3/aws4_request"
+	q.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	q.Set("X-Amz-Credential", s.accessKey+"/"+scope)
+	q.Set("X-Amz-Date", t.Format("20060102T150405Z"))
+	q.Set("X-Amz-Expires", fmt.Sprintf("%d", int(expires.Seconds())))
+	q.Set("X-Amz-SignedHeaders", "host")
+	u.RawQuery = s3CanonicalQuery(q)
+	canonicalRequest := strings.Join([]string{
+		"GET",
+		u.EscapedPath(),
+		u.RawQuery,
+		"host:" + u.Host,
+		"",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	_, signature := s.sign(t, canonicalRequest)
+	u.RawQuery += "&X-Amz-Signature=" + signature
+	return u.String()
+}
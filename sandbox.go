@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mjl-/sconf"
+)
+
+// With config Sandbox, go commands are started through a helper process, a
+// re-executed gobuild with subcommand sandbox-exec, in new namespaces. The helper
+// sets up the mounts, limits and network, and starts the go command without
+// privileges. For commands that download modules, the helper listens on loopback
+// in the sandbox, and passes accepted connections to gobuild, which proxies
+// them to allowed hosts only.
+
+// Passed to the sandbox helper.
+type sandboxSpec struct {
+	Root        string // Empty directory to mount the new root on, in the mount namespace of the helper.
+	Mounts      []sandboxMount
+	Dir         string
+	Argv        []string
+	Env         []string
+	Network     bool     // Whether to run a proxy, for downloading modules.
+	Forward     []string // Loopback addresses forwarded to the same address outside the sandbox, e.g. for a local GoProxy.
+	MaxFileSize int
+	MaxCPUTime  int
+	MaxMemory   int
+	Probe       *sandboxProbe `json:",omitempty"`
+}
+
+type sandboxMount struct {
+	Source   string
+	Target   string
+	Writable bool
+	Optional bool // Skipped if source does not exist.
+}
+
+// Checks run in the sandbox instead of a go command, by sandbox-test.
+type sandboxProbe struct {
+	Write []string // Directories to create a file in.
+	Dial  []string // Addresses to connect to directly.
+	Proxy []string // Addresses to connect to through the proxy.
+}
+
+type sandboxProbeResult struct {
+	Op     string
+	Target string
+	Error  string
+}
+
+// Addresses go commands in the sandbox may connect to through the proxy.
+func sandboxAllowed() []string {
+	var l []string
+	if u, err := url.Parse(goproxyURL()); err == nil && u.Host != "" {
+		l = append(l, hostPort(u))
+		// The module proxy redirects to its storage for downloads.
+		if u.Hostname() == "proxy.golang.org" {
+			l = append(l, "storage.googleapis.com:443")
+		}
+	}
+	return append(l, config.Sandbox.AllowHosts...)
+}
+
+// Loopback address of GoProxy or the goproxy cache, to forward into the sandbox.
+// HTTP clients don't use a proxy for loopback addresses.
+func sandboxForward() string {
+	u, err := url.Parse(goproxyURL())
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	if u.Hostname() == "localhost" {
+		return net.JoinHostPort("127.0.0.1", u.Port())
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil && ip.IsLoopback() {
+		return hostPort(u)
+	}
+	return ""
+}
+
+func hostPort(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// Handle a connection to the proxy in the sandbox, for a CONNECT request or a
+// plain HTTP request, only to allowed addresses.
+func sandboxProxy(conn net.Conn, allowed []string) {
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Minute))
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	var addr string
+	if req.Method == "CONNECT" {
+		addr = req.Host
+	} else {
+		addr = hostPort(req.URL)
+	}
+	ok := false
+	for _, a := range allowed {
+		if strings.EqualFold(a, addr) {
+			ok = true
+		}
+	}
+	if !ok {
+		log.Printf("sandbox: refusing connection to %s", addr)
+		fmt.Fprintf(conn, "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n")
+		return
+	}
+
+	upstream, err := net.DialTimeout("tcp", addr, 30*time.Second)
+	if err != nil {
+		log.Printf("sandbox: connecting to %s: %v", addr, err)
+		fmt.Fprintf(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+		return
+	}
+	defer upstream.Close()
+
+	if req.Method == "CONNECT" {
+		if _, err := fmt.Fprintf(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+			return
+		}
+	} else {
+		// One request per connection, so each is checked.
+		req.Close = true
+		if err := req.Write(upstream); err != nil {
+			return
+		}
+	}
+	sandboxPipe(&bufferedConn{conn, br}, upstream)
+}
+
+// Handle a connection to a forwarded loopback address in the sandbox.
+func sandboxForwardConn(conn net.Conn, addr string) {
+	defer conn.Close()
+	upstream, err := net.DialTimeout("tcp", addr, 30*time.Second)
+	if err != nil {
+		log.Printf("sandbox: forwarding to %s: %v", addr, err)
+		return
+	}
+	defer upstream.Close()
+	sandboxPipe(conn, upstream)
+}
+
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(buf []byte) (int, error) {
+	return c.r.Read(buf)
+}
+
+// Copy data in both directions until one side is done.
+func sandboxPipe(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(a, b)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(b, a)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// Run the probe in the sandbox, started by the helper instead of a go command.
+// Results are written as JSON to stdout.
+func sandboxRunProbe(args []string) {
+	if len(args) != 1 {
+		log.Fatalf("sandbox-probe: missing probe")
+	}
+	var p sandboxProbe
+	if err := json.Unmarshal([]byte(args[0]), &p); err != nil {
+		log.Fatalf("sandbox-probe: parsing probe: %v", err)
+	}
+
+	var results []sandboxProbeResult
+	add := func(op, target string, err error) {
+		r := sandboxProbeResult{Op: op, Target: target}
+		if err != nil {
+			r.Error = err.Error()
+		}
+		results = append(results, r)
+	}
+	for _, dir := range p.Write {
+		path := filepath.Join(dir, "gobuild-sandbox-test")
+		err := os.WriteFile(path, []byte("test\n"), 0666)
+		if err == nil {
+			os.Remove(path)
+		}
+		add("write", dir, err)
+	}
+	for _, addr := range p.Dial {
+		conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+		if err == nil {
+			conn.Close()
+		}
+		add("dial", addr, err)
+	}
+	for _, addr := range p.Proxy {
+		add("proxy", addr, probeProxy(addr))
+	}
+	if err := json.NewEncoder(os.Stdout).Encode(results); err != nil {
+		log.Fatalf("sandbox-probe: writing results: %v", err)
+	}
+}
+
+func probeProxy(addr string) error {
+	proxy := os.Getenv("HTTPS_PROXY")
+	if proxy == "" {
+		return fmt.Errorf("no proxy")
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp", u.Host, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if _, err := fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", addr, addr); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("proxy: %s", resp.Status)
+	}
+	return nil
+}
+
+// Check the sandbox prevents writes outside of the allowed directories, and
+// network access other than to the allowed hosts.
+func sandboxTest(args []string) {
+	if len(args) > 1 {
+		usage()
+	}
+	if len(args) > 0 {
+		if err := sconf.ParseFile(args[0], &config); err != nil {
+			log.Fatalf("parsing config file: %v", err)
+		}
+	}
+	if config.Sandbox == nil {
+		log.Fatalf("no Sandbox in config")
+	}
+	if !strings.HasSuffix(config.GoProxy, "/") {
+		config.GoProxy += "/"
+	}
+	initBuildDirs()
+	initGoproxy()
+
+	abs := func(p string) string {
+		if filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(workdir, p)
+	}
+	gopkg := filepath.Join(homedir, "go", "pkg")
+	cache := filepath.Join(homedir, ".cache")
+	gobin := filepath.Join(homedir, "go", "bin")
+	readonly := []string{"/", "/usr", workdir, homedir, emptyDir, abs(config.SDKDir), abs(config.DataDir)}
+	readonly = append(readonly, config.Sandbox.ReadOnly...)
+	writable := []string{"/tmp", cache, gobin, buildModcachesDir()}
+	writable = append(writable, config.Sandbox.Writable...)
+
+	// Direct connections should never work, except for a forwarded local GoProxy or
+	// local module proxy.
+	var goproxyAddr string
+	if u, err := url.Parse(goproxyURL()); err == nil && u.Host != "" {
+		goproxyAddr = hostPort(u)
+	}
+	dial := []string{goproxyAddr}
+	if host, port, err := net.SplitHostPort(goproxyAddr); err == nil {
+		if ips, err := net.LookupIP(host); err == nil && len(ips) > 0 && !ips[0].IsLoopback() {
+			dial = append(dial, net.JoinHostPort(ips[0].String(), port))
+		}
+	}
+	forward := sandboxForward()
+
+	failed := false
+	check := func(network bool) {
+		probe := sandboxProbe{
+			Write: append(append([]string{gopkg}, readonly...), writable...),
+			Dial:  dial,
+			Proxy: []string{goproxyAddr, "gobuild-sandbox-test.invalid:443"},
+		}
+		expect := map[string]bool{}
+		expect["write "+gopkg] = network
+		for _, p := range writable {
+			expect["write "+p] = true
+		}
+		if network {
+			if forward != "" {
+				expect["dial "+goproxyAddr] = true
+			} else {
+				expect["proxy "+goproxyAddr] = true
+			}
+		}
+
+		cmd := sandboxCommand(network, emptyDir, nil, nil, &probe)
+		cmd.Stderr = os.Stderr
+		output, err := cmd.Output()
+		if err != nil {
+			log.Fatalf("running sandbox: %v", err)
+		}
+		var results []sandboxProbeResult
+		if err := json.Unmarshal(output, &results); err != nil {
+			log.Fatalf("parsing sandbox probe results: %v", err)
+		}
+		mode := "build"
+		if network {
+			mode = "download"
+		}
+		for _, r := range results {
+			allowed := r.Error == ""
+			status := "ok"
+			if allowed != expect[r.Op+" "+r.Target] {
+				status = "FAIL"
+				failed = true
+			}
+			result := "allowed"
+			if !allowed {
+				result = "denied: " + r.Error
+			}
+			fmt.Printf("%-4s %-8s %-5s %s: %s\n", status, mode, r.Op, r.Target, result)
+		}
+	}
+	check(false)
+	check(true)
+	if failed {
+		log.Fatalf("sandbox test failed")
+	}
+	log.Printf("sandbox test OK")
+}
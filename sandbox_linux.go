@@ -0,0 +1,571 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Not in package syscall.
+const (
+	rlimitMemlock      = 8
+	rlimitMsgqueue     = 12
+	prSetNoNewPrivs    = 38
+	prCapAmbient       = 47
+	prCapAmbientClrAll = 4
+
+	stNosuid     = 0x2
+	stNodev      = 0x4
+	stNoexec     = 0x8
+	stNoatime    = 0x400
+	stNodiratime = 0x800
+	stRelatime   = 0x1000
+)
+
+// System paths available read-only in the sandbox, if they exist.
+var sandboxSystemPaths = []string{
+	"/usr",
+	"/bin",
+	"/sbin",
+	"/lib",
+	"/lib32",
+	"/lib64",
+	"/etc/resolv.conf",
+	"/etc/nsswitch.conf",
+	"/etc/hosts",
+	"/etc/services",
+	"/etc/protocols",
+	"/etc/mime.types",
+	"/etc/localtime",
+	"/etc/ssl",
+	"/etc/pki",
+	"/etc/ca-certificates",
+}
+
+// Paths available in the sandbox. The shared module cache is only writable when
+// downloading, builds write to their own module cache. A GOBUILD_GOBIN in env is
+// mounted as the go/bin directory in HomeDir, like run.sh does.
+func sandboxMounts(network bool, env []string) []sandboxMount {
+	var l []sandboxMount
+	for _, p := range sandboxSystemPaths {
+		l = append(l, sandboxMount{p, p, false, true})
+	}
+	for _, p := range config.Sandbox.ReadOnly {
+		l = append(l, sandboxMount{p, p, false, false})
+	}
+	for _, p := range config.Sandbox.Writable {
+		l = append(l, sandboxMount{p, p, true, false})
+	}
+	sdkDir := config.SDKDir
+	if !filepath.IsAbs(sdkDir) {
+		sdkDir = filepath.Join(workdir, sdkDir)
+	}
+	l = append(l, sandboxMount{sdkDir, sdkDir, false, false})
+
+	gopkg := filepath.Join(homedir, "go", "pkg")
+	cache := filepath.Join(homedir, ".cache")
+	gobin := filepath.Join(homedir, "go", "bin")
+	modcaches := buildModcachesDir()
+	for _, p := range []string{gopkg, cache, gobin, modcaches} {
+		os.MkdirAll(p, 0777) // Errors are reported when mounting.
+	}
+	gobinSource := gobin
+	for _, s := range env {
+		if strings.HasPrefix(s, "GOBUILD_GOBIN=") {
+			gobinSource = strings.TrimPrefix(s, "GOBUILD_GOBIN=")
+		}
+	}
+	return append(l,
+		sandboxMount{gopkg, gopkg, network, false},
+		sandboxMount{cache, cache, true, false},
+		sandboxMount{gobinSource, gobin, true, false},
+		sandboxMount{modcaches, modcaches, true, false},
+	)
+}
+
+// Make a command that runs argv in a sandbox, through the helper. With probe set,
+// the probe is run instead of argv.
+func sandboxCommand(network bool, dir string, argv, env []string, probe *sandboxProbe) *exec.Cmd {
+	spec := sandboxSpec{
+		Root:        emptyDir,
+		Mounts:      sandboxMounts(network, env),
+		Dir:         dir,
+		Argv:        argv,
+		Env:         env,
+		Network:     network,
+		MaxFileSize: config.Sandbox.MaxFileSize,
+		MaxCPUTime:  config.Sandbox.MaxCPUTime,
+		MaxMemory:   config.Sandbox.MaxMemory,
+		Probe:       probe,
+	}
+	var dial []string
+	if network {
+		if fwd := sandboxForward(); fwd != "" {
+			spec.Forward = []string{fwd}
+			dial = []string{fwd}
+		}
+	}
+
+	cmd := exec.Command("/proc/self/exe")
+	if len(argv) > 0 {
+		// Resolve with our PATH, the sandbox has a different view.
+		p, err := exec.LookPath(argv[0])
+		if err != nil {
+			cmd.Err = err
+			return cmd
+		}
+		spec.Argv = append([]string{p}, argv[1:]...)
+	}
+	buf, err := json.Marshal(spec)
+	if err != nil {
+		cmd.Err = fmt.Errorf("marshal sandbox spec: %v", err)
+		return cmd
+	}
+	cmd.Args = []string{"gobuild", "sandbox-exec", string(buf)}
+	cmd.Dir = "/"
+	cmd.Env = env
+	cmd.SysProcAttr = sandboxSysProcAttr(os.Getuid(), os.Getgid())
+	if network {
+		fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET|syscall.SOCK_CLOEXEC, 0)
+		if err != nil {
+			cmd.Err = fmt.Errorf("sandbox socketpair: %v", err)
+			return cmd
+		}
+		pf := os.NewFile(uintptr(fds[0]), "sandbox")
+		cf := os.NewFile(uintptr(fds[1]), "sandbox")
+		cmd.ExtraFiles = []*os.File{cf}
+		go sandboxServe(pf, cf, sandboxAllowed(), dial)
+	}
+	return cmd
+}
+
+// Attributes for starting the helper in new namespaces, with root in the user
+// namespace mapped to uid and gid.
+func sandboxSysProcAttr(uid, gid int) *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNET | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS | syscall.CLONE_NEWCGROUP,
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: uid, Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: gid, Size: 1}},
+		Pdeathsig:   syscall.SIGKILL,
+	}
+}
+
+// Receive connections accepted by the helper, and proxy or forward them. Index 0
+// is the proxy, others are the forwarded addresses.
+func sandboxServe(pf, cf *os.File, allowed, dial []string) {
+	defer cf.Close()
+	c, err := net.FileConn(pf)
+	pf.Close()
+	if err != nil {
+		log.Printf("sandbox: %v", err)
+		return
+	}
+	uc := c.(*net.UnixConn)
+	defer uc.Close()
+
+	// The helper sends a message when started, after which we can close our copy of
+	// its end, so we notice when it is gone.
+	buf := make([]byte, 1)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	uc.SetReadDeadline(time.Now().Add(time.Minute))
+	if _, _, _, _, err := uc.ReadMsgUnix(buf, oob); err != nil {
+		return
+	}
+	uc.SetReadDeadline(time.Time{})
+	cf.Close()
+
+	for {
+		n, oobn, _, _, err := uc.ReadMsgUnix(buf, oob)
+		if err != nil || n == 0 {
+			return
+		}
+		conn, err := receiveConn(oob[:oobn])
+		if err != nil {
+			log.Printf("sandbox: receiving connection: %v", err)
+			continue
+		}
+		if i := int(buf[0]); i == 0 {
+			go sandboxProxy(conn, allowed)
+		} else if i <= len(dial) {
+			go sandboxForwardConn(conn, dial[i-1])
+		} else {
+			conn.Close()
+		}
+	}
+}
+
+func receiveConn(oob []byte) (net.Conn, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) != 1 {
+		return nil, fmt.Errorf("got %d control messages, expected 1", len(msgs))
+	}
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil {
+		return nil, err
+	}
+	for _, fd := range fds[1:] {
+		syscall.Close(fd)
+	}
+	if len(fds) == 0 {
+		return nil, fmt.Errorf("no file descriptor")
+	}
+	f := os.NewFile(uintptr(fds[0]), "sandbox conn")
+	defer f.Close()
+	return net.FileConn(f)
+}
+
+// Sandbox helper, started in new namespaces by sandboxCommand. It sets up the
+// sandbox, and runs the command without privileges, exiting with its status.
+func sandboxExec(args []string) {
+	log.SetPrefix("sandbox: ")
+	if len(args) != 1 {
+		log.Fatalf("missing spec")
+	}
+	var spec sandboxSpec
+	if err := json.Unmarshal([]byte(args[0]), &spec); err != nil {
+		log.Fatalf("parsing spec: %v", err)
+	}
+
+	var sock *net.UnixConn
+	if spec.Network {
+		f := os.NewFile(3, "sandbox")
+		syscall.CloseOnExec(3)
+		c, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("connection to gobuild: %v", err)
+		}
+		sock = c.(*net.UnixConn)
+		if _, _, err := sock.WriteMsgUnix([]byte{0}, nil, nil); err != nil {
+			log.Fatalf("connection to gobuild: %v", err)
+		}
+	}
+
+	if err := sandboxSetup(spec); err != nil {
+		log.Fatalf("setting up sandbox: %v", err)
+	}
+
+	env := spec.Env
+	if spec.Network {
+		proxyAddr, err := sandboxListen(spec, sock)
+		if err != nil {
+			log.Fatalf("listening: %v", err)
+		}
+		env = append(env, "HTTPS_PROXY=http://"+proxyAddr, "HTTP_PROXY=http://"+proxyAddr)
+	}
+
+	argv := spec.Argv
+	if spec.Probe != nil {
+		buf, err := json.Marshal(spec.Probe)
+		if err != nil {
+			log.Fatalf("marshal probe: %v", err)
+		}
+		argv = []string{"/proc/self/exe", "sandbox-probe", string(buf)}
+	}
+
+	// Drop privileges for the command. This only affects the current thread, which
+	// starts the command.
+	runtime.LockOSThread()
+	if err := dropPrivileges(); err != nil {
+		log.Fatalf("dropping privileges: %v", err)
+	}
+
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Dir = spec.Dir
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			os.Exit(128 + int(ws.Signal()))
+		}
+		os.Exit(exitErr.ExitCode())
+	} else if err != nil {
+		log.Fatalf("running command: %v", err)
+	}
+	os.Exit(0)
+}
+
+// Make the new root with only the configured paths, a minimal /dev, a fresh /tmp
+// and /proc, and pivot into it. Then set the hostname and limits, and enable the
+// loopback interface.
+func sandboxSetup(spec sandboxSpec) error {
+	// Don't propagate our mounts to the host.
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("making mounts private: %v", err)
+	}
+	root := spec.Root
+	if err := syscall.Mount("tmpfs", root, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=0755"); err != nil {
+		return fmt.Errorf("mounting root: %v", err)
+	}
+	// Before the binds, which may be below /tmp.
+	tmp := filepath.Join(root, "tmp")
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return err
+	} else if err := syscall.Mount("tmpfs", tmp, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777"); err != nil {
+		return fmt.Errorf("mounting /tmp: %v", err)
+	}
+	for _, m := range spec.Mounts {
+		if err := sandboxBind(root, m); err != nil {
+			return err
+		}
+	}
+	for _, name := range []string{"null", "zero", "full", "random", "urandom"} {
+		p := "/dev/" + name
+		if err := sandboxBind(root, sandboxMount{p, p, true, false}); err != nil {
+			return err
+		}
+	}
+	for _, link := range [][2]string{{"fd", "/proc/self/fd"}, {"stdin", "/proc/self/fd/0"}, {"stdout", "/proc/self/fd/1"}, {"stderr", "/proc/self/fd/2"}} {
+		if err := os.Symlink(link[1], filepath.Join(root, "dev", link[0])); err != nil {
+			return err
+		}
+	}
+	proc := filepath.Join(root, "proc")
+	if err := os.MkdirAll(proc, 0755); err != nil {
+		return err
+	} else if err := syscall.Mount("proc", proc, "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("mounting /proc: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, spec.Dir), 0755); err != nil {
+		return err
+	}
+
+	oldroot := filepath.Join(root, ".oldroot")
+	if err := os.Mkdir(oldroot, 0700); err != nil {
+		return err
+	}
+	if err := syscall.PivotRoot(root, oldroot); err != nil {
+		return fmt.Errorf("pivot root: %v", err)
+	}
+	if err := os.Chdir("/"); err != nil {
+		return err
+	}
+	if err := syscall.Unmount("/.oldroot", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("unmounting old root: %v", err)
+	}
+	if err := os.Remove("/.oldroot"); err != nil {
+		return err
+	}
+	if err := syscall.Mount("", "/", "", syscall.MS_REMOUNT|syscall.MS_BIND|syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV, ""); err != nil {
+		return fmt.Errorf("making root read-only: %v", err)
+	}
+
+	if err := syscall.Sethostname([]byte("gobuild")); err != nil {
+		return fmt.Errorf("setting hostname: %v", err)
+	}
+
+	type limit struct {
+		resource int
+		value    uint64
+	}
+	limits := []limit{
+		{syscall.RLIMIT_CORE, 0},
+		{rlimitMemlock, 0},
+		{rlimitMsgqueue, 0},
+	}
+	if spec.MaxFileSize > 0 {
+		limits = append(limits, limit{syscall.RLIMIT_FSIZE, uint64(spec.MaxFileSize) * 1024 * 1024})
+	}
+	if spec.MaxCPUTime > 0 {
+		limits = append(limits, limit{syscall.RLIMIT_CPU, uint64(spec.MaxCPUTime)})
+	}
+	if spec.MaxMemory > 0 {
+		limits = append(limits, limit{syscall.RLIMIT_DATA, uint64(spec.MaxMemory) * 1024 * 1024})
+	}
+	for _, l := range limits {
+		if err := syscall.Setrlimit(l.resource, &syscall.Rlimit{Cur: l.value, Max: l.value}); err != nil {
+			return fmt.Errorf("setting resource limit %d: %v", l.resource, err)
+		}
+	}
+
+	if spec.Network {
+		if err := loopbackUp(); err != nil {
+			return fmt.Errorf("enabling loopback interface: %v", err)
+		}
+	}
+	return nil
+}
+
+// Bind mount m.Source at m.Target in root. Read-only mounts keep the flags of
+// the source mount that can't be cleared in a user namespace.
+func sandboxBind(root string, m sandboxMount) error {
+	fi, err := os.Lstat(m.Source)
+	if err != nil {
+		if m.Optional && os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("mount source: %v", err)
+	}
+	target := filepath.Join(root, m.Target)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		// Relative symlinks, like /bin to usr/bin, are recreated. Others are mounted as
+		// the file they point to.
+		if link, err := os.Readlink(m.Source); err == nil && !filepath.IsAbs(link) {
+			return os.Symlink(link, target)
+		}
+		fi, err = os.Stat(m.Source)
+		if err != nil {
+			if m.Optional && os.IsNotExist(err) {
+				return nil
+			}
+			return fmt.Errorf("mount source: %v", err)
+		}
+	}
+	if fi.IsDir() {
+		err = os.MkdirAll(target, 0755)
+	} else {
+		var f *os.File
+		f, err = os.OpenFile(target, os.O_CREATE|os.O_WRONLY, 0644)
+		if err == nil {
+			err = f.Close()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err := syscall.Mount(m.Source, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("mounting %s: %v", m.Source, err)
+	}
+	if m.Writable {
+		return nil
+	}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(m.Source, &st); err != nil {
+		return fmt.Errorf("statfs %s: %v", m.Source, err)
+	}
+	flags := uintptr(syscall.MS_REMOUNT | syscall.MS_BIND | syscall.MS_RDONLY)
+	for _, f := range []struct {
+		st int64
+		ms uintptr
+	}{
+		{stNosuid, syscall.MS_NOSUID},
+		{stNodev, syscall.MS_NODEV},
+		{stNoexec, syscall.MS_NOEXEC},
+		{stNoatime, syscall.MS_NOATIME},
+		{stNodiratime, syscall.MS_NODIRATIME},
+		{stRelatime, syscall.MS_RELATIME},
+	} {
+		if int64(st.Flags)&f.st != 0 {
+			flags |= f.ms
+		}
+	}
+	if err := syscall.Mount("", target, "", flags, ""); err != nil {
+		return fmt.Errorf("making %s read-only: %v", m.Source, err)
+	}
+	return nil
+}
+
+// Listen for the proxy and forwarded addresses, passing accepted connections to
+// gobuild. Returns the address of the proxy.
+func sandboxListen(spec sandboxSpec, sock *net.UnixConn) (string, error) {
+	addrs := append([]string{"127.0.0.1:0"}, spec.Forward...)
+	var proxyAddr string
+	for i, addr := range addrs {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return "", err
+		}
+		if i == 0 {
+			proxyAddr = l.Addr().String()
+		}
+		go func(index byte, l net.Listener) {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					log.Printf("accept: %v", err)
+					return
+				}
+				f, err := conn.(*net.TCPConn).File()
+				conn.Close()
+				if err != nil {
+					log.Printf("connection file: %v", err)
+					continue
+				}
+				_, _, err = sock.WriteMsgUnix([]byte{index}, syscall.UnixRights(int(f.Fd())), nil)
+				f.Close()
+				if err != nil {
+					log.Printf("passing connection to gobuild: %v", err)
+				}
+			}
+		}(byte(i), l)
+	}
+	return proxyAddr, nil
+}
+
+// Bring up the loopback interface of the new network namespace.
+func loopbackUp() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	var ifr struct {
+		name  [syscall.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(ifr.name[:], "lo")
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+		return errno
+	}
+	ifr.flags |= syscall.IFF_UP
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Ensure commands started from the current thread have no capabilities in the
+// sandbox: clear the bounding, inheritable and ambient sets, and prevent gaining
+// privileges.
+func dropPrivileges() error {
+	for c := 0; c < 64; c++ {
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_CAPBSET_DROP, uintptr(c), 0); errno == syscall.EINVAL {
+			break
+		} else if errno != 0 {
+			return fmt.Errorf("dropping capability %d from bounding set: %v", c, errno)
+		}
+	}
+	hdr := struct {
+		version uint32
+		pid     int32
+	}{0x20080522, 0} // _LINUX_CAPABILITY_VERSION_3
+	var data [2]struct {
+		effective, permitted, inheritable uint32
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPGET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return fmt.Errorf("capget: %v", errno)
+	}
+	data[0].inheritable = 0
+	data[1].inheritable = 0
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return fmt.Errorf("capset: %v", errno)
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prCapAmbient, prCapAmbientClrAll, 0); errno != 0 && errno != syscall.EINVAL {
+		return fmt.Errorf("clearing ambient capabilities: %v", errno)
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return fmt.Errorf("setting no new privileges: %v", errno)
+	}
+	return nil
+}
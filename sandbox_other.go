@@ -0,0 +1,19 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"log"
+	"os/exec"
+)
+
+func sandboxCommand(network bool, dir string, argv, env []string, probe *sandboxProbe) *exec.Cmd {
+	cmd := exec.Command("gobuild")
+	cmd.Err = errors.New("sandbox only supported on linux")
+	return cmd
+}
+
+func sandboxExec(args []string) {
+	log.Fatalf("sandbox only supported on linux")
+}
@@ -1,12 +1,10 @@
 package main
 
 import (
-	"bytes"
 	"compress/gzip"
 	"context"
-	"crypto/sha256"
+	"crypto/tls"
 	_ "embed"
-	"encoding/base64"
 	"errors"
 	"flag"
 	"fmt"
@@ -20,7 +18,6 @@ import (
 	"path/filepath"
 	"runtime"
 	"runtime/debug"
-	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -32,7 +29,6 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/crypto/acme/autocert"
 	"golang.org/x/mod/sumdb/note"
-	"golang.org/x/mod/sumdb/tlog"
 )
 
 var (
@@ -50,15 +46,25 @@ var (
 	}
 
 	config = struct {
-		GoProxy      string   `sconf-doc:"URL to Go module proxy. Used to resolve \"latest\" module versions."`
-		DataDir      string   `sconf-doc:"Directory where the sumdb and builds files (binary, log) are stored."`
-		SDKDir       string   `sconf-doc:"Directory where SDKs (go toolchains) are installed."`
-		HomeDir      string   `sconf-doc:"Directory set as home directory during builds. Go will store its caches, downloaded and extracted modules here."`
-		MaxBuilds    int      `sconf-doc:"Maximum concurrent builds. Default (0) uses NumCPU+1."`
-		Environment  []string `sconf:"optional" sconf-doc:"Additional environment variables in form KEY=VALUE to use for go command invocations. Useful to configure GOSUMDB and HTTPS_PROXY."`
-		Run          []string `sconf:"optional" sconf-doc:"Command and parameters to prefix invocations of go with. For example /usr/bin/nice."`
-		BuildGobin   bool     `sconf-doc:"If enabled, sets environment variable GOBUILD_GOBIN during a build to a directory where the build command should write the binary. Configure a wrapper to the build command through the Run config option."`
-		VerifierURLs []string `sconf:"optional" sconf-doc:"URLs of other gobuild instances that are asked to perform the same build. Gobuild requires all of them to create the same binary (same hash) for a build to be successful. Ideally, these instances differ in hardware, goos, goarch, user id/name, home and work directories."`
+		GoProxy          string   `sconf-doc:"URL to Go module proxy. Used to resolve \"latest\" module versions. Can be a list of URLs like GOPROXY, separated by comma (try the next proxy on a 404 or 410 response) or pipe (try the next proxy on any error). \"direct\" and \"off\" are not supported."`
+		DataDir          string   `sconf-doc:"Directory where the sumdb and builds files (binary, log) are stored."`
+		SDKDir           string   `sconf-doc:"Directory where SDKs (go toolchains) are installed."`
+		HomeDir          string   `sconf-doc:"Directory set as home directory during builds. Go will store its caches, downloaded and extracted modules here."`
+		MaxBuilds        int      `sconf-doc:"Maximum concurrent builds. Default (0) uses NumCPU+1."`
+		BuildTimeout     int      `sconf:"optional" sconf-doc:"Maximum number of seconds a go build may take. Builds that take longer are stopped, and not stored as failed. Default (0) is no limit."`
+		BuildIdleTimeout int      `sconf:"optional" sconf-doc:"Maximum number of seconds a go build may run without writing output. Default (0) is no limit."`
+		ClientMaxBuilds  int      `sconf:"optional" sconf-doc:"Maximum concurrent builds per client, identified by IP address or token (see ClientTokens). Builds are started round-robin between clients. Default (0) is no per-client limit."`
+		ClientMaxQueued  int      `sconf:"optional" sconf-doc:"Maximum builds per client that are waiting in the queue or in progress. Requests for more builds fail. Default (0) is no limit."`
+		Environment      []string `sconf:"optional" sconf-doc:"Additional environment variables in form KEY=VALUE to use for go command invocations. Useful to configure GOSUMDB and HTTPS_PROXY."`
+		Run              []string `sconf:"optional" sconf-doc:"Command and parameters to prefix invocations of go with. For example /usr/bin/nice."`
+		BuildGobin       bool     `sconf-doc:"If enabled, sets environment variable GOBUILD_GOBIN during a build to a directory where the build command should write the binary. Configure a wrapper to the build command through the Run config option."`
+		VerifierURLs     []string `sconf:"optional" sconf-doc:"URLs of other gobuild instances that are asked to perform the same build. Gobuild requires all of them (or VerifyQuorum) to create the same binary (same hash) for a build to be successful. Ideally, these instances differ in hardware, goos, goarch, user id/name, home and work directories."`
+		Verifiers        []struct {
+			URL     string `sconf-doc:"URL of other gobuild instance, like VerifierURLs."`
+			Timeout int    `sconf:"optional" sconf-doc:"Number of seconds to wait for the build at the verifier. If the verifier takes longer, it is considered unavailable. Default (0) waits indefinitely."`
+		} `sconf:"optional" sconf-doc:"Like VerifierURLs, but with per-verifier timeout."`
+		VerifyQuorum int  `sconf:"optional" sconf-doc:"Number of verifiers (VerifierURLs and Verifiers) that must return the same hash for a build to be successful. Unavailable verifiers are tolerated as long as the quorum is reached. A verifier returning a different hash always fails the build. Default (0) requires all verifiers."`
+		VerifyAsync  bool `sconf:"optional" sconf-doc:"If set, a build is published without waiting for the verifiers. Their results are stored when they are done, and disagreements are logged as alert."`
 		HTTPS        *struct {
 			ACME struct {
 				Domains []string `sconf-doc:"List of domains to serve HTTPS for and request certificates for with ACME."`
@@ -71,22 +77,98 @@ var (
 		LogDir         string   `sconf-doc:"Directory to store log files. HTTP access logs are written, one file per day. Additions to the transparency logs, and HTTP protocol errors. Leave empty to disable logging."`
 		ModulePrefixes []string `sconf:"optional" sconf-doc:"If non-empty, allow list of module prefixes for which binaries will be built. Requests for other module prefixes result in an error. Prefixes should typically end with a slash."`
 		SDKVersionStop string   `sconf:"optional" sconf-doc:"If set, the (hypothetical) version (and beyond) of the Go toolchain that is not allowed for builds. Gobuild automatically downloads new SDKs. However, new Go toolchain versions may change behaviour which may cause binaries to no longer become reproducible with the flags gobuild uses to build. By refusing new versions, you have time to separately verify binaries with newer Go toolchains are still reproducible. Example: a version of go1.20 allows go1.18, go1.19, go1.19.1, but not go1.20, go1.21 or go2.0. Versions like go1.20rc1 are interpreted as go1.20, without rc1."`
+		Follow         []struct {
+			Name        string `sconf-doc:"Name for the followed log. Used in paths in the data directory, metrics and on the status page."`
+			URL         string `sconf-doc:"Base URL of the gobuild instance, e.g. https://gobuilds.org. Its /tlog/stream endpoint is used to learn about new records."`
+			VerifierKey string `sconf-doc:"Verifier key for the transparency log of the gobuild instance."`
+			FromStart   bool   `sconf:"optional" sconf-doc:"If set, rebuild all records in the log when starting to follow, instead of only newly added records."`
+		} `sconf:"optional" sconf-doc:"Transparency logs of other gobuild instances to follow. Each record added to a followed log is rebuilt, and mismatching binaries and failed builds are logged, stored in data/follow/<name>/mismatches.json, and counted in metrics. Rebuilds that fail temporarily, e.g. on network errors or timeouts, are retried with backoff before continuing with the next record. Status is shown at /follow on the admin listener."`
+		PriorityModulePrefixes []string `sconf:"optional" sconf-doc:"Module prefixes for which builds get priority in the queue, before builds of other modules."`
+		ClientTokens           []struct {
+			Name  string `sconf-doc:"Name of client, used to account builds to, and in logging."`
+			Token string `sconf-doc:"Secret token, sent by client in an HTTP header 'Authorization: Bearer <token>'."`
+		} `sconf:"optional" sconf-doc:"Clients that authenticate with a token. Their builds are accounted to the name instead of the IP address, and get priority in the queue."`
+		Workers []struct {
+			Name  string `sconf-doc:"Name of worker, used in logging and on the queue page."`
+			Token string `sconf-doc:"Secret token, sent by worker in an HTTP header 'Authorization: Bearer <token>'."`
+		} `sconf:"optional" sconf-doc:"Remote workers that may connect to build, started with subcommand worker. Builds are dispatched to workers in addition to local builds (MaxBuilds). Workers connect to /worker/ on the HTTP listener."`
+		Sandbox *struct {
+			ReadOnly    []string `sconf:"optional" sconf-doc:"Additional paths made available read-only in the sandbox. System paths like /usr, /bin, /lib, /lib64 and a few files in /etc are always available if they exist, as is SDKDir."`
+			Writable    []string `sconf:"optional" sconf-doc:"Additional paths made available writable in the sandbox. The go build cache and the directory for binaries in HomeDir are always writable, the module cache only for downloading modules."`
+			AllowHosts  []string `sconf:"optional" sconf-doc:"Addresses (host:port) that go commands downloading modules may connect to, in addition to the host of GoProxy, and storage.googleapis.com:443 for proxy.golang.org. E.g. sum.golang.org:443 if GoProxy does not proxy the checksum database."`
+			MaxFileSize int      `sconf:"optional" sconf-doc:"Maximum size in MB of a file written by a go command. Default (0) is no limit."`
+			MaxCPUTime  int      `sconf:"optional" sconf-doc:"Maximum CPU time in seconds for each process of a go command. Default (0) is no limit."`
+			MaxMemory   int      `sconf:"optional" sconf-doc:"Maximum data memory in MB for each process of a go command. Default (0) is no limit."`
+		} `sconf:"optional" sconf-doc:"If set, go commands are run in a built-in sandbox, with Linux user, mount, pid, network, ipc and uts namespaces. Only configured paths are available. Only go commands downloading modules have network access, through a proxy that only allows connections to GoProxy and AllowHosts. An alternative to a wrapper like run.sh in Run. Check the sandbox with subcommand sandbox-test. Linux only."`
+		PrivSep *struct {
+			ServeUser string `sconf-doc:"User to run the HTTP servers and coordination of builds as."`
+			BuildUser string `sconf-doc:"User to run go commands as. HomeDir is owned by this user."`
+		} `sconf:"optional" sconf-doc:"If set, gobuild must be started as root, and runs with privilege separation. A privileged process opens the listeners, is the only process writing the transparency log and results in DataDir, and starts go commands as BuildUser. The HTTP servers run in a separate process as ServeUser. Ownership of DataDir, HomeDir, SDKDir, LogDir and CertDir is changed as needed at startup. Not compatible with BuildGobin. Linux only."`
+		Retention *struct {
+			MaxIdleDays int `sconf:"optional" sconf-doc:"Remove binaries that haven't been downloaded for this many days. Default (0) is no limit."`
+			MaxAgeDays  int `sconf:"optional" sconf-doc:"Remove binaries built or restored more than this many days ago. Default (0) is no limit."`
+			MaxSizeMB   int `sconf:"optional" sconf-doc:"Maximum total size in MB of the stored (gzipped) binaries. When exceeded, the least recently downloaded binaries are removed. Default (0) is no limit."`
+		} `sconf:"optional" sconf-doc:"If set, binaries of successful builds are removed from DataDir according to these limits, checked every hour. The record in the transparency log and the build log are kept. When a removed binary is downloaded, it is built again, and restored only if it has the same hash as in the transparency log. With S3, only binaries of builds in this instance's transparency log are removed."`
+		S3 *struct {
+			Endpoint         string `sconf-doc:"URL of the S3-compatible service, e.g. https://s3.eu-central-1.amazonaws.com, or http://localhost:9000 for a local stand-in. Requests use path-style URLs."`
+			Region           string `sconf-doc:"Region for signing requests, e.g. us-east-1."`
+			Bucket           string `sconf-doc:"Bucket to store objects in. Must already exist."`
+			Prefix           string `sconf:"optional" sconf-doc:"Prefix for the keys of objects, e.g. gobuild/."`
+			AccessKeyID      string `sconf-doc:"Access key ID for signing requests."`
+			SecretAccessKey  string `sconf-doc:"Secret access key for signing requests."`
+			PresignDownloads bool   `sconf:"optional" sconf-doc:"If set, downloads of gzipped binaries are redirected to presigned URLs, valid for an hour, instead of being served by gobuild."`
+		} `sconf:"optional" sconf-doc:"If set, the gzipped binaries and build logs of successful builds are stored in S3-compatible object storage instead of in DataDir. Other files, like the transparency log and logs of failed builds, are still stored in DataDir. Builds are reproducible, so gobuild instances can share a bucket and prefix, objects are never overwritten, so the stored build log is that of the instance that stored it first. Requires support for conditional writes with If-None-Match."`
+		Cleanup *struct {
+			ModuleIdleHours int `sconf:"optional" sconf-doc:"Remove extracted module directories from the module cache that haven't been accessed for this many hours. The downloaded zip files are kept, modules are extracted again when needed. With mount option relatime, access times are updated at most once a day, so values below 24 remove modules in use. Default (0) does not remove modules."`
+			BuildCacheMaxMB int `sconf:"optional" sconf-doc:"Clean the go build cache with \"go clean -cache\" when it exceeds this size in MB. Default (0) is no limit."`
+		} `sconf:"optional" sconf-doc:"If set, the caches in HomeDir are cleaned up every hour, while no builds are running. Disk usage of the caches, SDKDir and the result directory is exported as metrics regardless."`
+		GoProxyCache *struct {
+			TTL int `sconf:"optional" sconf-doc:"Number of seconds to use cached version lists, latest versions and version queries like branch names, before fetching them again. Default (0) is 300."`
+		} `sconf:"optional" sconf-doc:"If set, gobuild runs a caching module proxy for GoProxy on a loopback address, used by go commands and by gobuild itself. Responses for module versions (.info, .mod, .zip) are stored in DataDir/goproxy permanently."`
+		GoProxyRoutes []struct {
+			Prefix  string `sconf-doc:"Module path prefix, e.g. git.example.com/corp. Matches whole path elements, the longest matching prefix is used."`
+			GoProxy string `sconf-doc:"Module proxies for modules matching Prefix, in the same form as GoProxy."`
+		} `sconf:"optional" sconf-doc:"Module proxies to use instead of GoProxy for modules with a path prefix, e.g. an internal module proxy for private modules. Requests for these modules are not sent to GoProxy."`
+		GoPrivate string `sconf:"optional" sconf-doc:"Comma-separated glob patterns of module path prefixes of private modules, set as GOPRIVATE for go commands. Private modules are not verified with the checksum database. Unlike with the go command, they are still fetched through the module proxies, never directly."`
+		GoNoSumDB string `sconf:"optional" sconf-doc:"Comma-separated glob patterns of module path prefixes not to verify with the checksum database, set as GONOSUMDB for go commands. Defaults to GoPrivate. The go command has no GONOSUMCHECK, this is the setting to skip checksum verification."`
+		Netrc     string `sconf:"optional" sconf-doc:"File with credentials for module proxies, in netrc format: \"machine <host> login <user> password <password>\". Requests to module proxies at the host use them for HTTP basic authentication. Go commands make their requests through gobuild, and never see the credentials. With PrivSep, the file must be readable by ServeUser."`
 	}{
 		"https://proxy.golang.org/",
 		"data",
 		"sdk",
 		"home",
 		0,
+		0,
+		0,
+		0,
+		0,
 		nil,
 		nil,
 		false,
 		nil,
 		nil,
+		0,
+		false,
+		nil,
 		"",
 		"",
 		"",
 		nil,
 		"",
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+		"",
+		"",
+		"",
 	}
 	emptyConfig = config
 
@@ -95,9 +177,6 @@ var (
 	// (same partition) as final results.
 	resultDir string
 
-	// Opened at startup, used whenever we read/write to the hashes or records files.
-	hashesFile, recordsFile *os.File
-
 	// Either separate log file or stderr, append-only logging of added sums.
 	sumLogFile io.Writer
 )
@@ -130,6 +209,15 @@ var (
 
 	//go:embed template/error.html
 	errorHTML string
+
+	//go:embed template/follow.html
+	followHTML string
+
+	//go:embed template/quarantine.html
+	quarantineHTML string
+
+	//go:embed template/queue.html
+	queueHTML string
 )
 
 var (
@@ -137,6 +225,10 @@ var (
 	moduleTemplate = template.Must(template.New("module").Parse(moduleHTML + baseHTML))
 	homeTemplate   = template.Must(template.New("home").Parse(homeHTML + baseHTML))
 	errorTemplate  = template.Must(template.New("error").Parse(errorHTML))
+	followTemplate = template.Must(template.New("follow").Parse(followHTML))
+	queueTemplate  = template.Must(template.New("queue").Parse(queueHTML))
+
+	quarantineTemplate = template.Must(template.New("quarantine").Parse(quarantineHTML))
 )
 
 var errRemote = errors.New("remote")
@@ -166,12 +258,9 @@ func serve(args []string) {
 	if !strings.HasSuffix(config.GoProxy, "/") {
 		config.GoProxy += "/"
 	}
-	for i, url := range config.VerifierURLs {
-		if strings.HasSuffix(url, "/") {
-			config.VerifierURLs[i] = config.VerifierURLs[i][:len(config.VerifierURLs[i])-1]
-		}
-	}
+	initVerifiers()
 	resultDir = filepath.Join(config.DataDir, "result")
+	initBlobStore()
 	if config.SDKVersionStop != "" {
 		v, err := parseGoVersion(config.SDKVersionStop)
 		if err != nil {
@@ -185,56 +274,29 @@ func serve(args []string) {
 	}
 	gobuildVersion += " " + runtime.Version()
 
-	var err error
-	workdir, err = os.Getwd()
-	if err != nil {
-		log.Fatalln("getwd:", err)
-	}
-
-	homedir = config.HomeDir
-	if !filepath.IsAbs(homedir) {
-		homedir = filepath.Join(workdir, config.HomeDir)
-	}
-	os.Mkdir(homedir, 0777) // failures will be caught later
-	// We need a clean name: we will be matching path prefixes against paths returned by
-	// go tools, that will have evaluated names.
-	homedir, err = filepath.EvalSymlinks(homedir)
-	if err != nil {
-		log.Fatalf("evaluating symlinks in homedir: %v", err)
+	if config.PrivSep != nil {
+		_, privsepFrontend = os.LookupEnv("GOBUILD_PRIVSEP")
+		if !privsepFrontend {
+			privsepRoot(*listenHTTP, *listenAdmin)
+		}
 	}
-	emptyDir = filepath.Join(homedir, "tmp")
-	os.MkdirAll(emptyDir, 0555)
-	os.MkdirAll(config.SDKDir, 0777)                        // may already exist, we'll get errors later
-	os.MkdirAll(filepath.Join(config.DataDir, "sum"), 0777) // may already exist, we'll get errors later
 
-	// Make directories for each leading char for urlsafe base64 data, for storing results.
-	os.MkdirAll(resultDir, 0777) // may already exist, we'll get errors later
-	mksumdir := func(c rune) {
-		os.MkdirAll(filepath.Join(resultDir, string(c)), 0777)
-	}
-	for c := 'a'; c <= 'z'; c++ {
-		mksumdir(c)
-	}
-	for c := 'A'; c <= 'Z'; c++ {
-		mksumdir(c)
-	}
-	for c := '0'; c <= '9'; c++ {
-		mksumdir(c)
-	}
-	mksumdir('-')
-	mksumdir('_')
+	initBuildDirs()
+	initResultDirs()
+	initBuildModcaches()
+	initGoproxy()
 
-	// Open data/sum/hashes and data/sum/records files for the lifetime of the program.
-	// Creating empty files is proper initialization.
-	hashesPath := filepath.Join(config.DataDir, "sum", "hashes")
-	hashesFile, err = os.OpenFile(hashesPath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0666)
-	if err != nil {
-		log.Fatalf("creating hashes file: %v", err)
+	// Open data/sum/hashes and data/sum/records files for the lifetime of the
+	// program, completing or rolling back an interrupted addition. With privilege
+	// separation, only the privileged process writes them.
+	var err error
+	if privsepFrontend {
+		sums, err = openFileStoreReadonly(filepath.Join(config.DataDir, "sum"))
+	} else {
+		sums, err = openFileStore(filepath.Join(config.DataDir, "sum"))
 	}
-	recordsPath := filepath.Join(config.DataDir, "sum", "records")
-	recordsFile, err = os.OpenFile(recordsPath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0666)
 	if err != nil {
-		log.Fatalf("creating records file: %v", err)
+		log.Fatalf("opening transparency log: %v", err)
 	}
 
 	// Verify the most recent additions to the records & hashes files are consistent.
@@ -242,6 +304,7 @@ func serve(args []string) {
 		log.Fatal(err)
 	} else {
 		metricTlogRecords.Set(float64(recordCount))
+		tlogStreamInit(recordCount)
 	}
 
 	// Lower limits on http DefaultTransport. We typically only connect to a few
@@ -255,9 +318,19 @@ func serve(args []string) {
 	}).DialContext
 
 	initSDK()
+	initSDKTargets()
 	readRecentBuilds()
 
 	go coordinateBuilds()
+	startFollowers()
+	if config.Retention != nil {
+		// With privilege separation, the privileged process removes binaries.
+		if !privsepFrontend {
+			go retainBinaries()
+		}
+		go writeBinaryAccessLoop()
+	}
+	go diskUsageLoop()
 
 	// When shutting down, make sure no modifications to transparency log are in progress.
 	sigc := make(chan os.Signal, 1)
@@ -269,6 +342,9 @@ func serve(args []string) {
 	}()
 
 	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/follow", serveFollow)
+	http.HandleFunc("/quarantine/", serveQuarantine)
+	http.HandleFunc("/queue", serveQueue)
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
@@ -303,12 +379,18 @@ func serve(args []string) {
 			log.Fatalf("new signer: %v", err)
 		}
 
-		h := http.StripPrefix("/tlog", sumdb.NewServer(serverOps{signer}))
+		h := http.StripPrefix("/tlog", withClient(sumdb.NewServer(serverOps{signer})))
 		for _, path := range sumdb.ServerPaths {
 			mux.Handle("/tlog"+path, h)
 		}
+		mux.HandleFunc("/tlog/stream", serveTlogStream(signer))
 	}
 
+	mux.HandleFunc("/s/", serveSum)
+	mux.HandleFunc("/batch", serveBatchCreate)
+	mux.HandleFunc("/batch/", serveBatch)
+	mux.HandleFunc("/worker/", serveWorker)
+
 	mux.HandleFunc("/img/gopher-dance-long.gif", func(w http.ResponseWriter, r *http.Request) {
 		defer observePage("dance", time.Now())
 		w.Header().Set("Content-Type", "image/gif")
@@ -334,9 +416,12 @@ func serve(args []string) {
 		os.MkdirAll(config.LogDir, 0777)
 		handler = newLogHandler(mux, config.LogDir)
 
-		sumLogFile, err = os.OpenFile(filepath.Join(config.LogDir, "sum.log"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
-		if err != nil {
-			log.Fatalf("open sum.log: %v", err)
+		// With privilege separation, the privileged process writes sum.log.
+		if !privsepFrontend {
+			sumLogFile, err = os.OpenFile(filepath.Join(config.LogDir, "sum.log"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+			if err != nil {
+				log.Fatalf("open sum.log: %v", err)
+			}
 		}
 
 		if httperror, err := os.OpenFile(filepath.Join(config.LogDir, "httperror.log"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666); err != nil {
@@ -360,6 +445,9 @@ func serve(args []string) {
 				Handler:  handler,
 				ErrorLog: httpErrorLog,
 			}
+			if privsepFrontend {
+				log.Fatal(server.Serve(privsepListener("http")))
+			}
 			log.Fatal(server.ListenAndServe())
 		}()
 	}
@@ -377,12 +465,18 @@ func serve(args []string) {
 				Handler:  handler,
 				ErrorLog: httpErrorLog,
 			}
+			if privsepFrontend {
+				log.Fatal(server.Serve(tls.NewListener(privsepListener("https"), m.TLSConfig())))
+			}
 			log.Fatal(server.Serve(m.Listener()))
 		}()
 	}
 	if *listenAdmin != "" {
 		msg += " admin " + *listenAdmin
 		go func() {
+			if privsepFrontend {
+				log.Fatal(http.Serve(privsepListener("admin"), nil))
+			}
 			log.Fatal(http.ListenAndServe(*listenAdmin, nil))
 		}()
 	}
@@ -390,6 +484,53 @@ func serve(args []string) {
 	select {}
 }
 
+// Set workdir, homedir and emptyDir, and create the directories needed for
+// running go commands. Used by serve and worker.
+func initBuildDirs() {
+	var err error
+	workdir, err = os.Getwd()
+	if err != nil {
+		log.Fatalln("getwd:", err)
+	}
+
+	homedir = config.HomeDir
+	if !filepath.IsAbs(homedir) {
+		homedir = filepath.Join(workdir, config.HomeDir)
+	}
+	os.Mkdir(homedir, 0777) // failures will be caught later
+	// We need a clean name: we will be matching path prefixes against paths returned by
+	// go tools, that will have evaluated names.
+	homedir, err = filepath.EvalSymlinks(homedir)
+	if err != nil {
+		log.Fatalf("evaluating symlinks in homedir: %v", err)
+	}
+	emptyDir = filepath.Join(homedir, "tmp")
+	os.MkdirAll(emptyDir, 0555)
+	os.MkdirAll(config.SDKDir, 0777) // may already exist, we'll get errors later
+}
+
+// Create the directories for the transparency log and results.
+func initResultDirs() {
+	os.MkdirAll(filepath.Join(config.DataDir, "sum"), 0777) // may already exist, we'll get errors later
+
+	// Make directories for each leading char for urlsafe base64 data, for storing results.
+	os.MkdirAll(resultDir, 0777) // may already exist, we'll get errors later
+	mksumdir := func(c rune) {
+		os.MkdirAll(filepath.Join(resultDir, string(c)), 0777)
+	}
+	for c := 'a'; c <= 'z'; c++ {
+		mksumdir(c)
+	}
+	for c := 'A'; c <= 'Z'; c++ {
+		mksumdir(c)
+	}
+	for c := '0'; c <= '9'; c++ {
+		mksumdir(c)
+	}
+	mksumdir('-')
+	mksumdir('_')
+}
+
 func failf(w http.ResponseWriter, format string, args ...interface{}) {
 	err := fmt.Errorf(format, args...)
 	msg := err.Error()
@@ -409,15 +550,15 @@ func failf(w http.ResponseWriter, format string, args ...interface{}) {
 	errorTemplate.Execute(w, map[string]string{"Message": msg})
 }
 
-func serveLog(w http.ResponseWriter, r *http.Request, p string) {
-	f, err := os.Open(p)
+func serveLog(w http.ResponseWriter, r *http.Request, bs buildSpec) {
+	f, err := openBuildLog(bs)
 	if err != nil {
 		failf(w, "%w: open log.gz: %v", errServer, err)
 		return
 	}
 	defer f.Close()
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	serveGzipFile(w, r, p, f)
+	serveGzipFile(w, r, "log.gz", f)
 }
 
 func serveGzipFile(w http.ResponseWriter, r *http.Request, path string, src io.Reader) {
@@ -448,18 +589,12 @@ func acceptsGzip(r *http.Request) bool {
 }
 
 func verifySumState() (int64, error) {
-	// Verify records & hashes files have consistent sizes.
-	numRecords, err := treeSize()
+	numRecords, err := sums.treeSize()
 	if err != nil {
 		return -1, fmt.Errorf("finding number of records in tlog: %v", err)
 	}
-	if info, err := hashesFile.Stat(); err != nil {
-		return -1, fmt.Errorf("stat on hashes file: %v", err)
-	} else if hashCount := tlog.StoredHashCount(numRecords); hashCount*tlog.HashSize != info.Size() {
-		return -1, fmt.Errorf("inconsistent size of hashes file of %d bytes for %d records, should be %d", info.Size(), numRecords, hashCount*tlog.HashSize)
-	}
 
-	// For the latest record on disk, verify the hashes on disk match the record.
+	// Verify the latest record on disk. The "verify-log" subcommand checks all records.
 	if numRecords == 0 {
 		return 0, nil
 	}
@@ -469,50 +604,16 @@ func verifySumState() (int64, error) {
 	if err != nil {
 		return -1, fmt.Errorf("reading last record: %v", err)
 	}
-	hashes, err := tlog.StoredHashes(lastRecordNum, records[0], hashReader{})
-	if err != nil {
-		return -1, fmt.Errorf("calculating hashes for most recent record: %v", err)
-	}
-	buf := make([]byte, len(hashes)*tlog.HashSize)
-	if _, err := hashesFile.ReadAt(buf, tlog.StoredHashIndex(0, lastRecordNum)*tlog.HashSize); err != nil {
-		return -1, fmt.Errorf("reading hashes for verification: %v", err)
-	}
-	for i := range hashes {
-		o := i * tlog.HashSize
-		h := buf[o : o+tlog.HashSize]
-		if !bytes.Equal(hashes[i][:], h) {
-			return -1, fmt.Errorf("hash %d mismatch for last record %d, got %x, expect %x", i, lastRecordNum, h, hashes[i][:])
+	// Checks the hashes on disk, whether the recordnumber file is available (i.e. if
+	// a lookup will succeed), and whether the binary matches the sum.
+	_, issues := checkRecord(lastRecordNum, records[0], false)
+	for _, li := range issues {
+		// The sum index is not essential, and can be repaired while running.
+		if li.Kind == issueSumIndex {
+			log.Printf("warning: %s, run verify-log -repair", li)
+			continue
 		}
-	}
-
-	// Also check if the recordnumber file is available, i.e. if a lookup will succeed.
-	record, err := parseRecord(records[0])
-	if err != nil {
-		return -1, fmt.Errorf("parsing last record: %v", err)
-	}
-	if buf, err := os.ReadFile(filepath.Join(record.storeDir(), "recordnumber")); err != nil {
-		return -1, fmt.Errorf("open recordnumber: %v", err)
-	} else if num, err := strconv.ParseInt(string(buf), 10, 64); err != nil {
-		return -1, fmt.Errorf("parse recordnumber from file: %v", err)
-	} else if num != lastRecordNum {
-		return -1, fmt.Errorf("inconsistent last recordnumber %d, expected %d", num, lastRecordNum)
-	}
-
-	// And check if the hash of the binary matches the sum.
-	h := sha256.New()
-	f, err := os.Open(filepath.Join(record.storeDir(), "binary.gz"))
-	if err != nil {
-		return -1, fmt.Errorf("open binary.gz for verification: %v", err)
-	}
-	defer f.Close()
-	if gzr, err := gzip.NewReader(f); err != nil {
-		return -1, fmt.Errorf("gzip reader for binary.gz: %v", err)
-	} else if _, err := io.Copy(h, gzr); err != nil {
-		return -1, fmt.Errorf("reading binary.gz for verification: %v", err)
-	} else if sum := "0" + base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:20]); sum != record.Sum {
-		return -1, fmt.Errorf("latest binary.gz sum mismatch, got %s, expect %s", sum, record.Sum)
-	} else if err := f.Close(); err != nil {
-		return -1, fmt.Errorf("close binary.gz: %v", err)
+		return -1, fmt.Errorf("verifying last record: %s", li)
 	}
 	return numRecords, nil
 }
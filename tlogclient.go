@@ -17,6 +17,9 @@ import (
 type clientOps struct {
 	localDir string
 	baseURL  string
+
+	// If not nil, called for security errors instead of exiting.
+	securityError func(msg string)
 }
 
 var _ sumdb.ClientOps = (*clientOps)(nil)
@@ -41,10 +44,12 @@ func newClient(vkey string, baseURL string) (*sumdb.Client, *clientOps, error) {
 	if err != nil {
 		return nil, nil, err
 	}
-	ops := &clientOps{
-		filepath.Join(dir, "gobuild", "sumclient", verifier.Name()),
-		baseURL,
-	}
+	return newClientDir(vkey, baseURL, filepath.Join(dir, "gobuild", "sumclient", verifier.Name()))
+}
+
+// newClientDir returns a client that keeps its state in localDir. BaseURL must be set.
+func newClientDir(vkey, baseURL, localDir string) (*sumdb.Client, *clientOps, error) {
+	ops := &clientOps{localDir, strings.TrimRight(baseURL, "/"), nil}
 
 	if ovkey, err := ops.ReadConfig("key"); err != nil {
 		if !os.IsNotExist(err) {
@@ -154,5 +159,9 @@ func (c *clientOps) Log(msg string) {
 // but the return value is mainly for testing. In a real program,
 // SecurityError should typically print the message and call log.Fatal or os.Exit.
 func (c *clientOps) SecurityError(msg string) {
+	if c.securityError != nil {
+		c.securityError(msg)
+		return
+	}
 	log.Fatalln(msg)
 }
@@ -25,14 +25,7 @@ var _ sumdb.ServerOps = serverOps{}
 type hashReader struct{}
 
 func (h hashReader) ReadHashes(indexes []int64) ([]tlog.Hash, error) {
-	hashes := make([]tlog.Hash, len(indexes))
-
-	for i, index := range indexes {
-		if _, err := hashesFile.ReadAt(hashes[i][:], index*tlog.HashSize); err != nil {
-			return nil, err
-		}
-	}
-	return hashes, nil
+	return sums.readHashes(indexes)
 }
 
 func observeOp(rerr *error, t0 time.Time, errorCounter prometheus.Counter, histo prometheus.Histogram) {
@@ -46,7 +39,7 @@ func observeOp(rerr *error, t0 time.Time, errorCounter prometheus.Counter, histo
 func (s serverOps) Signed(ctx context.Context) (result []byte, rerr error) {
 	defer observeOp(&rerr, time.Now(), metricTlogOpsSignedErrors, metricTlogOpsSignedDuration)
 
-	if n, err := treeSize(); err != nil {
+	if n, err := sums.treeSize(); err != nil {
 		return nil, err
 	} else if h, err := tlog.TreeHash(n, hashReader{}); err != nil {
 		return nil, err
@@ -65,18 +58,7 @@ func (s serverOps) ReadRecords(ctx context.Context, id, n int64) (results [][]by
 		return nil, fmt.Errorf("bad n")
 	}
 
-	all := make([]byte, n*diskRecordSize)
-	if _, err := recordsFile.ReadAt(all, id*diskRecordSize); err != nil {
-		return nil, fmt.Errorf("reading records: %v", err)
-	}
-	result := make([][]byte, n)
-	for i := int64(0); i < n; i++ {
-		buf := all[:diskRecordSize]
-		all = all[diskRecordSize:]
-		size := int(buf[0])<<8 | int(buf[1])
-		result[i] = buf[2 : 2+size]
-	}
-	return result, nil
+	return sums.readRecords(id, n)
 }
 
 // Lookup looks up a record for the given key,
@@ -145,14 +127,14 @@ func lookupBuild(ctx context.Context, bs buildSpec) (int64, error) {
 
 	// Attempt to build.
 	if err := prepareBuild(bs); err != nil {
-		if errors.Is(err, errBadGoversion) || errors.Is(err, os.ErrNotExist) || errors.Is(err, errNotExist) || errors.Is(err, errBadModule) || errors.Is(err, errBadVersion) {
+		if errors.Is(err, errBadGoversion) || errors.Is(err, os.ErrNotExist) || errors.Is(err, errNotExist) || errors.Is(err, errBadModule) || errors.Is(err, errBadVersion) || errors.Is(err, errBadOptions) || errors.Is(err, errBadVariant) || errors.Is(err, errBadTarget) {
 			return -1, os.ErrNotExist
 		}
 		return -1, fmt.Errorf("preparing build: %w", err)
 	}
 
 	eventc := make(chan buildUpdate, 100)
-	registerBuild(bs, eventc)
+	registerBuild(bs, contextClient(ctx), eventc)
 
 	for {
 		select {
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/mod/sumdb/tlog"
+)
+
+// The on-disk record is 512 bytes: 2-byte big endian size, followed by n bytes content, followed by zero bytes.
+const diskRecordSize = 512
+
+// sumStore is the storage for the transparency log: the records, the hashes of
+// the tree, and the "recordnumber" index files in the result directories that
+// map a build to its record.
+type sumStore interface {
+	// Number of records in the log.
+	treeSize() (int64, error)
+
+	// Read hashes at the stored hash indexes, see tlog.StoredHashIndex.
+	readHashes(indexes []int64) ([]tlog.Hash, error)
+
+	// Read n records, starting at id.
+	readRecords(id, n int64) ([][]byte, error)
+
+	// Add record as record number rn, along with its hashes as calculated by
+	// tlog.StoredHashes. Tmpdir must already contain the "recordnumber" file, and
+	// is renamed to storeDir. Either all changes are made, or none are. The sum
+	// is added to the index for lookupSum.
+	add(rn int64, record []byte, hashes []tlog.Hash, sum, tmpdir, storeDir string) error
+
+	// Return record numbers with the sum, in increasing order. Typically only one.
+	lookupSum(sum string) ([]int64, error)
+
+	// Add record number to the index for sum, if not already present. Used for
+	// repairing the index, add updates the index itself.
+	indexSum(sum string, rn int64) error
+}
+
+// The global store, opened at startup.
+var sums sumStore
+
+// fileStore keeps records and hashes in two append-only files. Before an
+// addition is made, the complete change is written to a journal file. After all
+// changes are applied, the journal is removed. If gobuild stops halfway, the
+// journal is found on the next startup, and the change is either completed or
+// rolled back.
+type fileStore struct {
+	dir                     string
+	hashesFile, recordsFile *os.File
+}
+
+var _ sumStore = (*fileStore)(nil)
+
+// journal describes a single addition to the log. Offsets are the file sizes
+// before the addition.
+type journal struct {
+	RecordNumber  int64
+	HashesOffset  int64
+	RecordsOffset int64
+	Hashes        []byte // All hashes, concatenated.
+	Record        []byte // As written to disk, diskRecordSize bytes.
+	Sum           string
+	Tmpdir        string
+	StoreDir      string
+}
+
+// Open the hashes & records files in dir, creating them if needed. A pending
+// journal from an interrupted addition is replayed.
+func openFileStore(dir string) (*fileStore, error) {
+	s, err := openFileStoreFlags(dir, os.O_APPEND|os.O_CREATE|os.O_RDWR)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.recover(); err != nil {
+		return nil, fmt.Errorf("recovering from journal: %v", err)
+	}
+	if err := s.checkSizes(); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(s.sumIndexDir()); err != nil && os.IsNotExist(err) {
+		if err := s.rebuildSumIndex(); err != nil {
+			return nil, fmt.Errorf("building sum index: %v", err)
+		}
+	}
+	return s, nil
+}
+
+// Open the store for reading only, for inspection while another process may be
+// writing. A journal is not replayed, and sizes are not checked.
+func openFileStoreReadonly(dir string) (*fileStore, error) {
+	return openFileStoreFlags(dir, os.O_RDONLY)
+}
+
+func openFileStoreFlags(dir string, flags int) (*fileStore, error) {
+	s := &fileStore{dir: dir}
+	var err error
+	// Creating empty files is proper initialization.
+	s.hashesFile, err = os.OpenFile(filepath.Join(dir, "hashes"), flags, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("opening hashes file: %v", err)
+	}
+	s.recordsFile, err = os.OpenFile(filepath.Join(dir, "records"), flags, 0666)
+	if err != nil {
+		s.hashesFile.Close()
+		return nil, fmt.Errorf("opening records file: %v", err)
+	}
+	return s, nil
+}
+
+func (s *fileStore) journalPath() string {
+	return filepath.Join(s.dir, "journal")
+}
+
+// Verify records & hashes files have consistent sizes.
+func (s *fileStore) checkSizes() error {
+	n, err := s.treeSize()
+	if err != nil {
+		return err
+	}
+	if info, err := s.hashesFile.Stat(); err != nil {
+		return fmt.Errorf("stat on hashes file: %v", err)
+	} else if hashCount := tlog.StoredHashCount(n); hashCount*tlog.HashSize != info.Size() {
+		return fmt.Errorf("inconsistent size of hashes file of %d bytes for %d records, should be %d", info.Size(), n, hashCount*tlog.HashSize)
+	}
+	return nil
+}
+
+func (s *fileStore) treeSize() (int64, error) {
+	if info, err := s.recordsFile.Stat(); err != nil {
+		return 0, err
+	} else if info.Size()%diskRecordSize != 0 {
+		return 0, fmt.Errorf("inconsistent size of records file: %d is not multiple of diskRecordSize %d", info.Size(), diskRecordSize)
+	} else {
+		return info.Size() / diskRecordSize, nil
+	}
+}
+
+func (s *fileStore) readHashes(indexes []int64) ([]tlog.Hash, error) {
+	hashes := make([]tlog.Hash, len(indexes))
+	for i, index := range indexes {
+		if _, err := s.hashesFile.ReadAt(hashes[i][:], index*tlog.HashSize); err != nil {
+			return nil, err
+		}
+	}
+	return hashes, nil
+}
+
+func (s *fileStore) readRecords(id, n int64) ([][]byte, error) {
+	all := make([]byte, n*diskRecordSize)
+	if _, err := s.recordsFile.ReadAt(all, id*diskRecordSize); err != nil {
+		return nil, fmt.Errorf("reading records: %v", err)
+	}
+	result := make([][]byte, n)
+	for i := int64(0); i < n; i++ {
+		buf := all[:diskRecordSize]
+		all = all[diskRecordSize:]
+		size := int(buf[0])<<8 | int(buf[1])
+		result[i] = buf[2 : 2+size]
+	}
+	return result, nil
+}
+
+func (s *fileStore) add(rn int64, record []byte, hashes []tlog.Hash, sum, tmpdir, storeDir string) error {
+	if len(record) > diskRecordSize-2 {
+		return fmt.Errorf("record too large")
+	}
+
+	// A journal left behind by an earlier failed addition must be resolved first,
+	// which happens at startup.
+	if _, err := os.Stat(s.journalPath()); err == nil {
+		metricTlogConsistencyErrors.Inc()
+		return fmt.Errorf("pending journal from earlier failed addition, restart to recover")
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("checking for journal: %v", err)
+	}
+
+	hinfo, err := s.hashesFile.Stat()
+	if err != nil {
+		return fmt.Errorf("stat hashes file: %v", err)
+	}
+	expHashes := tlog.StoredHashCount(rn)
+	if expHashes*tlog.HashSize != hinfo.Size() {
+		metricTlogConsistencyErrors.Inc()
+		return fmt.Errorf("unexpected size of hashes file: for %d records, we should have %d hashes, for a total of %d bytes, but file is %d bytes", rn, expHashes, expHashes*tlog.HashSize, hinfo.Size())
+	}
+
+	j := journal{
+		RecordNumber:  rn,
+		HashesOffset:  hinfo.Size(),
+		RecordsOffset: rn * diskRecordSize,
+		Hashes:        make([]byte, len(hashes)*tlog.HashSize),
+		Record:        make([]byte, diskRecordSize),
+		Sum:           sum,
+		Tmpdir:        tmpdir,
+		StoreDir:      storeDir,
+	}
+	for i, h := range hashes {
+		copy(j.Hashes[i*tlog.HashSize:], h[:])
+	}
+	j.Record[0] = uint8(len(record) >> 8)
+	j.Record[1] = uint8(len(record))
+	copy(j.Record[2:], record)
+
+	if err := s.writeJournal(j); err != nil {
+		return fmt.Errorf("writing journal: %v", err)
+	}
+
+	// From here on, a crash is recovered from at startup. Errors we can handle
+	// ourselves by rolling back.
+	if err := s.apply(j); err != nil {
+		if xerr := s.rollback(j); xerr != nil {
+			metricTlogConsistencyErrors.Inc()
+			log.Printf("CRITICAL: rolling back addition of record %d: %v, journal kept for recovery at next startup", rn, xerr)
+		}
+		return err
+	}
+	if err := os.Remove(s.journalPath()); err != nil {
+		// The addition is complete, a replay of the journal at startup would leave it as is.
+		log.Printf("removing journal after adding record %d: %v", rn, err)
+	}
+	return nil
+}
+
+// Write journal to a temporary file, then rename it into place, so a journal is
+// either complete or absent.
+func (s *fileStore) writeJournal(j journal) error {
+	buf, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	p := s.journalPath()
+	f, err := os.Create(p + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if f != nil {
+			f.Close()
+			os.Remove(p + ".tmp")
+		}
+	}()
+	if _, err := f.Write(buf); err != nil {
+		return err
+	} else if err := f.Sync(); err != nil {
+		return err
+	} else if err := f.Close(); err != nil {
+		return err
+	}
+	f = nil
+	if err := os.Rename(p+".tmp", p); err != nil {
+		return err
+	}
+	return syncDir(s.dir)
+}
+
+// Apply the changes described in the journal. The records and hashes files must
+// be at their offsets as in the journal.
+func (s *fileStore) apply(j journal) error {
+	if _, err := s.hashesFile.Write(j.Hashes); err != nil {
+		return fmt.Errorf("write hashes: %v", err)
+	} else if err := s.hashesFile.Sync(); err != nil {
+		return fmt.Errorf("sync hashes file: %v", err)
+	}
+	if _, err := s.recordsFile.Write(j.Record); err != nil {
+		return fmt.Errorf("write record: %v", err)
+	} else if err := s.recordsFile.Sync(); err != nil {
+		return fmt.Errorf("sync records file: %v", err)
+	}
+
+	// Put the tmp directory in place. From now on, lookups will succeed. This is
+	// the point of no return, later failures cannot be rolled back.
+	if j.Tmpdir != "" {
+		if err := os.Rename(j.Tmpdir, j.StoreDir); err != nil {
+			return fmt.Errorf("renaming to final directory in resultDir: %w", err)
+		}
+		if err := syncDir(filepath.Dir(j.StoreDir)); err != nil {
+			log.Printf("sync result dir after adding record %d: %v", j.RecordNumber, err)
+		}
+	}
+
+	// The index can be rebuilt from the records, so a failure is not fatal. The
+	// "verify-log -repair" subcommand fixes it.
+	if j.Sum != "" {
+		if err := s.indexSum(j.Sum, j.RecordNumber); err != nil {
+			metricTlogConsistencyErrors.Inc()
+			log.Printf("adding record %d to sum index: %v", j.RecordNumber, err)
+		}
+	}
+	return nil
+}
+
+func (s *fileStore) sumIndexDir() string {
+	return filepath.Join(s.dir, "bysum")
+}
+
+// Files in the sum index are named after the sum, in a directory named after
+// the first character after the version.
+func (s *fileStore) sumIndexPath(sum string) string {
+	return filepath.Join(s.sumIndexDir(), sum[1:2], sum)
+}
+
+func (s *fileStore) lookupSum(sum string) ([]int64, error) {
+	if !isSum(sum) {
+		return nil, fmt.Errorf("bad sum")
+	}
+	buf, err := os.ReadFile(s.sumIndexPath(sum))
+	if err != nil {
+		return nil, err
+	}
+	var l []int64
+	for _, line := range strings.Split(strings.TrimSpace(string(buf)), "\n") {
+		num, err := strconv.ParseInt(line, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parsing record number in sum index: %v", err)
+		}
+		l = append(l, num)
+	}
+	return l, nil
+}
+
+func (s *fileStore) indexSum(sum string, rn int64) error {
+	return writeSumIndex(s.sumIndexPath(sum), rn)
+}
+
+// Add rn to the sum index file at p, with a write to a temporary file and rename.
+func writeSumIndex(p string, rn int64) error {
+	var nums []int64
+	if buf, err := os.ReadFile(p); err == nil {
+		for _, line := range strings.Split(strings.TrimSpace(string(buf)), "\n") {
+			num, err := strconv.ParseInt(line, 10, 64)
+			if err != nil {
+				return fmt.Errorf("parsing record number in sum index: %v", err)
+			}
+			if num == rn {
+				return nil
+			}
+			nums = append(nums, num)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	nums = append(nums, rn)
+	sort.Slice(nums, func(i, j int) bool {
+		return nums[i] < nums[j]
+	})
+	var b strings.Builder
+	for _, num := range nums {
+		fmt.Fprintf(&b, "%d\n", num)
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+		return err
+	}
+	if err := os.WriteFile(p+".tmp", []byte(b.String()), 0666); err != nil {
+		return err
+	}
+	return os.Rename(p+".tmp", p)
+}
+
+// Build the sum index from the records, for logs created before the index
+// existed. The index is created in a temporary directory that is renamed into
+// place when complete.
+func (s *fileStore) rebuildSumIndex() error {
+	n, err := s.treeSize()
+	if err != nil {
+		return err
+	}
+	log.Printf("building sum index for %d records", n)
+
+	tmpdir := s.sumIndexDir() + ".tmp"
+	if err := os.RemoveAll(tmpdir); err != nil {
+		return err
+	}
+	for first := int64(0); first < n; first += 1000 {
+		count := n - first
+		if count > 1000 {
+			count = 1000
+		}
+		records, err := s.readRecords(first, count)
+		if err != nil {
+			return err
+		}
+		for i, record := range records {
+			br, err := parseRecord(record)
+			if err != nil {
+				return fmt.Errorf("parsing record %d: %v", first+int64(i), err)
+			}
+			if err := writeSumIndex(filepath.Join(tmpdir, br.Sum[1:2], br.Sum), first+int64(i)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := os.MkdirAll(tmpdir, 0777); err != nil {
+		return err
+	}
+	return os.Rename(tmpdir, s.sumIndexDir())
+}
+
+// Undo partial writes to the records and hashes files, and remove the journal.
+// The tmpdir is left for the caller to clean up.
+func (s *fileStore) rollback(j journal) error {
+	if err := s.truncate(j); err != nil {
+		return err
+	}
+	return os.Remove(s.journalPath())
+}
+
+func (s *fileStore) truncate(j journal) error {
+	if err := s.hashesFile.Truncate(j.HashesOffset); err != nil {
+		return fmt.Errorf("truncating hashes file: %v", err)
+	} else if err := s.hashesFile.Sync(); err != nil {
+		return fmt.Errorf("sync hashes file: %v", err)
+	}
+	if err := s.recordsFile.Truncate(j.RecordsOffset); err != nil {
+		return fmt.Errorf("truncating records file: %v", err)
+	} else if err := s.recordsFile.Sync(); err != nil {
+		return fmt.Errorf("sync records file: %v", err)
+	}
+	return nil
+}
+
+// Replay a journal left behind by an interrupted addition. If the result
+// directory with the build files is still present, the addition is completed.
+// Otherwise it is rolled back.
+func (s *fileStore) recover() error {
+	buf, err := os.ReadFile(s.journalPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var j journal
+	if err := json.Unmarshal(buf, &j); err != nil {
+		return fmt.Errorf("parsing journal: %v", err)
+	}
+
+	log.Printf("found journal for record %d, key %s, recovering", j.RecordNumber, j.StoreDir)
+
+	// Start from the state before the addition, discarding partial writes.
+	if err := s.truncate(j); err != nil {
+		return err
+	}
+
+	hasRecordNumber := func(dir string) bool {
+		buf, err := os.ReadFile(filepath.Join(dir, "recordnumber"))
+		if err != nil {
+			return false
+		}
+		num, err := strconv.ParseInt(string(buf), 10, 64)
+		return err == nil && num == j.RecordNumber
+	}
+
+	if hasRecordNumber(j.StoreDir) {
+		// Rename to final directory had completed.
+		j.Tmpdir = ""
+	} else if !hasRecordNumber(j.Tmpdir) {
+		log.Printf("result directory for record %d not present, rolling back", j.RecordNumber)
+		return os.Remove(s.journalPath())
+	}
+	if err := s.apply(j); err != nil {
+		return err
+	}
+	log.Printf("completed addition of record %d", j.RecordNumber)
+	return os.Remove(s.journalPath())
+}
+
+// Sync directory, making renames/creations of directory entries durable.
+func syncDir(dir string) error {
+	// Directories cannot be opened for syncing on Windows.
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/mod/sumdb/tlog"
+)
+
+// Record for a build of version v, with a sum derived from v.
+func testRecord(t *testing.T, v string) []byte {
+	t.Helper()
+	h := sha256.Sum256([]byte(v))
+	br := buildResult{
+		buildSpec: buildSpec{Mod: "example.com/cmd", Version: v, Dir: "/", Goos: "linux", Goarch: "amd64", Goversion: "go1.21.0"},
+		Filesize:  1,
+		Sum:       "0" + base64.RawURLEncoding.EncodeToString(h[:20]),
+	}
+	buf, err := br.packRecord()
+	if err != nil {
+		t.Fatalf("pack record: %v", err)
+	}
+	return buf
+}
+
+// Make a result directory in parent with a "recordnumber" file, like addSum.
+func testResultTmpdir(t *testing.T, parent string, rn int64) string {
+	t.Helper()
+	dir, err := os.MkdirTemp(parent, "tmpresult")
+	if err != nil {
+		t.Fatalf("tmpdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "recordnumber"), []byte(fmt.Sprintf("%d", rn)), 0666); err != nil {
+		t.Fatalf("write recordnumber: %v", err)
+	}
+	return dir
+}
+
+// Sum of the build in record.
+func testRecordSum(t *testing.T, record []byte) string {
+	t.Helper()
+	br, err := parseRecord(record)
+	if err != nil {
+		t.Fatalf("parse record: %v", err)
+	}
+	return br.Sum
+}
+
+// Journal for adding record as the next record, like add writes it.
+func testJournal(t *testing.T, s *fileStore, record []byte, tmpdir, storeDir string) journal {
+	t.Helper()
+	rn, err := s.treeSize()
+	if err != nil {
+		t.Fatalf("tree size: %v", err)
+	}
+	hashes, err := tlog.StoredHashes(rn, record, tlog.HashReaderFunc(s.readHashes))
+	if err != nil {
+		t.Fatalf("hashes: %v", err)
+	}
+	j := journal{
+		RecordNumber:  rn,
+		HashesOffset:  tlog.StoredHashCount(rn) * tlog.HashSize,
+		RecordsOffset: rn * diskRecordSize,
+		Hashes:        make([]byte, len(hashes)*tlog.HashSize),
+		Record:        make([]byte, diskRecordSize),
+		Sum:           testRecordSum(t, record),
+		Tmpdir:        tmpdir,
+		StoreDir:      storeDir,
+	}
+	for i, h := range hashes {
+		copy(j.Hashes[i*tlog.HashSize:], h[:])
+	}
+	j.Record[0] = uint8(len(record) >> 8)
+	j.Record[1] = uint8(len(record))
+	copy(j.Record[2:], record)
+	return j
+}
+
+func testAdd(t *testing.T, s *fileStore, record []byte, tmpdir, storeDir string) error {
+	t.Helper()
+	rn, err := s.treeSize()
+	if err != nil {
+		t.Fatalf("tree size: %v", err)
+	}
+	hashes, err := tlog.StoredHashes(rn, record, tlog.HashReaderFunc(s.readHashes))
+	if err != nil {
+		t.Fatalf("hashes: %v", err)
+	}
+	return s.add(rn, record, hashes, testRecordSum(t, record), tmpdir, storeDir)
+}
+
+func testCloseStore(s *fileStore) {
+	s.hashesFile.Close()
+	s.recordsFile.Close()
+}
+
+// Check the store has the records, and consistent hashes.
+func testCheckStore(t *testing.T, s *fileStore, records ...[]byte) {
+	t.Helper()
+	n, err := s.treeSize()
+	if err != nil {
+		t.Fatalf("tree size: %v", err)
+	}
+	if n != int64(len(records)) {
+		t.Fatalf("tree size %d, expected %d", n, len(records))
+	}
+	if err := s.checkSizes(); err != nil {
+		t.Fatalf("check sizes: %v", err)
+	}
+	if n > 0 {
+		l, err := s.readRecords(0, n)
+		if err != nil {
+			t.Fatalf("read records: %v", err)
+		}
+		for i, record := range records {
+			if string(l[i]) != string(record) {
+				t.Fatalf("record %d is %q, expected %q", i, l[i], record)
+			}
+		}
+	}
+	if _, err := os.Stat(s.journalPath()); !os.IsNotExist(err) {
+		t.Fatalf("journal present: %v", err)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	dir := t.TempDir()
+	results := t.TempDir()
+
+	s, err := openFileStore(dir)
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	testCheckStore(t, s)
+
+	r0 := testRecord(t, "v1.0.0")
+	r1 := testRecord(t, "v1.0.1")
+	for i, r := range [][]byte{r0, r1} {
+		storeDir := filepath.Join(results, fmt.Sprintf("%d", i))
+		if err := testAdd(t, s, r, testResultTmpdir(t, results, int64(i)), storeDir); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(storeDir, "recordnumber")); err != nil {
+			t.Fatalf("result directory not in place: %v", err)
+		}
+	}
+	testCheckStore(t, s, r0, r1)
+
+	// Wrong record number.
+	if err := s.add(5, r1, nil, testRecordSum(t, r1), testResultTmpdir(t, results, 5), filepath.Join(results, "5")); err == nil {
+		t.Fatalf("add with wrong record number succeeded")
+	}
+
+	// Failure to rename the result directory into place is rolled back.
+	r2 := testRecord(t, "v1.0.2")
+	if err := testAdd(t, s, r2, testResultTmpdir(t, results, 2), filepath.Join(results, "missing", "2")); err == nil {
+		t.Fatalf("add with bad store dir succeeded")
+	}
+	testCheckStore(t, s, r0, r1)
+
+	// A pending journal blocks additions.
+	j := testJournal(t, s, r2, testResultTmpdir(t, results, 2), filepath.Join(results, "2"))
+	if err := s.writeJournal(j); err != nil {
+		t.Fatalf("write journal: %v", err)
+	}
+	if err := testAdd(t, s, r2, testResultTmpdir(t, results, 2), filepath.Join(results, "2")); err == nil {
+		t.Fatalf("add with pending journal succeeded")
+	}
+	os.Remove(s.journalPath())
+	testCloseStore(s)
+
+	// Recover from an interrupted addition, with the files at the states they can be
+	// left in.
+	type interrupted struct {
+		name     string
+		tmpdir   bool                          // Whether the tmpdir with recordnumber is present.
+		write    func(s *fileStore, j journal) // Partial changes made before the interruption.
+		complete bool                          // Whether recovery should complete the addition.
+	}
+	tests := []interrupted{
+		{"nothing", true, func(s *fileStore, j journal) {}, true},
+		{"partial hashes", true, func(s *fileStore, j journal) {
+			s.hashesFile.Write(j.Hashes[:5])
+		}, true},
+		{"partial record", true, func(s *fileStore, j journal) {
+			s.hashesFile.Write(j.Hashes)
+			s.recordsFile.Write(j.Record[:100])
+		}, true},
+		{"renamed", true, func(s *fileStore, j journal) {
+			if err := s.apply(j); err != nil {
+				t.Fatalf("apply: %v", err)
+			}
+		}, true},
+		{"without tmpdir", false, func(s *fileStore, j journal) {
+			s.hashesFile.Write(j.Hashes)
+			s.recordsFile.Write(j.Record)
+		}, false},
+	}
+	records := [][]byte{r0, r1}
+	for i, tc := range tests {
+		s, err := openFileStore(dir)
+		if err != nil {
+			t.Fatalf("%s: open store: %v", tc.name, err)
+		}
+		rn := int64(len(records))
+		r := testRecord(t, fmt.Sprintf("v1.1.%d", i))
+		tmpdir := filepath.Join(results, "tmp")
+		if tc.tmpdir {
+			tmpdir = testResultTmpdir(t, results, rn)
+		}
+		storeDir := filepath.Join(results, fmt.Sprintf("%d", rn))
+		j := testJournal(t, s, r, tmpdir, storeDir)
+		if err := s.writeJournal(j); err != nil {
+			t.Fatalf("%s: write journal: %v", tc.name, err)
+		}
+		tc.write(s, j)
+		testCloseStore(s)
+
+		s, err = openFileStore(dir)
+		if err != nil {
+			t.Fatalf("%s: open store for recovery: %v", tc.name, err)
+		}
+		if tc.complete {
+			records = append(records, r)
+		}
+		testCheckStore(t, s, records...)
+		if _, err := os.Stat(storeDir); tc.complete != (err == nil) {
+			t.Fatalf("%s: result directory present %v, expected %v", tc.name, err == nil, tc.complete)
+		}
+		testCloseStore(s)
+	}
+}
+
+func testLookupSum(t *testing.T, s *fileStore, record []byte, exp ...int64) {
+	t.Helper()
+	l, err := s.lookupSum(testRecordSum(t, record))
+	if len(exp) == 0 {
+		if !os.IsNotExist(err) {
+			t.Fatalf("lookup sum: got %v, err %v, expected not found", l, err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("lookup sum: %v", err)
+	}
+	if fmt.Sprint(l) != fmt.Sprint(exp) {
+		t.Fatalf("lookup sum: got %v, expected %v", l, exp)
+	}
+}
+
+func TestSumIndex(t *testing.T) {
+	dir := t.TempDir()
+	results := t.TempDir()
+
+	s, err := openFileStore(dir)
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+
+	// Builds for different targets can have the same binary, and sum.
+	r0 := testRecord(t, "v1.0.0")
+	r1 := testRecord(t, "v1.0.1")
+	br, err := parseRecord(r0)
+	if err != nil {
+		t.Fatalf("parse record: %v", err)
+	}
+	br.Goos = "freebsd"
+	r2, err := br.packRecord()
+	if err != nil {
+		t.Fatalf("pack record: %v", err)
+	}
+	for i, r := range [][]byte{r0, r1, r2} {
+		if err := testAdd(t, s, r, testResultTmpdir(t, results, int64(i)), filepath.Join(results, fmt.Sprintf("%d", i))); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+	testLookupSum(t, s, r0, 0, 2)
+	testLookupSum(t, s, r1, 1)
+	testLookupSum(t, s, testRecord(t, "v1.0.2"))
+	if _, err := s.lookupSum("bad"); err == nil || os.IsNotExist(err) {
+		t.Fatalf("lookup of bad sum: got %v, expected error", err)
+	}
+
+	// Adding to the index again, as repair does, doesn't change it.
+	if err := s.indexSum(testRecordSum(t, r0), 2); err != nil {
+		t.Fatalf("index sum: %v", err)
+	}
+	testLookupSum(t, s, r0, 0, 2)
+	testCloseStore(s)
+
+	// Without an index, e.g. for a log from before the index existed, it is built
+	// from the records when opening. A leftover of an interrupted rebuild is
+	// discarded.
+	if err := os.RemoveAll(filepath.Join(dir, "bysum")); err != nil {
+		t.Fatalf("remove index: %v", err)
+	}
+	if err := writeSumIndex(filepath.Join(dir, "bysum.tmp", "x", "bogus"), 10); err != nil {
+		t.Fatalf("write bogus index: %v", err)
+	}
+	s, err = openFileStore(dir)
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	defer testCloseStore(s)
+	testLookupSum(t, s, r0, 0, 2)
+	testLookupSum(t, s, r1, 1)
+	if _, err := os.Stat(filepath.Join(dir, "bysum.tmp")); !os.IsNotExist(err) {
+		t.Fatalf("temporary index still present: %v", err)
+	}
+
+	// An empty log gets an empty index.
+	empty := t.TempDir()
+	es, err := openFileStore(empty)
+	if err != nil {
+		t.Fatalf("open empty store: %v", err)
+	}
+	defer testCloseStore(es)
+	if _, err := os.Stat(filepath.Join(empty, "bysum")); err != nil {
+		t.Fatalf("no index for empty log: %v", err)
+	}
+	testLookupSum(t, es, r0)
+}
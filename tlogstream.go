@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/sumdb/note"
+	"golang.org/x/mod/sumdb/tlog"
+)
+
+// Records added to the transparency log are announced to listeners of
+// /tlog/stream. Listeners are only woken up, they read the records themselves.
+// This way a slow listener never misses a record.
+var tlogStream = struct {
+	sync.Mutex
+	size      int64 // Number of records that are completely added and can be streamed.
+	listeners map[chan struct{}]struct{}
+}{
+	listeners: map[chan struct{}]struct{}{},
+}
+
+// Event sent on /tlog/stream for each record. The SSE id is the record number.
+type streamRecord struct {
+	RecordNumber int64
+	Record       string // Packed record, as in the log.
+	Tree         string // Signed tree head for the tree including this record.
+}
+
+// Initialize the size of the tlog that can be streamed, during startup.
+func tlogStreamInit(size int64) {
+	tlogStream.Lock()
+	defer tlogStream.Unlock()
+	tlogStream.size = size
+}
+
+// Called by addSum after a record has been added, to wake up listeners.
+func tlogStreamPublish(recordNumber int64) {
+	tlogStream.Lock()
+	defer tlogStream.Unlock()
+	if recordNumber+1 > tlogStream.size {
+		tlogStream.size = recordNumber + 1
+	}
+	for c := range tlogStream.listeners {
+		// Listeners have a buffer of one, a pending wakeup is good enough.
+		select {
+		case c <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func tlogStreamSubscribe() (chan struct{}, int64) {
+	tlogStream.Lock()
+	defer tlogStream.Unlock()
+	c := make(chan struct{}, 1)
+	tlogStream.listeners[c] = struct{}{}
+	metricTlogStreamListeners.Inc()
+	return c, tlogStream.size
+}
+
+func tlogStreamUnsubscribe(c chan struct{}) {
+	tlogStream.Lock()
+	defer tlogStream.Unlock()
+	delete(tlogStream.listeners, c)
+	metricTlogStreamListeners.Dec()
+}
+
+func tlogStreamSize() int64 {
+	tlogStream.Lock()
+	defer tlogStream.Unlock()
+	return tlogStream.size
+}
+
+// Serve /tlog/stream, sending each newly added record as SSE event. Without
+// Last-Event-ID header, only records added from now on are sent. With
+// Last-Event-ID, records following that record number are sent first.
+func serveTlogStream(signer note.Signer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "405 - Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			log.Println("ResponseWriter not a http.Flusher")
+			failf(w, "%w: implementation limitation: cannot stream updates", errServer)
+			return
+		}
+
+		// Subscribe before determining where to start, so we won't miss records added in
+		// between.
+		c, size := tlogStreamSubscribe()
+		defer tlogStreamUnsubscribe(c)
+
+		next := size
+		if s := strings.TrimSpace(r.Header.Get("Last-Event-ID")); s != "" {
+			last, err := strconv.ParseInt(s, 10, 64)
+			if err != nil || last < -1 || last >= size {
+				http.Error(w, "400 - Bad Request - bad Last-Event-ID", http.StatusBadRequest)
+				return
+			}
+			next = last + 1
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		if _, err := w.Write([]byte(": keepalive\n\n")); err != nil {
+			return
+		}
+		flusher.Flush()
+
+		ctx := r.Context()
+		keepalive := time.NewTicker(time.Minute)
+		defer keepalive.Stop()
+		for {
+			// Send all records we haven't sent yet, in batches.
+			for size := tlogStreamSize(); next < size; {
+				n := size - next
+				if n > 1000 {
+					n = 1000
+				}
+				records, err := serverOps{}.ReadRecords(ctx, next, n)
+				if err != nil {
+					log.Printf("tlog stream: reading records: %v", err)
+					return
+				}
+				for _, record := range records {
+					buf, err := packStreamRecord(signer, next, record)
+					if err != nil {
+						log.Printf("tlog stream: %v", err)
+						return
+					}
+					if _, err := w.Write(buf); err != nil {
+						return
+					}
+					next++
+				}
+				flusher.Flush()
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-c:
+			case <-keepalive.C:
+				if _, err := w.Write([]byte(": keepalive\n\n")); err != nil {
+					return
+				}
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// Make an SSE event for the record, with a signed tree head for the tree that
+// ends with this record.
+func packStreamRecord(signer note.Signer, recordNumber int64, record []byte) ([]byte, error) {
+	h, err := tlog.TreeHash(recordNumber+1, hashReader{})
+	if err != nil {
+		return nil, fmt.Errorf("tree hash: %v", err)
+	}
+	text := tlog.FormatTree(tlog.Tree{N: recordNumber + 1, Hash: h})
+	tree, err := note.Sign(&note.Note{Text: string(text)}, signer)
+	if err != nil {
+		return nil, fmt.Errorf("signing tree: %v", err)
+	}
+	data, err := json.Marshal(streamRecord{recordNumber, string(record), string(tree)})
+	if err != nil {
+		return nil, fmt.Errorf("marshal record: %v", err)
+	}
+	return []byte(fmt.Sprintf("id: %d\nevent: record\ndata: %s\n\n", recordNumber, data)), nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var errBadVariant = errors.New("bad variant")
+
+// Microarchitecture variants of a goarch, selected through an environment
+// variable like GOAMD64. The default of the toolchain is not a variant: it is the
+// build without variant, so the same binary isn't built under two names.
+type archVariants struct {
+	Env      string         // E.g. "GOAMD64".
+	Default  string         // Value when no variant is set, for display.
+	Variants map[string]int // Variant to minimum Go minor version (go1.<minor>).
+}
+
+var variants = map[string]archVariants{
+	"amd64":    {"GOAMD64", "v1", map[string]int{"v2": 18, "v3": 18, "v4": 18}},
+	"arm":      {"GOARM", "7", map[string]int{"5": 0, "6": 0}},
+	"386":      {"GO386", "sse2", map[string]int{"softfloat": 16}},
+	"mips":     {"GOMIPS", "hardfloat", map[string]int{"softfloat": 10}},
+	"mipsle":   {"GOMIPS", "hardfloat", map[string]int{"softfloat": 10}},
+	"mips64":   {"GOMIPS64", "hardfloat", map[string]int{"softfloat": 11}},
+	"mips64le": {"GOMIPS64", "hardfloat", map[string]int{"softfloat": 11}},
+	"ppc64":    {"GOPPC64", "power8", map[string]int{"power9": 11, "power10": 20}},
+	"ppc64le":  {"GOPPC64", "power8", map[string]int{"power9": 11, "power10": 20}},
+}
+
+// Check that variant is valid for goarch, regardless of Go version.
+func checkVariant(goarch, variant string) error {
+	if variant == "" {
+		return nil
+	}
+	if _, ok := variants[goarch].Variants[variant]; !ok {
+		return fmt.Errorf("%w: unknown variant %q for %s", errBadVariant, variant, goarch)
+	}
+	return nil
+}
+
+// Check that the variant of bs is supported by its Go version.
+func checkVariantGoversion(bs buildSpec) error {
+	if bs.Variant == "" {
+		return nil
+	}
+	if err := checkVariant(bs.Goarch, bs.Variant); err != nil {
+		return err
+	}
+	gv, err := parseGoVersion(bs.Goversion)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errBadGoversion, err)
+	}
+	if min := variants[bs.Goarch].Variants[bs.Variant]; gv.minor < min {
+		return fmt.Errorf("%w: %s=%s requires go1.%d or newer", errBadVariant, variants[bs.Goarch].Env, bs.Variant, min)
+	}
+	return nil
+}
+
+// Environment variable to set for the variant of bs. Without variant, the default
+// is set explicitly, the default of a toolchain can depend on the system it was
+// built on.
+func (bs buildSpec) variantEnv() []string {
+	av, ok := variants[bs.Goarch]
+	if !ok {
+		return nil
+	}
+	if bs.Variant == "" {
+		return []string{av.Env + "=" + av.Default}
+	}
+	return []string{av.Env + "=" + bs.Variant}
+}
+
+// Variants for goarch, oldest first, without the default.
+func variantList(goarch string) []string {
+	av := variants[goarch]
+	var l []string
+	for v := range av.Variants {
+		l = append(l, v)
+	}
+	sort.Slice(l, func(i, j int) bool {
+		if av.Variants[l[i]] != av.Variants[l[j]] {
+			return av.Variants[l[i]] < av.Variants[l[j]]
+		}
+		return l[i] < l[j]
+	})
+	return l
+}
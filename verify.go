@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Status of a verifier for a build, as stored in verifiers.json.
+const (
+	verifyAgree       = "agree"       // Same sum.
+	verifyDisagree    = "disagree"    // Different sum.
+	verifyUnavailable = "unavailable" // Error or timeout.
+	verifyPending     = "pending"     // Asynchronous verification still in progress.
+)
+
+type verifierConfig struct {
+	URL     string
+	Timeout time.Duration // Zero means no timeout.
+}
+
+// From config VerifierURLs and Verifiers, set at startup.
+var verifierConfigs []verifierConfig
+
+// Gather the verifiers from the config, and check the quorum.
+func initVerifiers() {
+	for _, u := range config.VerifierURLs {
+		verifierConfigs = append(verifierConfigs, verifierConfig{strings.TrimSuffix(u, "/"), 0})
+	}
+	for _, v := range config.Verifiers {
+		verifierConfigs = append(verifierConfigs, verifierConfig{strings.TrimSuffix(v.URL, "/"), time.Duration(v.Timeout) * time.Second})
+	}
+	if config.VerifyQuorum < 0 || config.VerifyQuorum > len(verifierConfigs) {
+		log.Fatalf("VerifyQuorum %d must be between 0 and the number of verifiers, %d", config.VerifyQuorum, len(verifierConfigs))
+	}
+}
+
+// Number of verifiers that must agree for a build to succeed.
+func verifyQuorum() int {
+	if config.VerifyQuorum == 0 {
+		return len(verifierConfigs)
+	}
+	return config.VerifyQuorum
+}
+
+type verifierResult struct {
+	URL    string
+	Status string
+	Sum    string `json:",omitempty"` // For agree and disagree.
+	Error  string `json:",omitempty"` // For unavailable.
+}
+
+// verification holds the results of the verifiers for a build. It is stored as
+// verifiers.json in the result directory, and shown on the build page.
+type verification struct {
+	Quorum  int
+	Async   bool
+	Results []verifierResult
+}
+
+func (v verification) count(status string) int {
+	n := 0
+	for _, r := range v.Results {
+		if r.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+func (v verification) Agreed() int {
+	return v.count(verifyAgree)
+}
+
+func (v verification) Pending() bool {
+	return v.count(verifyPending) > 0
+}
+
+func (v verification) QuorumReached() bool {
+	return v.Agreed() >= v.Quorum
+}
+
+type remoteBuild struct {
+	verifyURL string
+	err       error
+	result    *buildResult
+}
+
+// Start builds at all verifiers. Results are delivered on the returned channel,
+// which has room for all of them.
+func startVerify(bs buildSpec) chan remoteBuild {
+	c := make(chan remoteBuild, len(verifierConfigs))
+	for _, vc := range verifierConfigs {
+		go func(vc verifierConfig) {
+			ctx := context.Background()
+			if vc.Timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, vc.Timeout)
+				defer cancel()
+			}
+			result, err := verifyRemote(ctx, vc.URL, bs)
+			if err != nil {
+				err = fmt.Errorf("verifying with %s: %w", vc.URL, err)
+			}
+			c <- remoteBuild{vc.URL, err, result}
+		}(vc)
+	}
+	return c
+}
+
+// Let a verifier build bs, returning its build result.
+func verifyRemote(ctx context.Context, verifierBaseURL string, bs buildSpec) (*buildResult, error) {
+	t0 := time.Now()
+	defer func() {
+		metricVerifyDuration.WithLabelValues(verifierBaseURL, bs.Goos, bs.Goarch, bs.Goversion).Observe(time.Since(t0).Seconds())
+	}()
+
+	verifyURL := verifierBaseURL + request{bs, "", pageRecord}.link()
+	resp, err := httpGetContext(ctx, verifyURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: http request: %v", errServer, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		metricVerifyErrors.WithLabelValues(verifierBaseURL, bs.Goos, bs.Goarch, bs.Goversion).Inc()
+		buf, err := io.ReadAll(resp.Body)
+		msg := string(buf)
+		if err != nil {
+			msg = fmt.Sprintf("reading error message: %v", err)
+		}
+		return nil, fmt.Errorf("%w: http error response: %s:\n%s", errRemote, resp.Status, msg)
+	}
+
+	if msg, err := io.ReadAll(resp.Body); err != nil {
+		return nil, fmt.Errorf("reading build result from remote: %v", err)
+	} else if br, err := parseRecord(msg); err != nil {
+		return nil, fmt.Errorf("parsing build record from remote: %v", err)
+	} else {
+		return br, nil
+	}
+}
+
+// Wait for the results of all verifiers, and compare them with our sum.
+func collectVerify(c chan remoteBuild, sum string) verification {
+	v := verification{Quorum: verifyQuorum()}
+	for range verifierConfigs {
+		rb := <-c
+		vr := verifierResult{URL: rb.verifyURL}
+		if rb.err != nil {
+			vr.Status = verifyUnavailable
+			vr.Error = rb.err.Error()
+		} else if rb.result.Sum == sum {
+			vr.Status = verifyAgree
+			vr.Sum = rb.result.Sum
+		} else {
+			vr.Status = verifyDisagree
+			vr.Sum = rb.result.Sum
+			metricVerifyMismatches.WithLabelValues(rb.verifyURL).Inc()
+		}
+		v.Results = append(v.Results, vr)
+	}
+	return v
+}
+
+// Verifiers with a different result, for quarantining.
+func (v verification) disagreeing() []quarantineRemote {
+	var l []quarantineRemote
+	for _, vr := range v.Results {
+		if vr.Status == verifyDisagree {
+			l = append(l, quarantineRemote{vr.URL, vr.Sum})
+		}
+	}
+	return l
+}
+
+// Check if the verification allows publishing the build.
+func (v verification) check(sum string) error {
+	var mismatches, unavailable []string
+	for _, vr := range v.Results {
+		switch vr.Status {
+		case verifyDisagree:
+			mismatches = append(mismatches, fmt.Sprintf("%s got %s", vr.URL, vr.Sum))
+		case verifyUnavailable:
+			unavailable = append(unavailable, vr.Error)
+		}
+	}
+	// A verifier with a different result always fails the build, the quorum is only
+	// about unavailable verifiers.
+	if len(mismatches) > 0 {
+		return fmt.Errorf("build mismatches, we and %d others got %s, but %s (%w)", v.Agreed(), sum, strings.Join(mismatches, ", "), errTempFailure)
+	}
+	if !v.QuorumReached() {
+		return fmt.Errorf("verification quorum not reached, %d verifiers agreed, need %d: %s (%w)", v.Agreed(), v.Quorum, strings.Join(unavailable, "; "), errTempFailure)
+	}
+	return nil
+}
+
+// Wait for verifiers of an already published build, and store the results.
+// Disagreements are logged as alert, they cannot be undone anymore.
+func finishVerifyAsync(br buildResult, c chan remoteBuild) {
+	v := collectVerify(c, br.Sum)
+	v.Async = true
+	for _, vr := range v.Results {
+		if vr.Status == verifyDisagree {
+			log.Printf("ALERT: verifier %s disagrees about published build %s, got %s, we have %s", vr.URL, br.String(), vr.Sum, br.Sum)
+		}
+	}
+	if remotes := v.disagreeing(); len(remotes) > 0 {
+		quarantineStored("verify-async", br, remotes)
+	}
+	if !v.QuorumReached() {
+		log.Printf("verification quorum not reached for published build %s, %d verifiers agreed, need %d", br.String(), v.Agreed(), v.Quorum)
+	}
+	var err error
+	if privsepFrontend {
+		err = privsepWriteVerification(br.buildSpec, v)
+	} else {
+		err = writeVerification(br.storeDir(), v)
+	}
+	if err != nil {
+		log.Printf("storing verification results for %s: %v", br.String(), err)
+	}
+}
+
+// Write verifiers.json to dir.
+func writeVerification(dir string, v verification) error {
+	buf, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return err
+	}
+	p := filepath.Join(dir, "verifiers.json")
+	if err := os.WriteFile(p+".tmp", buf, 0666); err != nil {
+		return err
+	}
+	return os.Rename(p+".tmp", p)
+}
+
+// Read verifiers.json from dir. Returns nil if the build was not verified.
+func readVerification(dir string) (*verification, error) {
+	buf, err := os.ReadFile(filepath.Join(dir, "verifiers.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var v verification
+	if err := json.Unmarshal(buf, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+
+	"github.com/mjl-/sconf"
+	"golang.org/x/mod/sumdb/tlog"
+)
+
+// Kinds of inconsistencies found while verifying the log.
+const (
+	issueStore        = "store"        // Records/hashes files or journal.
+	issueRecord       = "record"       // Record cannot be parsed.
+	issueHashes       = "hashes"       // Stored hashes don't match the record.
+	issueDuplicate    = "duplicate"    // Multiple records for the same key.
+	issueRecordNumber = "recordnumber" // Index file in result directory missing or wrong.
+	issueSumIndex     = "sumindex"     // Record missing from index by sum.
+	issueBinary       = "binary"       // Binary missing or with different sum or size.
+)
+
+type logIssue struct {
+	Record   int64  // -1 for issues not about a single record.
+	Key      string `json:",omitempty"`
+	Kind     string
+	Message  string
+	Repaired bool `json:",omitempty"`
+}
+
+func (li logIssue) String() string {
+	s := fmt.Sprintf("%s: %s", li.Kind, li.Message)
+	if li.Record >= 0 {
+		s = fmt.Sprintf("record %d, %s: %s", li.Record, li.Key, s)
+	}
+	if li.Repaired {
+		s += " (repaired)"
+	}
+	return s
+}
+
+// Summary of verify-log, printed as JSON with -json.
+type logSummary struct {
+	Records  int64
+	Issues   []logIssue
+	Kinds    map[string]int // Number of issues per kind.
+	Repaired int
+}
+
+func verifyLog(args []string) {
+	flags := flag.NewFlagSet("verify-log", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "Repair data that can be derived from the log: missing recordnumber files and sum index entries.")
+	jsonOutput := flags.Bool("json", false, "Print summary as JSON.")
+	flags.Usage = func() {
+		log.Println("usage: gobuild verify-log [flags] [gobuild.conf]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	args = flags.Args()
+	if len(args) > 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if len(args) > 0 {
+		if err := sconf.ParseFile(args[0], &config); err != nil {
+			log.Fatalf("parsing config file: %v", err)
+		}
+	}
+	resultDir = filepath.Join(config.DataDir, "result")
+	initBlobStore()
+
+	summary := logSummary{Issues: []logIssue{}, Kinds: map[string]int{}}
+	addIssue := func(li logIssue) {
+		summary.Issues = append(summary.Issues, li)
+		summary.Kinds[li.Kind]++
+		if li.Repaired {
+			summary.Repaired++
+		}
+		if !*jsonOutput {
+			fmt.Println(li.String())
+		}
+	}
+
+	// We don't replay a journal: a running gobuild may be adding a record right now.
+	store, err := openFileStoreReadonly(filepath.Join(config.DataDir, "sum"))
+	if err != nil {
+		log.Fatalf("opening transparency log: %v", err)
+	}
+	sums = store
+	if _, err := os.Stat(store.journalPath()); err == nil {
+		addIssue(logIssue{Record: -1, Kind: issueStore, Message: "journal present, an addition is in progress or was interrupted"})
+	}
+	if err := store.checkSizes(); err != nil {
+		addIssue(logIssue{Record: -1, Kind: issueStore, Message: err.Error()})
+	}
+
+	n, err := store.treeSize()
+	if err != nil {
+		log.Fatalf("finding number of records in tlog: %v", err)
+	}
+	summary.Records = n
+
+	keys := map[string]int64{}
+	for first := int64(0); first < n; first += 1000 {
+		count := n - first
+		if count > 1000 {
+			count = 1000
+		}
+		records, err := store.readRecords(first, count)
+		if err != nil {
+			log.Fatalf("reading records: %v", err)
+		}
+		for i, record := range records {
+			num := first + int64(i)
+			br, issues := checkRecord(num, record, *repair)
+			if br != nil {
+				key := br.String()
+				if prev, ok := keys[key]; ok {
+					issues = append(issues, logIssue{num, key, issueDuplicate, fmt.Sprintf("key also in record %d", prev), false})
+				} else {
+					keys[key] = num
+				}
+			}
+			for _, li := range issues {
+				addIssue(li)
+			}
+		}
+	}
+
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		if err := enc.Encode(summary); err != nil {
+			log.Fatalf("writing summary: %v", err)
+		}
+	} else {
+		fmt.Printf("checked %d records, %d issues, %d repaired\n", summary.Records, len(summary.Issues), summary.Repaired)
+	}
+	if len(summary.Issues) > summary.Repaired {
+		os.Exit(1)
+	}
+}
+
+// checkRecord verifies the stored hashes for the record, the recordnumber file in
+// the result directory, the sum index, and the sum and size of the binary. With
+// repair, missing recordnumber files and sum index entries are written. The
+// buildResult is nil if the record cannot be parsed.
+func checkRecord(num int64, data []byte, repair bool) (*buildResult, []logIssue) {
+	var issues []logIssue
+
+	br, err := parseRecord(data)
+	if err != nil {
+		return nil, []logIssue{{num, "", issueRecord, fmt.Sprintf("parsing record: %v", err), false}}
+	}
+	key := br.String()
+	add := func(kind string, repaired bool, format string, args ...interface{}) {
+		issues = append(issues, logIssue{num, key, kind, fmt.Sprintf(format, args...), repaired})
+	}
+
+	if hashes, err := tlog.StoredHashes(num, data, hashReader{}); err != nil {
+		add(issueHashes, false, "calculating hashes: %v", err)
+	} else {
+		indexes := make([]int64, len(hashes))
+		for i := range indexes {
+			indexes[i] = tlog.StoredHashIndex(0, num) + int64(i)
+		}
+		if stored, err := sums.readHashes(indexes); err != nil {
+			add(issueHashes, false, "reading hashes: %v", err)
+		} else {
+			for i := range hashes {
+				if hashes[i] != stored[i] {
+					add(issueHashes, false, "hash %d mismatch, got %x, expect %x", i, stored[i][:], hashes[i][:])
+				}
+			}
+		}
+	}
+
+	// Check the recordnumber file is available, i.e. if a lookup will succeed.
+	p := filepath.Join(br.storeDir(), "recordnumber")
+	if buf, err := os.ReadFile(p); err != nil {
+		if !os.IsNotExist(err) || !repair {
+			add(issueRecordNumber, false, "reading recordnumber: %v", err)
+		} else if err := writeRecordNumber(br.storeDir(), num); err != nil {
+			add(issueRecordNumber, false, "missing recordnumber, writing: %v", err)
+		} else {
+			add(issueRecordNumber, true, "missing recordnumber")
+		}
+	} else if xnum, err := strconv.ParseInt(string(buf), 10, 64); err != nil {
+		add(issueRecordNumber, false, "parsing recordnumber: %v", err)
+	} else if xnum != num {
+		add(issueRecordNumber, false, "recordnumber file has %d", xnum)
+	}
+
+	// Check the sum index has the record, for finding builds by sum.
+	if nums, err := sums.lookupSum(br.Sum); err != nil && !os.IsNotExist(err) {
+		add(issueSumIndex, false, "reading sum index: %v", err)
+	} else if !containsInt64(nums, num) {
+		if !repair {
+			add(issueSumIndex, false, "record missing in sum index")
+		} else if err := sums.indexSum(br.Sum, num); err != nil {
+			add(issueSumIndex, false, "record missing in sum index, adding: %v", err)
+		} else {
+			add(issueSumIndex, true, "record missing in sum index")
+		}
+	}
+
+	// And check if the hash of the binary matches the sum.
+	if _, err := blobs.stat(br.storeKey() + "/log.gz"); err == nil && binaryRemoved(br.buildSpec) {
+		// Removed by retention, the build log is kept.
+	} else if sum, size, err := sumGzipBlob(br.storeKey() + "/binary.gz"); err != nil {
+		add(issueBinary, false, "%v", err)
+	} else if sum != br.Sum {
+		add(issueBinary, false, "binary.gz has sum %s, expect %s", sum, br.Sum)
+	} else if size != br.Filesize {
+		add(issueBinary, false, "binary.gz has size %d, expect %d", size, br.Filesize)
+	}
+
+	return br, issues
+}
+
+// Write recordnumber file in dir, creating dir if needed.
+func writeRecordNumber(dir string, num int64) error {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	p := filepath.Join(dir, "recordnumber")
+	if err := os.WriteFile(p+".tmp", []byte(fmt.Sprintf("%d", num)), 0666); err != nil {
+		return err
+	}
+	return os.Rename(p+".tmp", p)
+}
+
+func containsInt64(l []int64, v int64) bool {
+	for _, e := range l {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Calculate sum and size of the decompressed contents of gzip file p.
+func sumGzipFile(p string) (string, int64, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	return sumGzip(f, filepath.Base(p))
+}
+
+func sumGzipBlob(key string) (string, int64, error) {
+	rc, err := blobs.open(key)
+	if err != nil {
+		return "", 0, err
+	}
+	defer rc.Close()
+	return sumGzip(rc, path.Base(key))
+}
+
+// Sum and size of the uncompressed data from r, a gzip file with name.
+func sumGzip(r io.Reader, name string) (string, int64, error) {
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return "", 0, fmt.Errorf("gzip reader for %s: %v", name, err)
+	}
+	h := sha256.New()
+	size, err := io.Copy(h, gzr)
+	if err != nil {
+		return "", 0, fmt.Errorf("reading %s: %v", name, err)
+	}
+	return "0" + base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:20]), size, nil
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mjl-/sconf"
+)
+
+// How often a worker checks if its job is still wanted by the coordinator.
+const workerJobCheckInterval = 10 * time.Second
+
+type workerClient struct {
+	baseURL  string
+	token    string
+	capacity int
+}
+
+// Run a worker that builds for a coordinator, which dispatches builds to it.
+func worker(args []string) {
+	workerFlags := flag.NewFlagSet("worker", flag.ExitOnError)
+
+	baseURL := workerFlags.String("url", "http://localhost:8000", "base URL of gobuild instance to build for")
+	tokenFile := workerFlags.String("tokenfile", "", "file containing token for authenticating to the gobuild instance, as configured in its Workers")
+	capacity := workerFlags.Int("capacity", runtime.NumCPU(), "maximum concurrent builds")
+
+	workerFlags.Usage = func() {
+		log.Println("usage: gobuild worker [flags] [gobuild.conf]")
+		workerFlags.PrintDefaults()
+	}
+	workerFlags.Parse(args)
+	args = workerFlags.Args()
+	if len(args) > 1 || *tokenFile == "" || *capacity <= 0 {
+		workerFlags.Usage()
+		os.Exit(2)
+	}
+	if len(args) > 0 {
+		if err := sconf.ParseFile(args[0], &config); err != nil {
+			log.Fatalf("parsing config file: %v", err)
+		}
+	}
+	if !strings.HasSuffix(config.GoProxy, "/") {
+		config.GoProxy += "/"
+	}
+	if config.SDKVersionStop != "" {
+		v, err := parseGoVersion(config.SDKVersionStop)
+		if err != nil {
+			log.Fatalf("parsing MaxSDKVersion %q from config: %s", config.SDKVersionStop, err)
+		}
+		sdkVersionStop = &v
+	}
+	buf, err := os.ReadFile(*tokenFile)
+	if err != nil {
+		log.Fatalf("reading token: %v", err)
+	}
+
+	initBuildDirs()
+	initBuildModcaches()
+	initGoproxy()
+	initSDK()
+	go diskUsageLoop()
+
+	wc := workerClient{strings.TrimRight(*baseURL, "/"), strings.TrimSpace(string(buf)), *capacity}
+	log.Printf("worker building for %s, capacity %d", wc.baseURL, wc.capacity)
+	for i := 0; i < wc.capacity; i++ {
+		go wc.run()
+	}
+	select {}
+}
+
+// Poll for jobs and execute them, forever.
+func (wc workerClient) run() {
+	for {
+		job, err := wc.poll()
+		if err != nil {
+			log.Printf("polling for job: %v", err)
+			time.Sleep(5 * time.Second)
+			continue
+		} else if job == nil {
+			continue
+		}
+		log.Printf("building %s", job.BuildSpec)
+		if err := wc.execute(*job); err != nil {
+			log.Printf("build %s: %v", job.BuildSpec, err)
+		}
+	}
+}
+
+func (wc workerClient) request(method, path, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, wc.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+wc.token)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// Wait for a job. Returns nil without error if no job was available.
+func (wc workerClient) poll() (*workerJob, error) {
+	sdk.Lock()
+	status := workerStatus{Capacity: wc.capacity}
+	for goversion := range sdk.installed {
+		status.Goversions = append(status.Goversions, goversion)
+	}
+	sdk.Unlock()
+	sort.Strings(status.Goversions)
+
+	buf, err := json.Marshal(status)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := wc.request("POST", "/worker/poll", "application/json", bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return nil, nil
+	case http.StatusOK:
+	default:
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var job workerJob
+	if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+		return nil, fmt.Errorf("parsing job: %v", err)
+	}
+	return &job, nil
+}
+
+// Build the job, and send the result to the coordinator.
+func (wc workerClient) execute(job workerJob) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Stop the build when the coordinator no longer wants it.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(workerJobCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			resp, err := wc.request("GET", "/worker/job/"+job.ID, "", nil)
+			if err != nil {
+				log.Printf("checking job status: %v", err)
+				continue
+			}
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusGone {
+				log.Printf("build %s no longer wanted, stopping", job.BuildSpec)
+				cancel()
+				return
+			}
+		}
+	}()
+
+	var result workerResult
+	resultPath, output, cleanup, err := wc.compile(ctx, job.BuildSpec)
+	defer cleanup()
+	result.Output = string(output)
+	if reason, ok := buildAbortReason(err); ok {
+		if ctx.Err() == context.Canceled {
+			// Coordinator is no longer interested in a result.
+			return err
+		}
+		result.Status = workerResultAbort
+		result.Reason = reason
+		result.Error = err.Error()
+	} else if err != nil {
+		if errors.Is(err, errCompile) {
+			result.Status = workerResultCompile
+		} else {
+			result.Status = workerResultError
+		}
+		result.Error = err.Error()
+	} else {
+		result.Status = workerResultOK
+	}
+	return wc.sendResult(job, result, resultPath)
+}
+
+// Prepare and compile bs, like a local build. Only a failing go command for the
+// compile results in an error wrapping errCompile.
+func (wc workerClient) compile(ctx context.Context, bs buildSpec) (string, []byte, func(), error) {
+	if config.BuildTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(config.BuildTimeout)*time.Second)
+		defer cancel()
+	}
+
+	if err := ensureSDK(bs.Goversion); err != nil {
+		return "", nil, func() {}, fmt.Errorf("ensuring toolchain %q: %v", bs.Goversion, err)
+	}
+	cacheLock.RLock()
+	defer cacheLock.RUnlock()
+	gobin, err := ensureGobin(bs.Goversion)
+	if err != nil {
+		return "", nil, func() {}, err
+	}
+	modDir, getOutput, err := ensureModule(bs.Goversion, gobin, bs.Mod, bs.Version)
+	if err != nil {
+		return "", getOutput, func() {}, fmt.Errorf("error fetching module from goproxy: %v", err)
+	}
+	opts, err := checkOptions(bs, modDir)
+	if err != nil {
+		return "", nil, func() {}, err
+	}
+	// Fetch the dependencies, like the coordinator did when preparing the build. We
+	// don't necessarily share its module cache. Failures are not compile errors, the
+	// coordinator must not store them as failed build.
+	if err := checkPackage(bs, gobin, modDir, opts); err != nil {
+		return "", nil, func() {}, fmt.Errorf("preparing build: %v", err)
+	}
+	return compile(ctx, bs, gobin, opts)
+}
+
+// Post the result, with binary at resultPath for successful builds.
+func (wc workerClient) sendResult(job workerJob, result workerResult, resultPath string) error {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		pw.CloseWithError(writeWorkerResult(mw, result, resultPath))
+	}()
+	resp, err := wc.request("POST", "/worker/job/"+job.ID, mw.FormDataContentType(), pr)
+	pr.Close()
+	if err != nil {
+		return fmt.Errorf("sending result: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("sending result: unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func writeWorkerResult(mw *multipart.Writer, result workerResult, resultPath string) error {
+	rw, err := mw.CreateFormField("result")
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(rw).Encode(result); err != nil {
+		return err
+	}
+	if result.Status == workerResultOK {
+		f, err := os.Open(resultPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		bw, err := mw.CreateFormFile("binary", "binary")
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(bw, f); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// Add mod@version with files to the file-based module proxy at dir. Returns the
+// go.sum lines for the module.
+func testProxyModule(t *testing.T, dir, mod, version string, files map[string]string) string {
+	t.Helper()
+	vdir := filepath.Join(dir, mod, "@v")
+	if err := os.MkdirAll(vdir, 0777); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	write := func(name, data string) {
+		if err := os.WriteFile(filepath.Join(vdir, name), []byte(data), 0666); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	write("list", version+"\n")
+	write(version+".info", fmt.Sprintf(`{"Version": %q, "Time": "2024-01-01T00:00:00Z"}`, version))
+	write(version+".mod", files["go.mod"])
+
+	zp := filepath.Join(vdir, version+".zip")
+	f, err := os.Create(zp)
+	if err != nil {
+		t.Fatalf("create zip: %v", err)
+	}
+	zw := zip.NewWriter(f)
+	for name, data := range files {
+		w, err := zw.Create(mod + "@" + version + "/" + name)
+		if err != nil {
+			t.Fatalf("zip: %v", err)
+		}
+		w.Write([]byte(data))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("zip: %v", err)
+	} else if err := f.Close(); err != nil {
+		t.Fatalf("zip: %v", err)
+	}
+
+	zipHash, err := hashModuleZip(zp)
+	if err != nil {
+		t.Fatalf("hash zip: %v", err)
+	}
+	h := sha256.Sum256([]byte(files["go.mod"]))
+	mh := sha256.Sum256([]byte(fmt.Sprintf("%x  go.mod\n", h)))
+	modHash := "h1:" + base64.StdEncoding.EncodeToString(mh[:])
+	return fmt.Sprintf("%s %s %s\n%s %s/go.mod %s\n", mod, version, zipHash, mod, version, modHash)
+}
+
+// A worker with its own HomeDir must fetch the dependencies itself.
+func TestWorkerCompile(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds with the go toolchain")
+	}
+	goversion := runtime.Version()
+	if _, err := parseGoVersion(goversion); err != nil {
+		t.Skipf("toolchain %s not a release", goversion)
+	}
+	gocache, err := exec.Command(filepath.Join(runtime.GOROOT(), "bin", "go"), "env", "GOCACHE").Output()
+	if err != nil {
+		t.Fatalf("go env GOCACHE: %v", err)
+	}
+
+	proxyDir := t.TempDir()
+	depSum := testProxyModule(t, proxyDir, "example.com/dep", "v1.0.0", map[string]string{
+		"go.mod": "module example.com/dep\n\ngo 1.21\n",
+		"dep.go": "package dep\n\nfunc Hello() string { return \"hello\" }\n",
+	})
+	testProxyModule(t, proxyDir, "example.com/cmd", "v1.0.0", map[string]string{
+		"go.mod":  "module example.com/cmd\n\ngo 1.21\n\nrequire example.com/dep v1.0.0\n",
+		"go.sum":  depSum,
+		"main.go": "package main\n\nimport \"example.com/dep\"\n\nfunc main() {\n\tprintln(dep.Hello())\n}\n",
+	})
+	testProxyModule(t, proxyDir, "example.com/broken", "v1.0.0", map[string]string{
+		"go.mod":  "module example.com/broken\n\ngo 1.21\n\nrequire example.com/missing v1.0.0\n",
+		"main.go": "package main\n\nimport \"example.com/missing\"\n\nfunc main() {\n\tmissing.Hello()\n}\n",
+	})
+
+	origConfig := config
+	defer func() {
+		config = origConfig
+		sdk.Lock()
+		sdk.installed = nil
+		sdk.Unlock()
+	}()
+	config.SDKDir = t.TempDir()
+	if err := os.Symlink(runtime.GOROOT(), filepath.Join(config.SDKDir, goversion)); err != nil {
+		t.Fatalf("symlink toolchain: %v", err)
+	}
+	sdk.Lock()
+	sdk.installed = map[string]struct{}{goversion: {}}
+	sdk.Unlock()
+	config.GoProxy = "file://" + filepath.ToSlash(proxyDir) + "/"
+	config.GoNoSumDB = "example.com"
+	// Writable module caches, for removing the temporary directories.
+	config.Environment = []string{"GOCACHE=" + strings.TrimSpace(string(gocache)), "GOFLAGS=-modcacherw"}
+	config.HomeDir = t.TempDir()
+	initBuildDirs()
+	initBuildModcaches()
+
+	wc := workerClient{}
+	bs := buildSpec{"example.com/cmd", "v1.0.0", "/", runtime.GOOS, runtime.GOARCH, "", goversion, ""}
+	path, output, cleanup, err := wc.compile(context.Background(), bs)
+	if err != nil {
+		t.Fatalf("compile: %v\n%s", err, output)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("binary: %v", err)
+	}
+	cleanup()
+
+	// Failing to fetch dependencies is not a compile error, it must not be stored as
+	// failed build.
+	bs.Mod = "example.com/broken"
+	_, _, cleanup, err = wc.compile(context.Background(), bs)
+	cleanup()
+	if err == nil || errors.Is(err, errCompile) {
+		t.Fatalf("compile with missing dependency: got err %v, expected error that is not a compile error", err)
+	}
+}
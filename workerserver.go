@@ -0,0 +1,489 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Remote workers connect to the coordinator over HTTP, with a token from config
+// Workers. A worker long-polls for a job at /worker/poll, advertising its
+// capacity and installed SDKs. It fetches the module and compiles, checking the
+// status of the job at /worker/job/<id> to learn if it was canceled, and posts
+// the binary and output to /worker/job/<id>. The coordinator hashes, verifies
+// and publishes the binary like for a local build.
+
+const (
+	workerPollTimeout = 30 * time.Second // Long-poll, worker polls again after.
+	workerExpiry      = 2 * time.Minute  // Without polls, worker is gone, not counted in capacity.
+)
+
+// Without job status checks, worker is gone. Variable for tests.
+var workerJobExpiry = time.Minute
+
+// Sent by worker when polling.
+type workerStatus struct {
+	Capacity   int      // Max concurrent builds.
+	Goversions []string // Installed SDKs.
+}
+
+// Job for a worker, response to a poll.
+type workerJob struct {
+	ID        string
+	BuildSpec buildSpec
+}
+
+// Status of a job, posted by worker along with the binary.
+const (
+	workerResultOK      = "ok"      // Binary included.
+	workerResultCompile = "compile" // Compile failed, confirmed locally before storing as failed build.
+	workerResultAbort   = "abort"   // Build stopped, Reason set.
+	workerResultError   = "error"   // Other error, e.g. fetching module or SDK.
+)
+
+type workerResult struct {
+	Status string
+	Reason string `json:",omitempty"` // For abort: timeout, idle or canceled.
+	Error  string `json:",omitempty"`
+	Output string `json:",omitempty"` // Output of go command.
+}
+
+// Connected worker, shown on the admin queue page.
+type workerInfo struct {
+	Name       string
+	Capacity   int
+	Goversions []string
+	Running    int
+	LastSeen   time.Time
+}
+
+// Poll waiting for a job.
+type workerPoll struct {
+	worker string
+	jobc   chan *remoteJob // Buffered, 1.
+}
+
+type remoteJob struct {
+	job      workerJob
+	worker   string
+	lastSeen time.Time
+	resultc  chan remoteResult // Buffered, 1.
+}
+
+type remoteResult struct {
+	result workerResult
+	path   string // Of binary in resultDir, for workerResultOK.
+}
+
+// Dispatch of builds to local execution or remote workers.
+var dispatch = struct {
+	sync.Mutex
+	workers     map[string]*workerInfo
+	polls       []*workerPoll
+	jobs        map[string]*remoteJob
+	localActive int
+	changed     chan struct{} // Closed and replaced on changes.
+}{
+	workers: map[string]*workerInfo{},
+	jobs:    map[string]*remoteJob{},
+	changed: make(chan struct{}),
+}
+
+// Must be called with dispatch lock held.
+func dispatchChanged() {
+	close(dispatch.changed)
+	dispatch.changed = make(chan struct{})
+}
+
+// Maximum number of concurrent local builds.
+func maxLocalBuilds() int {
+	if config.MaxBuilds == 0 {
+		return runtime.NumCPU() + 1
+	}
+	return config.MaxBuilds
+}
+
+// Summed capacity of active workers, used by the coordinator in addition to
+// local builds.
+func remoteCapacity() int {
+	dispatch.Lock()
+	defer dispatch.Unlock()
+	n := 0
+	for _, w := range dispatch.workers {
+		if time.Since(w.LastSeen) < workerExpiry {
+			n += w.Capacity
+		}
+	}
+	return n
+}
+
+// Active workers, for the admin page.
+func workerList() []workerInfo {
+	dispatch.Lock()
+	defer dispatch.Unlock()
+	var l []workerInfo
+	for _, w := range dispatch.workers {
+		if time.Since(w.LastSeen) < workerExpiry {
+			l = append(l, *w)
+		}
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].Name < l[j].Name
+	})
+	return l
+}
+
+// Take a waiting poll, from a worker with the SDK for goversion if withSDK is set.
+// Must be called with dispatch lock held.
+func takePoll(goversion string, withSDK bool) *workerPoll {
+	for i, p := range dispatch.polls {
+		w := dispatch.workers[p.worker]
+		if w.Running >= w.Capacity {
+			continue
+		}
+		has := false
+		for _, gv := range w.Goversions {
+			if gv == goversion {
+				has = true
+			}
+		}
+		if has == withSDK {
+			dispatch.polls = append(dispatch.polls[:i], dispatch.polls[i+1:]...)
+			return p
+		}
+	}
+	return nil
+}
+
+// Compile bs locally or on a worker. Workers that have the SDK are preferred, then
+// local builds if below MaxBuilds, then workers that have to fetch the SDK. If
+// none are available, we wait. A compile failure on a worker is confirmed with a
+// local compile, only that is stored as failed build. A worker with a broken
+// environment, or a misbehaving worker, cannot make a build fail permanently.
+func compileDispatch(ctx context.Context, bs buildSpec, gobin string, opts buildOptions) (string, []byte, func(), error) {
+	localOnly := false
+	for {
+		dispatch.Lock()
+		var p *workerPoll
+		if !localOnly {
+			p = takePoll(bs.Goversion, true)
+		}
+		if p == nil && dispatch.localActive < maxLocalBuilds() {
+			dispatch.localActive++
+			dispatch.Unlock()
+			defer func() {
+				dispatch.Lock()
+				dispatch.localActive--
+				dispatchChanged()
+				dispatch.Unlock()
+			}()
+			return compile(ctx, bs, gobin, opts)
+		}
+		if p == nil && !localOnly {
+			p = takePoll(bs.Goversion, false)
+		}
+		if p != nil {
+			buf := make([]byte, 12)
+			if _, err := rand.Read(buf); err != nil {
+				dispatch.Unlock()
+				return "", nil, func() {}, fmt.Errorf("%w: random job id: %v", errServer, err)
+			}
+			j := &remoteJob{
+				job:      workerJob{base64.RawURLEncoding.EncodeToString(buf), bs},
+				worker:   p.worker,
+				lastSeen: time.Now(),
+				resultc:  make(chan remoteResult, 1),
+			}
+			dispatch.jobs[j.job.ID] = j
+			dispatch.workers[p.worker].Running++
+			dispatch.Unlock()
+			p.jobc <- j
+			resultPath, output, cleanup, err := compileRemote(ctx, j)
+			if errors.Is(err, errCompile) {
+				log.Printf("build %s: %v, confirming with local compile", bs, err)
+				cleanup()
+				localOnly = true
+				continue
+			}
+			return resultPath, output, cleanup, err
+		}
+		changed := dispatch.changed
+		dispatch.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return "", nil, func() {}, fmt.Errorf("%w: waiting for worker", contextAbort(ctx))
+		case <-changed:
+		}
+	}
+}
+
+// Wait for the result of a job from a worker.
+func compileRemote(ctx context.Context, j *remoteJob) (string, []byte, func(), error) {
+	log.Printf("build %s dispatched to worker %s", j.job.BuildSpec, j.worker)
+
+	// Remove the job. The worker learns about it when checking its status.
+	remove := func() {
+		dispatch.Lock()
+		defer dispatch.Unlock()
+		delete(dispatch.jobs, j.job.ID)
+		if w, ok := dispatch.workers[j.worker]; ok {
+			w.Running--
+		}
+		dispatchChanged()
+		select {
+		case res := <-j.resultc:
+			if res.path != "" {
+				os.Remove(res.path)
+			}
+		default:
+		}
+	}
+
+	ticker := time.NewTicker(workerJobExpiry / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			remove()
+			return "", nil, func() {}, fmt.Errorf("%w: on worker %s", contextAbort(ctx), j.worker)
+
+		case <-ticker.C:
+			dispatch.Lock()
+			expired := time.Since(j.lastSeen) > workerJobExpiry
+			dispatch.Unlock()
+			if expired {
+				remove()
+				return "", nil, func() {}, fmt.Errorf("worker %s stopped responding (%w)", j.worker, errTempFailure)
+			}
+
+		case res := <-j.resultc:
+			remove()
+			r := res.result
+			output := []byte(r.Output)
+			switch r.Status {
+			case workerResultOK:
+				return res.path, output, func() { os.Remove(res.path) }, nil
+			case workerResultCompile:
+				msg := strings.TrimPrefix(r.Error, errCompile.Error()+": ")
+				return "", output, func() {}, fmt.Errorf("%w: on worker %s: %s", errCompile, j.worker, msg)
+			case workerResultAbort:
+				err := errBuildCanceled
+				switch r.Reason {
+				case "timeout":
+					err = errBuildTimeout
+				case "idle":
+					err = errBuildIdle
+				}
+				return "", output, func() {}, fmt.Errorf("%w: on worker %s: %s", err, j.worker, r.Error)
+			default:
+				return "", output, func() {}, fmt.Errorf("on worker %s: %s (%w)", j.worker, r.Error, errTempFailure)
+			}
+		}
+	}
+}
+
+// Name of the worker for the token in the request, or empty if not valid.
+func workerAuth(r *http.Request) string {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		return ""
+	}
+	for _, w := range config.Workers {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(w.Token)) == 1 {
+			return w.Name
+		}
+	}
+	return ""
+}
+
+// Serve /worker/poll and /worker/job/<id> for remote workers.
+func serveWorker(w http.ResponseWriter, r *http.Request) {
+	name := workerAuth(r)
+	if name == "" {
+		http.Error(w, "401 - Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/worker/poll" && r.Method == "POST":
+		serveWorkerPoll(w, r, name)
+	case strings.HasPrefix(r.URL.Path, "/worker/job/") && r.Method == "GET":
+		serveWorkerJobStatus(w, r, name, strings.TrimPrefix(r.URL.Path, "/worker/job/"))
+	case strings.HasPrefix(r.URL.Path, "/worker/job/") && r.Method == "POST":
+		serveWorkerJobResult(w, r, name, strings.TrimPrefix(r.URL.Path, "/worker/job/"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func serveWorkerPoll(w http.ResponseWriter, r *http.Request, name string) {
+	var status workerStatus
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&status); err != nil {
+		failf(w, "parsing worker status: %v", err)
+		return
+	}
+
+	p := &workerPoll{name, make(chan *remoteJob, 1)}
+	dispatch.Lock()
+	wi, ok := dispatch.workers[name]
+	if !ok {
+		log.Printf("worker %s connected, capacity %d", name, status.Capacity)
+		wi = &workerInfo{Name: name}
+		dispatch.workers[name] = wi
+	}
+	wi.Capacity = status.Capacity
+	wi.Goversions = status.Goversions
+	wi.LastSeen = time.Now()
+	dispatch.polls = append(dispatch.polls, p)
+	dispatchChanged()
+	dispatch.Unlock()
+
+	// Capacity may have changed, the coordinator may be able to start more builds.
+	kickBuilds()
+
+	var j *remoteJob
+	t := time.NewTimer(workerPollTimeout)
+	defer t.Stop()
+	select {
+	case j = <-p.jobc:
+	case <-t.C:
+	case <-r.Context().Done():
+	}
+	if j == nil {
+		dispatch.Lock()
+		for i, op := range dispatch.polls {
+			if op == p {
+				dispatch.polls = append(dispatch.polls[:i], dispatch.polls[i+1:]...)
+				break
+			}
+		}
+		dispatch.Unlock()
+		// A job may have been given to the poll before we removed it.
+		select {
+		case j = <-p.jobc:
+		default:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(j.job) // Errors are noticed by not hearing from the worker.
+}
+
+// Look up a job of a worker, marking it as seen.
+func workerJobSeen(name, id string) (*remoteJob, bool) {
+	dispatch.Lock()
+	defer dispatch.Unlock()
+	j, ok := dispatch.jobs[id]
+	if !ok || j.worker != name {
+		return nil, false
+	}
+	j.lastSeen = time.Now()
+	if wi, ok := dispatch.workers[name]; ok {
+		wi.LastSeen = time.Now()
+	}
+	return j, true
+}
+
+// Respond with 200 if the job should continue, 410 if it was canceled.
+func serveWorkerJobStatus(w http.ResponseWriter, r *http.Request, name, id string) {
+	if _, ok := workerJobSeen(name, id); !ok {
+		http.Error(w, "410 - Gone", http.StatusGone)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Receive the result of a job, as multipart form with a "result" JSON part, and a
+// "binary" part for successful builds.
+func serveWorkerJobResult(w http.ResponseWriter, r *http.Request, name, id string) {
+	if _, ok := workerJobSeen(name, id); !ok {
+		http.Error(w, "410 - Gone", http.StatusGone)
+		return
+	}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		failf(w, "reading multipart result: %v", err)
+		return
+	}
+	var res remoteResult
+	defer func() {
+		if res.path != "" {
+			os.Remove(res.path)
+		}
+	}()
+	var haveResult bool
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			failf(w, "reading multipart result: %v", err)
+			return
+		}
+		switch part.FormName() {
+		case "result":
+			if err := json.NewDecoder(part).Decode(&res.result); err != nil {
+				failf(w, "parsing result: %v", err)
+				return
+			}
+			haveResult = true
+		case "binary":
+			if err := receiveBinary(part, &res); err != nil {
+				failf(w, "%w: storing binary: %v", errServer, err)
+				return
+			}
+		}
+	}
+	if !haveResult || res.result.Status == workerResultOK && res.path == "" {
+		failf(w, "missing result or binary")
+		return
+	}
+
+	dispatch.Lock()
+	j, ok := dispatch.jobs[id]
+	if ok {
+		select {
+		case j.resultc <- res:
+			res.path = "" // Now owned by compileRemote.
+		default:
+			ok = false
+		}
+	}
+	dispatch.Unlock()
+	if !ok {
+		http.Error(w, "410 - Gone", http.StatusGone)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func receiveBinary(part *multipart.Part, res *remoteResult) error {
+	f, err := os.CreateTemp(stagingDir(), "tmpworker")
+	if err != nil {
+		return err
+	}
+	res.path = f.Name()
+	if _, err := io.Copy(f, part); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
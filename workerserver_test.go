@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testDispatchResult struct {
+	path    string
+	output  []byte
+	cleanup func()
+	err     error
+}
+
+// Poll for a job in the background, with status instead of the installed SDKs.
+func testWorkerPoll(t *testing.T, wc workerClient, status workerStatus) chan *workerJob {
+	t.Helper()
+	jobc := make(chan *workerJob, 1)
+	go func() {
+		buf, err := json.Marshal(status)
+		if err != nil {
+			panic(err)
+		}
+		resp, err := wc.request("POST", "/worker/poll", "application/json", bytes.NewReader(buf))
+		if err != nil {
+			jobc <- nil
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			jobc <- nil
+			return
+		}
+		var job workerJob
+		if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+			jobc <- nil
+			return
+		}
+		jobc <- &job
+	}()
+	return jobc
+}
+
+func testWaitPolls(t *testing.T, n int) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		dispatch.Lock()
+		have := len(dispatch.polls)
+		dispatch.Unlock()
+		if have == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("waiting for %d polls, timeout", n)
+}
+
+func testJob(t *testing.T, jobc chan *workerJob, bs buildSpec) workerJob {
+	t.Helper()
+	select {
+	case j := <-jobc:
+		if j == nil {
+			t.Fatalf("poll failed")
+		}
+		if j.BuildSpec != bs {
+			t.Fatalf("got job for %s, expected %s", j.BuildSpec, bs)
+		}
+		return *j
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no job for %s", bs)
+	}
+	panic("not reached")
+}
+
+func testDispatch(bs buildSpec) chan testDispatchResult {
+	rc := make(chan testDispatchResult, 1)
+	go func() {
+		path, output, cleanup, err := compileDispatch(context.Background(), bs, "", buildOptions{})
+		rc <- testDispatchResult{path, output, cleanup, err}
+	}()
+	return rc
+}
+
+func testDispatchWait(t *testing.T, rc chan testDispatchResult) testDispatchResult {
+	t.Helper()
+	select {
+	case r := <-rc:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no result from dispatch")
+	}
+	panic("not reached")
+}
+
+func testRunning(t *testing.T, worker string, n int) {
+	t.Helper()
+	dispatch.Lock()
+	running := dispatch.workers[worker].Running
+	dispatch.Unlock()
+	if running != n {
+		t.Fatalf("worker %s has %d running, expected %d", worker, running, n)
+	}
+}
+
+func TestWorkerDispatch(t *testing.T) {
+	resultDir = t.TempDir()
+	if err := json.Unmarshal([]byte(`[{"Name": "a", "Token": "tokena"}, {"Name": "b", "Token": "tokenb"}]`), &config.Workers); err != nil {
+		t.Fatalf("workers config: %v", err)
+	}
+	defer func() {
+		config.Workers = nil
+		dispatch.Lock()
+		dispatch.workers = map[string]*workerInfo{}
+		dispatch.polls = nil
+		dispatch.jobs = map[string]*remoteJob{}
+		dispatch.localActive = 0
+		dispatch.Unlock()
+	}()
+
+	// No local builds, only remote.
+	dispatch.Lock()
+	dispatch.localActive = maxLocalBuilds()
+	dispatch.Unlock()
+
+	ts := httptest.NewServer(http.HandlerFunc(serveWorker))
+	defer ts.Close()
+	wa := workerClient{ts.URL, "tokena", 1}
+	wb := workerClient{ts.URL, "tokenb", 2}
+
+	if _, err := (workerClient{ts.URL, "bad", 1}).poll(); err == nil {
+		t.Fatalf("poll with bad token succeeded")
+	}
+
+	// Worker b polls first, but a has the SDK and is preferred.
+	pb := testWorkerPoll(t, wb, workerStatus{2, nil})
+	testWaitPolls(t, 1)
+	pa := testWorkerPoll(t, wa, workerStatus{1, []string{"go1.21.0"}})
+	testWaitPolls(t, 2)
+	if n := remoteCapacity(); n != 3 {
+		t.Fatalf("remote capacity %d, expected 3", n)
+	}
+
+	bs1 := buildSpec{"example.com/cmd", "v1.0.0", "/", "linux", "amd64", "", "go1.21.0", ""}
+	rc1 := testDispatch(bs1)
+	job1 := testJob(t, pa, bs1)
+	testRunning(t, "a", 1)
+
+	// Worker a is at capacity, so b gets the next build, without the SDK.
+	pa2 := testWorkerPoll(t, wa, workerStatus{1, []string{"go1.21.0"}})
+	testWaitPolls(t, 2)
+	bs2 := bs1
+	bs2.Version = "v1.0.1"
+	rc2 := testDispatch(bs2)
+	job2 := testJob(t, pb, bs2)
+	testRunning(t, "a", 1)
+	testRunning(t, "b", 1)
+
+	binary := filepath.Join(t.TempDir(), "binary")
+	if err := os.WriteFile(binary, []byte("binary"), 0666); err != nil {
+		t.Fatalf("write binary: %v", err)
+	}
+	if err := wa.sendResult(job1, workerResult{Status: workerResultOK, Output: "output"}, binary); err != nil {
+		t.Fatalf("send result: %v", err)
+	}
+	r1 := testDispatchWait(t, rc1)
+	if r1.err != nil {
+		t.Fatalf("dispatch: %v", r1.err)
+	}
+	if buf, err := os.ReadFile(r1.path); err != nil || string(buf) != "binary" || string(r1.output) != "output" {
+		t.Fatalf("got binary %q, output %q, err %v", buf, r1.output, err)
+	}
+	r1.cleanup()
+	if _, err := os.Stat(r1.path); !os.IsNotExist(err) {
+		t.Fatalf("binary not removed by cleanup: %v", err)
+	}
+	testRunning(t, "a", 0)
+
+	// A compile failure on a worker is confirmed locally, not with another worker.
+	if err := wb.sendResult(job2, workerResult{Status: workerResultCompile, Error: "compile failed: exit status 1"}, ""); err != nil {
+		t.Fatalf("send result: %v", err)
+	}
+	testWaitPolls(t, 1)
+	select {
+	case r2 := <-rc2:
+		t.Fatalf("dispatch finished without local compile, err %v", r2.err)
+	case j := <-pa2:
+		t.Fatalf("job %s sent to other worker", j.BuildSpec)
+	case <-time.After(100 * time.Millisecond):
+	}
+	testRunning(t, "b", 0)
+	dispatch.Lock()
+	dispatch.localActive--
+	dispatchChanged()
+	dispatch.Unlock()
+	// The local compile fails too, there is no go command.
+	if r2 := testDispatchWait(t, rc2); !errors.Is(r2.err, errCompile) || strings.Contains(r2.err.Error(), "on worker") {
+		t.Fatalf("dispatch: got err %v, expected local compile error", r2.err)
+	}
+
+	// With local capacity, a worker with the SDK is still preferred. Worker a then
+	// disappears during the job.
+	workerJobExpiry = 200 * time.Millisecond
+	defer func() {
+		workerJobExpiry = time.Minute
+	}()
+	dispatch.Lock()
+	dispatch.localActive = 0
+	dispatch.Unlock()
+	bs3 := bs1
+	bs3.Version = "v1.0.2"
+	rc3 := testDispatch(bs3)
+	job3 := testJob(t, pa2, bs3)
+	if r3 := testDispatchWait(t, rc3); !errors.Is(r3.err, errTempFailure) {
+		t.Fatalf("dispatch: got err %v, expected temporary failure", r3.err)
+	}
+	testRunning(t, "a", 0)
+	if err := wa.sendResult(job3, workerResult{Status: workerResultOK}, binary); err == nil {
+		t.Fatalf("late result accepted")
+	}
+	if resp, err := wa.request("GET", "/worker/job/"+job3.ID, "", nil); err != nil {
+		t.Fatalf("job status: %v", err)
+	} else if resp.Body.Close(); resp.StatusCode != http.StatusGone {
+		t.Fatalf("job status %s, expected 410 gone", resp.Status)
+	}
+
+	// Workers that stopped polling don't count.
+	dispatch.Lock()
+	for _, w := range dispatch.workers {
+		w.LastSeen = time.Now().Add(-workerExpiry)
+	}
+	dispatch.Unlock()
+	if n := remoteCapacity(); n != 0 {
+		t.Fatalf("remote capacity %d after expiry, expected 0", n)
+	}
+}